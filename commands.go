@@ -0,0 +1,773 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/TheDiscordian/ipfs-sync/ipfssync"
+)
+
+// Command is a subcommand of ipfs-sync, like `ipfs-sync status`.
+type Command struct {
+	Name  string
+	Args  string // usage of positional arguments, optional ones in brackets
+	Usage string
+	// Daemon is called if the daemon is running, Direct if it isn't, either may be nil if unsupported.
+	Daemon func(args []string, jsonOut bool) error
+	Direct func(args []string, jsonOut bool) error
+	// Flags adds any flags besides --json, it may be nil.
+	Flags func(fs *flag.FlagSet)
+}
+
+// Commands lists every subcommand, in the order they're shown in the usage text.
+var Commands []*Command
+
+func init() {
+	Commands = []*Command{
+		{Name: "status", Usage: "show every dir with its current CID and IPNS name", Daemon: statusDaemon, Direct: statusDirect},
+		{Name: "publish", Args: "<ID>", Usage: "publish the current root of a dir now, --confirm <root> to only publish what was reviewed with pending",
+			Daemon: publishDaemon, Direct: publishDirect, Flags: publishFlags},
+		{Name: "pending", Args: "<ID>", Usage: "list what's changed in a dir since it was last published", Daemon: pendingDaemon, Direct: pendingDirect},
+		{Name: "resync", Args: "<ID>", Usage: "rehash a dir and sync any changes", Daemon: dirAction("resync"), Direct: resyncDirect},
+		{Name: "pause", Args: "<ID>", Usage: "stop adding files and publishing for a dir (daemon only)", Daemon: dirAction("pause")},
+		{Name: "resume", Args: "<ID>", Usage: "resume adding files and publishing for a dir (daemon only)", Daemon: dirAction("resume")},
+		{Name: "queue", Usage: "list files waiting to be added (daemon only)", Daemon: queueDaemon},
+		{Name: "quarantine", Usage: "list files held back because they look sensitive (daemon only)", Daemon: quarantineDaemon},
+		{Name: "allow", Args: "<ID> <path>", Usage: "let a file which looks sensitive be published", Daemon: allowDaemon, Direct: allowDirect},
+		{Name: "keys", Usage: "list the IPNS keys managed by ipfs-sync", Daemon: keysDirect, Direct: keysDirect},
+		{Name: "history", Args: "<ID>", Usage: "list everything a dir has been published as", Daemon: historyDaemon, Direct: historyDirect},
+		{Name: "diff", Args: "<ID> [old] [new]", Usage: "list what changed in a dir between two roots (CIDs or timestamps from history), by default its last publish",
+			Daemon: diffDaemon, Direct: diffDirect},
+		{Name: "rollback", Args: "<ID> <CID|timestamp>", Usage: "republish an earlier root of a dir, --restore to restore the MFS too (otherwise the dir is paused)",
+			Daemon: rollbackDaemon, Direct: rollbackDirect, Flags: rollbackFlags},
+		{Name: "export", Args: "<ID|CID> [CID]", Usage: "write a CAR file of a dir's current root (or an earlier one, or any CID), restorable with `ipfs dag import`",
+			Daemon: exportCmd, Direct: exportCmd, Flags: exportFlags},
+		{Name: "restore", Args: "<ID|CID> <target-dir>", Usage: "write a dir's current root (or any CID) to target-dir, --path to only restore part of it",
+			Daemon: restoreDaemon, Direct: restoreDirect, Flags: restoreFlags},
+		{Name: "decrypt", Args: "<ID|CID> <target-dir>", Usage: "write the plaintext of an encrypted dir's current root (or any CID) to target-dir",
+			Daemon: decryptCmd, Direct: decryptCmd, Flags: decryptFlags},
+	}
+
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage of %s:\n  %s [flags]\n  %s [flags] <command> [--json] [args]\n\nCommands:\n", os.Args[0], os.Args[0], os.Args[0])
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		for _, cmd := range Commands {
+			fmt.Fprintf(w, "  %s %s\t%s\n", cmd.Name, cmd.Args, cmd.Usage)
+		}
+		w.Flush()
+		fmt.Fprintln(out, "\nFlags:")
+		flag.PrintDefaults()
+	}
+}
+
+var errNoDaemon = errors.New("ipfs-sync daemon isn't running")
+
+// RunCommand runs the subcommand in args, talking to the daemon if it's running, and returns the exit code.
+func RunCommand(args []string) int {
+	var cmd *Command
+	for _, c := range Commands {
+		if c.Name == args[0] {
+			cmd = c
+			break
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command '%s'\n\n", args[0])
+		flag.Usage()
+		return 2
+	}
+
+	fs := flag.NewFlagSet(cmd.Name, flag.ContinueOnError)
+	jsonOut := fs.Bool("json", false, "output JSON")
+	if cmd.Flags != nil {
+		cmd.Flags(fs)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s [flags] %s\n  %s\n", os.Args[0], cmd.Name, cmd.Args, cmd.Usage)
+		fs.PrintDefaults()
+	}
+	// flags can come before, between, or after the positional arguments
+	var positional []string
+	for rest := args[1:]; ; {
+		if err := fs.Parse(rest); err != nil {
+			return 2
+		}
+		if rest = fs.Args(); len(rest) == 0 {
+			break
+		}
+		positional, rest = append(positional, rest[0]), rest[1:]
+	}
+	fields := strings.Fields(cmd.Args)
+	required := 0
+	for _, field := range fields {
+		if !strings.HasPrefix(field, "[") {
+			required++
+		}
+	}
+	if len(positional) < required || len(positional) > len(fields) {
+		fs.Usage()
+		return 2
+	}
+
+	var err error
+	if daemonRunning() && cmd.Daemon != nil {
+		err = cmd.Daemon(positional, *jsonOut)
+	} else if cmd.Direct != nil {
+		if err = syncer.Open(); err == nil {
+			err = cmd.Direct(positional, *jsonOut)
+			syncer.Stop()
+		}
+	} else {
+		err = errNoDaemon
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
+
+// controlClient returns an HTTP client for the control API which gives up after timeout (0 for never), and the base URL
+// to use with it.
+func controlClient(timeout time.Duration) (*http.Client, string) {
+	if ControlSocket == "" {
+		return &http.Client{Timeout: timeout}, "http://" + ControlAddr
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", ControlSocket)
+			},
+		},
+	}, "http://ipfs-sync"
+}
+
+// daemonRunning returns true if the control API of a running daemon can be reached.
+func daemonRunning() bool {
+	var (
+		conn net.Conn
+		err  error
+	)
+	switch {
+	case ControlSocket != "":
+		conn, err = net.DialTimeout("unix", ControlSocket, time.Second)
+	case ControlAddr != "":
+		conn, err = net.DialTimeout("tcp", ControlAddr, time.Second)
+	default:
+		return false
+	}
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// controlRequest does a request to the control API, decoding the response into out.
+func controlRequest(method, cmd string, out interface{}) error {
+	return controlRequestTimeout(method, cmd, TimeoutTime, out)
+}
+
+// controlRequestTimeout is controlRequest, giving up after timeout (0 for never), for requests which may take a while.
+func controlRequestTimeout(method, cmd string, timeout time.Duration, out interface{}) error {
+	c, base := controlClient(timeout)
+	req, err := http.NewRequest(method, base+ControlAPI+cmd, nil)
+	if err != nil {
+		return err
+	}
+	if ControlSocket == "" {
+		token, err := ioutil.ReadFile(controlTokenFile())
+		if err != nil {
+			return fmt.Errorf("error reading control API token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		errStruct := new(ipfssync.ErrorStruct)
+		if err := json.NewDecoder(resp.Body).Decode(errStruct); err != nil || errStruct.Error() == "" {
+			return errors.New(resp.Status)
+		}
+		return errStruct
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// printJSON writes v to stdout as indented JSON.
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// printStatuses prints statuses as a table, or as JSON if jsonOut is true.
+func printStatuses(statuses []*DirStatus, jsonOut bool) error {
+	if jsonOut {
+		return printJSON(statuses)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCID\tIPNS\tPAUSED\tQUEUED")
+	for _, status := range statuses {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%d\n", status.ID, orDash(status.CID), orDash(status.Key), status.Paused, status.Queued)
+	}
+	return w.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// getDirKey returns the DirKey with the given ID from the config.
+func getDirKey(id string) (*ipfssync.DirKey, error) {
+	dk := syncer.Dir(id)
+	if dk == nil {
+		return nil, fmt.Errorf("no dir with ID '%s'", id)
+	}
+	return dk, nil
+}
+
+// loadKey looks up the IPNS name of dk.
+func loadKey(dk *ipfssync.DirKey) error {
+	keys, err := syncer.ListKeys(syncer.Context())
+	if err != nil {
+		return err
+	}
+	for _, ik := range keys.Keys {
+		if ik.Name == ipfssync.KeySpace+dk.ID {
+			dk.SetKey(ik.Id)
+			return nil
+		}
+	}
+	return fmt.Errorf("no IPNS key for '%s', it hasn't been published yet", dk.ID)
+}
+
+func statusDaemon(args []string, jsonOut bool) error {
+	var statuses []*DirStatus
+	if err := controlRequest("GET", "dirs", &statuses); err != nil {
+		return err
+	}
+	return printStatuses(statuses, jsonOut)
+}
+
+func statusDirect(args []string, jsonOut bool) error {
+	statuses := make([]*DirStatus, 0)
+	for _, dk := range syncer.Dirs() {
+		if err := loadKey(dk); err == nil {
+			if cid, err := syncer.ResolveIPNS(syncer.Context(), dk.GetKey()); err == nil {
+				dk.SetCID(cid)
+			}
+		}
+		statuses = append(statuses, dirStatus(dk))
+	}
+	return printStatuses(statuses, jsonOut)
+}
+
+// printPublished prints the result of publishing a dir.
+func printPublished(status *DirStatus, jsonOut bool) error {
+	if jsonOut {
+		return printJSON(status)
+	}
+	fmt.Printf("%s published %s to /ipns/%s\n", status.ID, status.CID, status.Key)
+	return nil
+}
+
+var publishConfirm *string
+
+func publishFlags(fs *flag.FlagSet) {
+	publishConfirm = fs.String("confirm", "", "only publish if the dir's root is still this one, as shown by pending")
+}
+
+func publishDaemon(args []string, jsonOut bool) error {
+	status := new(DirStatus)
+	cmd := fmt.Sprintf("dirs/%s/publish?confirm=%s", args[0], url.QueryEscape(*publishConfirm))
+	if err := controlRequest("POST", cmd, status); err != nil {
+		return err
+	}
+	return printPublished(status, jsonOut)
+}
+
+func publishDirect(args []string, jsonOut bool) error {
+	dk, err := getDirKey(args[0])
+	if err != nil {
+		return err
+	}
+	if err := loadKey(dk); err != nil {
+		return err
+	}
+	// so pins are updated from the current root, and the publish is recorded against it
+	if cid, err := syncer.ResolveIPNS(syncer.Context(), dk.GetKey()); err == nil {
+		dk.SetCID(cid)
+	}
+	if err := syncer.Approve(dk, *publishConfirm); err != nil {
+		return err
+	}
+	return printPublished(dirStatus(dk), jsonOut)
+}
+
+// printPending prints what's changed in a dir since it was last published.
+func printPending(status *PendingStatus, jsonOut bool) error {
+	if jsonOut {
+		return printJSON(status)
+	}
+	if len(status.Changes) == 0 {
+		fmt.Printf("%s has no changes since it was last published (%s)\n", status.ID, orDash(status.CID))
+		return nil
+	}
+	fmt.Printf("%s has %d change(s) since it was last published (%s), it'd be published as %s\n\n", status.ID,
+		len(status.Changes), orDash(status.CID), status.Root)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CHANGE\tPATH\tSIZE")
+	for _, change := range status.Changes {
+		fmt.Fprintf(w, "%s\t%s\t%d\n", change.Type, change.Path, change.Size)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("\nPublish with: %s publish --confirm %s %s\n", os.Args[0], status.Root, status.ID)
+	return nil
+}
+
+func pendingDaemon(args []string, jsonOut bool) error {
+	status := new(PendingStatus)
+	if err := controlRequest("GET", "dirs/"+args[0]+"/pending", status); err != nil {
+		return err
+	}
+	return printPending(status, jsonOut)
+}
+
+func pendingDirect(args []string, jsonOut bool) error {
+	dk, err := getDirKey(args[0])
+	if err != nil {
+		return err
+	}
+	if err := loadKey(dk); err == nil {
+		if cid, err := syncer.ResolveIPNS(syncer.Context(), dk.GetKey()); err == nil {
+			dk.SetCID(cid)
+		}
+	}
+	root, changes, err := syncer.PendingChanges(dk)
+	if err != nil {
+		return err
+	}
+	return printPending(&PendingStatus{ID: dk.ID, CID: dk.GetCID(), Root: root, Changes: changes}, jsonOut)
+}
+
+func resyncDirect(args []string, jsonOut bool) error {
+	dk, err := getDirKey(args[0])
+	if err != nil {
+		return err
+	}
+	if err := syncer.SyncDir(dk); err != nil {
+		return err
+	}
+	if jsonOut {
+		return printJSON(dirStatus(dk))
+	}
+	fmt.Println(dk.ID, "resynced")
+	return nil
+}
+
+// dirAction returns a command which does action on a dir through the control API.
+func dirAction(action string) func(args []string, jsonOut bool) error {
+	return func(args []string, jsonOut bool) error {
+		status := new(DirStatus)
+		if err := controlRequest("POST", "dirs/"+args[0]+"/"+action, status); err != nil {
+			return err
+		}
+		if jsonOut {
+			return printJSON(status)
+		}
+		return printStatuses([]*DirStatus{status}, false)
+	}
+}
+
+func queueDaemon(args []string, jsonOut bool) error {
+	var queues []*QueueStatus
+	if err := controlRequest("GET", "queue", &queues); err != nil {
+		return err
+	}
+	if jsonOut {
+		return printJSON(queues)
+	}
+	for _, qs := range queues {
+		fmt.Printf("%s (%d queued)\n", qs.ID, len(qs.Paths))
+		for _, path := range qs.Paths {
+			fmt.Println("  " + path)
+		}
+	}
+	return nil
+}
+
+func quarantineDaemon(args []string, jsonOut bool) error {
+	var statuses []*QuarantineStatus
+	if err := controlRequest("GET", "quarantine", &statuses); err != nil {
+		return err
+	}
+	if jsonOut {
+		return printJSON(statuses)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPATH\tREASON")
+	for _, qs := range statuses {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", qs.ID, qs.Path, qs.Reason)
+	}
+	return w.Flush()
+}
+
+func allowDaemon(args []string, jsonOut bool) error {
+	status := new(DirStatus)
+	if err := controlRequest("POST", fmt.Sprintf("dirs/%s/allow?path=%s", args[0], url.QueryEscape(args[1])), status); err != nil {
+		return err
+	}
+	if jsonOut {
+		return printJSON(status)
+	}
+	fmt.Println(args[1], "allowed")
+	return nil
+}
+
+func allowDirect(args []string, jsonOut bool) error {
+	if err := syncer.Allow(args[0], args[1]); err != nil {
+		return err
+	}
+	if jsonOut {
+		return printJSON(dirStatus(syncer.Dir(args[0])))
+	}
+	fmt.Println(args[1], "allowed")
+	return nil
+}
+
+func keysDirect(args []string, jsonOut bool) error {
+	if EndPoint == "" {
+		return errors.New("no end point configured")
+	}
+	keys, err := syncer.ListKeys(syncer.Context())
+	if err != nil {
+		return err
+	}
+	ours := make([]ipfssync.Key, 0, len(keys.Keys))
+	for _, ik := range keys.Keys {
+		if strings.HasPrefix(ik.Name, ipfssync.KeySpace) {
+			ours = append(ours, ipfssync.Key{Id: ik.Id, Name: ik.Name[len(ipfssync.KeySpace):]})
+		}
+	}
+	if jsonOut {
+		return printJSON(ours)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tIPNS")
+	for _, ik := range ours {
+		fmt.Fprintf(w, "%s\t%s\n", ik.Name, ik.Id)
+	}
+	return w.Flush()
+}
+
+// printHistory prints records as a table, or as JSON if jsonOut is true.
+func printHistory(records []*ipfssync.PublishRecord, jsonOut bool) error {
+	if jsonOut {
+		return printJSON(records)
+	}
+	return writeHistory(os.Stdout, records)
+}
+
+func writeHistory(out io.Writer, records []*ipfssync.PublishRecord) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tSEQ\tCID\tCHANGES\tDIFF")
+	for _, record := range records {
+		changes := record.Changes.String()
+		if record.Rollback {
+			changes = "rollback"
+		}
+		diff := "-"
+		if record.Diff != nil {
+			diff = record.Diff.String()
+		}
+		seq := "-"
+		if record.Sequence != nil {
+			seq = fmt.Sprint(*record.Sequence)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", record.Time.Format(time.RFC3339), seq, record.CID, changes, diff)
+	}
+	return w.Flush()
+}
+
+func historyDaemon(args []string, jsonOut bool) error {
+	var records []*ipfssync.PublishRecord
+	if err := controlRequest("GET", "dirs/"+args[0]+"/history", &records); err != nil {
+		return err
+	}
+	return printHistory(records, jsonOut)
+}
+
+func historyDirect(args []string, jsonOut bool) error {
+	dk, err := getDirKey(args[0])
+	if err != nil {
+		return err
+	}
+	records, err := syncer.History(dk.ID)
+	if err != nil {
+		return err
+	}
+	return printHistory(records, jsonOut)
+}
+
+// printDiff prints what changed in a dir between two roots.
+func printDiff(status *DiffStatus, jsonOut bool) error {
+	if jsonOut {
+		return printJSON(status)
+	}
+	fmt.Printf("%s changed from %s to %s: %s\n", status.ID, status.From, status.To, status.Summary)
+	if len(status.Changes) == 0 {
+		return nil
+	}
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CHANGE\tPATH\tSIZE")
+	for _, change := range status.Changes {
+		fmt.Fprintf(w, "%s\t%s\t%d\n", change.Type, change.Path, change.Size)
+	}
+	return w.Flush()
+}
+
+// diffArgs returns the roots to compare from args, which are empty if they weren't given.
+func diffArgs(args []string) (from, to string) {
+	if len(args) > 1 {
+		from = args[1]
+	}
+	if len(args) > 2 {
+		to = args[2]
+	}
+	return from, to
+}
+
+func diffDaemon(args []string, jsonOut bool) error {
+	from, to := diffArgs(args)
+	status := new(DiffStatus)
+	cmd := fmt.Sprintf("dirs/%s/diff?from=%s&to=%s", args[0], url.QueryEscape(from), url.QueryEscape(to))
+	if err := controlRequest("GET", cmd, status); err != nil {
+		return err
+	}
+	return printDiff(status, jsonOut)
+}
+
+func diffDirect(args []string, jsonOut bool) error {
+	dk, err := getDirKey(args[0])
+	if err != nil {
+		return err
+	}
+	if err := loadKey(dk); err == nil {
+		if cid, err := syncer.ResolveIPNS(syncer.Context(), dk.GetKey()); err == nil {
+			dk.SetCID(cid)
+		}
+	}
+	from, to := diffArgs(args)
+	from, to, changes, err := syncer.DiffVersions(dk.ID, from, to)
+	if err != nil {
+		return err
+	}
+	return printDiff(&DiffStatus{ID: dk.ID, From: from, To: to, Changes: changes, Summary: ipfssync.Summarize(changes)}, jsonOut)
+}
+
+var rollbackRestore *bool
+
+func rollbackFlags(fs *flag.FlagSet) {
+	rollbackRestore = fs.Bool("restore", false, "replace the MFS copy of the dir with the old root")
+}
+
+// printRollback prints the result of rolling back a dir.
+func printRollback(id string, record *ipfssync.PublishRecord, jsonOut bool) error {
+	if jsonOut {
+		return printJSON(record)
+	}
+	fmt.Printf("%s rolled back to %s\n", id, record.CID)
+	if !*rollbackRestore {
+		fmt.Printf("%s is paused until it's resumed\n", id)
+	}
+	return nil
+}
+
+func rollbackDaemon(args []string, jsonOut bool) error {
+	record := new(ipfssync.PublishRecord)
+	cmd := fmt.Sprintf("dirs/%s/rollback?to=%s&restore=%t", args[0], url.QueryEscape(args[1]), *rollbackRestore)
+	if err := controlRequest("POST", cmd, record); err != nil {
+		return err
+	}
+	return printRollback(args[0], record, jsonOut)
+}
+
+func rollbackDirect(args []string, jsonOut bool) error {
+	if !*rollbackRestore {
+		return errors.New("rolling back without --restore requires the daemon to be running, so the dir can stay paused")
+	}
+	dk, err := getDirKey(args[0])
+	if err != nil {
+		return err
+	}
+	if err := loadKey(dk); err != nil {
+		return err
+	}
+	if cid, err := syncer.ResolveIPNS(syncer.Context(), dk.GetKey()); err == nil {
+		dk.SetCID(cid)
+	}
+	record, err := syncer.Rollback(dk.ID, args[1], true)
+	if err != nil {
+		return err
+	}
+	return printRollback(dk.ID, record, jsonOut)
+}
+
+var exportOut *string
+
+func exportFlags(fs *flag.FlagSet) {
+	exportOut = fs.String("o", "", "file to write the CAR to (default <CID>.car)")
+}
+
+func exportCmd(args []string, jsonOut bool) error {
+	if EndPoint == "" {
+		return errors.New("no end point configured")
+	}
+	cid := strings.TrimPrefix(args[0], "/ipfs/")
+	if dk := syncer.Dir(args[0]); dk != nil {
+		if len(args) > 1 {
+			cid = strings.TrimPrefix(args[1], "/ipfs/")
+		} else {
+			if err := loadKey(dk); err != nil {
+				return err
+			}
+			var err error
+			if cid, err = syncer.ResolveIPNS(syncer.Context(), dk.GetKey()); err != nil {
+				return err
+			}
+		}
+	} else if len(args) > 1 {
+		return fmt.Errorf("no dir with ID '%s'", args[0])
+	}
+	out := *exportOut
+	if out == "" {
+		out = cid + ".car"
+	}
+	if err := syncer.ExportCAR(cid, out); err != nil {
+		return err
+	}
+	if jsonOut {
+		return printJSON(map[string]string{"CID": cid, "File": out})
+	}
+	fmt.Println("Exported", cid, "to", out)
+	return nil
+}
+
+var restorePath *string
+
+func restoreFlags(fs *flag.FlagSet) {
+	restorePath = fs.String("path", "", "file or directory in the root to restore, instead of all of it")
+}
+
+// printRestored prints the result of a restore.
+func printRestored(status *RestoreStatus, jsonOut bool) error {
+	if jsonOut {
+		return printJSON(status)
+	}
+	fmt.Println("Restored", status.Files, "file(s) from", status.CID, "to", status.Dir)
+	return nil
+}
+
+// restoreDaemon restores a dir into itself through the daemon, which holds the DB the restored files are recorded in.
+// CIDs and restores anywhere else don't need it, so they're restored directly.
+func restoreDaemon(args []string, jsonOut bool) error {
+	target, err := filepath.Abs(args[1])
+	if err != nil {
+		return err
+	}
+	if dk := syncer.Dir(args[0]); dk == nil || !withinDir(dk.Dir, target) {
+		return restoreDirect(args, jsonOut)
+	}
+	status := new(RestoreStatus)
+	cmd := fmt.Sprintf("dirs/%s/restore?target=%s&path=%s", args[0], url.QueryEscape(target), url.QueryEscape(*restorePath))
+	if err := controlRequestTimeout("POST", cmd, 0, status); err != nil {
+		return err
+	}
+	return printRestored(status, jsonOut)
+}
+
+func restoreDirect(args []string, jsonOut bool) error {
+	if EndPoint == "" {
+		return errors.New("no end point configured")
+	}
+	cid := strings.TrimPrefix(args[0], "/ipfs/")
+	dk := syncer.Dir(args[0])
+	if dk != nil {
+		if err := loadKey(dk); err != nil {
+			return err
+		}
+		var err error
+		if cid, err = syncer.ResolveIPNS(syncer.Context(), dk.GetKey()); err != nil {
+			return err
+		}
+	}
+	n, err := syncer.Restore(dk, cid, *restorePath, args[1])
+	if err != nil {
+		return err
+	}
+	return printRestored(&RestoreStatus{CID: cid, Dir: args[1], Files: n}, jsonOut)
+}
+
+var decryptPassphrase, decryptKeyFile *string
+
+func decryptFlags(fs *flag.FlagSet) {
+	decryptPassphrase = fs.String("passphrase", "", "passphrase to decrypt with, instead of the dir's")
+	decryptKeyFile = fs.String("keyfile", "", "key file to decrypt with, instead of the dir's")
+}
+
+func decryptCmd(args []string, jsonOut bool) error {
+	if EndPoint == "" {
+		return errors.New("no end point configured")
+	}
+	enc := &ipfssync.Encryption{Passphrase: *decryptPassphrase, KeyFile: *decryptKeyFile}
+	cid := strings.TrimPrefix(args[0], "/ipfs/")
+	if dk := syncer.Dir(args[0]); dk != nil {
+		if err := loadKey(dk); err != nil {
+			return err
+		}
+		var err error
+		if cid, err = syncer.ResolveIPNS(syncer.Context(), dk.GetKey()); err != nil {
+			return err
+		}
+		if enc.Passphrase == "" && enc.KeyFile == "" {
+			if dk.Encrypt == nil {
+				return fmt.Errorf("'%s' isn't encrypted", dk.ID)
+			}
+			enc = dk.Encrypt
+		}
+	}
+	if err := syncer.DecryptTree(cid, args[1], enc); err != nil {
+		return err
+	}
+	if jsonOut {
+		return printJSON(map[string]string{"CID": cid, "Dir": args[1]})
+	}
+	fmt.Println("Decrypted", cid, "to", args[1])
+	return nil
+}
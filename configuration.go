@@ -10,6 +10,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/TheDiscordian/ipfs-sync/ipfssync"
 	"gopkg.in/yaml.v3"
 )
 
@@ -19,11 +20,17 @@ var (
 	EndPointFlag        = flag.String("endpoint", "http://127.0.0.1:5001", "node to connect to over HTTP")
 	EndPoint            string
 	DirKeysFlag         = new(SyncDirs)
-	DirKeys             []*DirKey
+	DirKeys             []*ipfssync.DirKey
 	SyncTimeFlag        = flag.Duration("sync", time.Second*10, "time to sleep between IPNS syncs (ex: 120s)")
 	SyncTime            time.Duration
 	TimeoutTimeFlag     = flag.Duration("timeout", time.Second*30, "longest time to wait for API calls like 'version' and 'files/mkdir' (ex: 60s)")
 	TimeoutTime         time.Duration
+	QuietTimeFlag       = flag.Duration("quiet", time.Second, "time a file must go without changes before it's added (ex: 5s)")
+	QuietTime           time.Duration
+	SettleTimeFlag      = flag.Duration("settle", 0, "time a file's size must stay the same before it's added, useful for large copies (ex: 10s)")
+	SettleTime          time.Duration
+	ConcurrencyFlag     = flag.Int("concurrency", 4, "maximum amount of files to add to IPFS at once, across all dirs")
+	Concurrency         int
 	ConfigFileFlag      = flag.String("config", getHomeDir()+".ipfs-sync.yaml", "path to config file to use")
 	ConfigFile          string
 	IgnoreFlag          = new(IgnoreStruct)
@@ -33,10 +40,21 @@ var (
 	DBPath              string
 	IgnoreHiddenFlag    = flag.Bool("ignorehidden", false, `ignore anything prefixed with "."`)
 	IgnoreHidden        bool
+	GuardFlag           = flag.Bool("guard", false, "scan files for secrets before adding them, and hold back anything sensitive")
+	Guard               bool
+	Sensitive           []string
 	VersionFlag         = flag.Bool("version", false, "display version and exit")
 	VerboseFlag         = flag.Bool("v", false, "display verbose output")
 	Verbose             bool
 	EstuaryAPIKey       string // don't make this a flag
+	PinningServices     []*ipfssync.PinningService
+	DNSLinkProviders    []*ipfssync.DNSLinkConfig
+	ControlSocketFlag   = flag.String("socket", getHomeDir()+".ipfs-sync.sock", "path to unix socket to serve the control API on (empty to disable)")
+	ControlSocket       string
+	ControlAddrFlag     = flag.String("control", "", "TCP address to serve the control API on (ex: 127.0.0.1:5050)")
+	ControlAddr         string
+	MetricsAddrFlag     = flag.String("metrics", "", "address to serve Prometheus metrics on at /metrics (ex: 127.0.0.1:9550)")
+	MetricsAddr         string
 	VerifyFilestoreFlag = flag.Bool("verify", false, "verify filestore on startup (not recommended unless you're having issues)")
 	VerifyFilestore     bool
 
@@ -45,7 +63,7 @@ var (
 
 func init() {
 	flag.Var(DirKeysFlag, "dirs", `set the dirs to monitor in json format like: [{"ID":"Example1", "Dir":"/home/user/Documents/", "Nocopy": false},{"ID":"Example2", "Dir":"/home/user/Pictures/", "Nocopy": false}]`)
-	flag.Var(IgnoreFlag, "ignore", `set the suffixes to ignore (default: ["kate-swp", "swp", "part", "crdownload"])`)
+	flag.Var(IgnoreFlag, "ignore", `set the gitignore-style patterns to ignore in json format (default: ["*.kate-swp", "*.swp", "*.part", "*.crdownload"])`)
 }
 
 func getHomeDir() string {
@@ -56,30 +74,15 @@ func getHomeDir() string {
 //go:embed config.yaml.sample
 var content embed.FS
 
-// DirKey used for keeping track of directories, and it's used in the `dirs` config paramerter.
-type DirKey struct {
-	// config values
-	ID       string `json:"ID" yaml:"ID"`
-	Dir      string `yaml:"Dir"`
-	Nocopy   bool   `yaml:"Nocopy"`
-	DontHash bool   `yaml:"DontHash"`
-	Pin      bool   `yaml:"Pin"`
-	Estuary  bool   `yaml:"Estuary"`
-
-	// probably best to let this be managed automatically
-	CID     string
-	MFSPath string
-}
-
 // SyncDirs is used for reading what the user specifies for which directories they'd like to sync.
 type SyncDirs struct {
-	DirKeys []*DirKey
+	DirKeys []*ipfssync.DirKey
 	json    string
 }
 
 // Set takes a JSON string and marshals it into `sd`.
 func (sd *SyncDirs) Set(str string) error {
-	sd.DirKeys = make([]*DirKey, 0, 1)
+	sd.DirKeys = make([]*ipfssync.DirKey, 0, 1)
 	sd.json = str
 	return json.Unmarshal([]byte(str), &sd.DirKeys)
 }
@@ -109,22 +112,31 @@ func (ig *IgnoreStruct) String() string {
 
 // ConfigFileStruct is used for loading information from the config file.
 type ConfigFileStruct struct {
-	BasePath        string    `yaml:"BasePath"`
-	EndPoint        string    `yaml:"EndPoint"`
-	Dirs            []*DirKey `yaml:"Dirs"`
-	Sync            string    `yaml:"Sync"`
-	Ignore          []string  `yaml:"Ignore"`
-	DB              string    `yaml:"DB"`
-	IgnoreHidden    bool      `yaml:"IgnoreHidden"`
-	Timeout         string    `yaml:"Timeout"`
-	EstuaryAPIKey   string    `yaml:"EstuaryAPIKey"`
-	VerifyFilestore bool      `yaml:"VerifyFilestore"`
+	BasePath         string                     `yaml:"BasePath"`
+	EndPoint         string                     `yaml:"EndPoint"`
+	Dirs             []*ipfssync.DirKey         `yaml:"Dirs"`
+	Sync             string                     `yaml:"Sync"`
+	Ignore           []string                   `yaml:"Ignore"`
+	DB               string                     `yaml:"DB"`
+	IgnoreHidden     bool                       `yaml:"IgnoreHidden"`
+	Guard            bool                       `yaml:"Guard"`
+	Sensitive        []string                   `yaml:"Sensitive"`
+	Timeout          string                     `yaml:"Timeout"`
+	Quiet            string                     `yaml:"Quiet"`
+	Settle           string                     `yaml:"Settle"`
+	Concurrency      int                        `yaml:"Concurrency"`
+	EstuaryAPIKey    string                     `yaml:"EstuaryAPIKey"`
+	PinningServices  []*ipfssync.PinningService `yaml:"PinningServices"`
+	DNSLinkProviders []*ipfssync.DNSLinkConfig  `yaml:"DNSLinkProviders"`
+	VerifyFilestore  bool                       `yaml:"VerifyFilestore"`
+	ControlSocket    string                     `yaml:"ControlSocket"`
+	ControlAddr      string                     `yaml:"ControlAddr"`
+	MetricsAddr      string                     `yaml:"MetricsAddr"`
 }
 
 func loadConfig(path string) {
 	log.Println("Loading config file", path)
-	cfgFile, err := os.Open(path)
-	if err != nil {
+	if _, err := os.Stat(path); err != nil {
 		log.Println("Config file not found, generating...")
 		defaultconfig, _ := content.ReadFile("config.yaml.sample")
 		err = ioutil.WriteFile(path, defaultconfig, 0644)
@@ -133,23 +145,15 @@ func loadConfig(path string) {
 			log.Println("[ERROR] Skipping config file...")
 			return
 		}
-		cfgFile, err = os.Open(path)
-		if err != nil {
-			log.Println("[ERROR] Error loading config file:", err)
-			log.Println("[ERROR] Skipping config file...")
-			return
-		}
 	}
-	defer cfgFile.Close()
-	cfgTxt, _ := ioutil.ReadAll(cfgFile)
 
-	cfg := new(ConfigFileStruct)
-	err = yaml.Unmarshal(cfgTxt, cfg)
+	cfg, err := readConfig(path)
 	if err != nil {
-		log.Println("[ERROR] Error decoding config file:", err)
+		log.Println("[ERROR] Error loading config file:", err)
 		log.Println("[ERROR] Skipping config file...")
 		return
 	}
+	loadedConfig = cfg
 	if cfg.BasePath != "" {
 		BasePath = cfg.BasePath
 	}
@@ -159,6 +163,37 @@ func loadConfig(path string) {
 	if len(cfg.Dirs) > 0 {
 		DirKeys = cfg.Dirs
 	}
+	if cfg.Concurrency > 0 {
+		Concurrency = cfg.Concurrency
+	}
+	if cfg.DB != "" {
+		DBPath = cfg.DB
+	}
+	VerifyFilestore = cfg.VerifyFilestore
+	if cfg.ControlSocket != "" {
+		ControlSocket = cfg.ControlSocket
+	}
+	ControlAddr = cfg.ControlAddr
+	MetricsAddr = cfg.MetricsAddr
+	applyConfig(cfg)
+}
+
+// readConfig reads and decodes the config file at path.
+func readConfig(path string) (*ConfigFileStruct, error) {
+	cfgTxt, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := new(ConfigFileStruct)
+	err = yaml.Unmarshal(cfgTxt, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// applyConfig applies the settings from cfg which can be changed while running.
+func applyConfig(cfg *ConfigFileStruct) {
 	if cfg.Sync != "" {
 		tsTime, err := time.ParseDuration(cfg.Sync)
 		if err != nil {
@@ -175,12 +210,69 @@ func loadConfig(path string) {
 			TimeoutTime = tsTime
 		}
 	}
-	if cfg.DB != "" {
-		DBPath = cfg.DB
+	if cfg.Quiet != "" {
+		tsTime, err := time.ParseDuration(cfg.Quiet)
+		if err != nil {
+			log.Println("[ERROR] Error processing quiet in config file:", err)
+		} else {
+			QuietTime = tsTime
+		}
+	}
+	if cfg.Settle != "" {
+		tsTime, err := time.ParseDuration(cfg.Settle)
+		if err != nil {
+			log.Println("[ERROR] Error processing settle in config file:", err)
+		} else {
+			SettleTime = tsTime
+		}
+	}
+	if len(cfg.Ignore) > 0 {
+		Ignore = cfg.Ignore
 	}
 	IgnoreHidden = cfg.IgnoreHidden
+	Guard = cfg.Guard
+	Sensitive = cfg.Sensitive
 	EstuaryAPIKey = cfg.EstuaryAPIKey
-	VerifyFilestore = cfg.VerifyFilestore
+	services := cfg.PinningServices
+	if EstuaryAPIKey != "" {
+		hasEstuary := false
+		for _, ps := range services {
+			hasEstuary = hasEstuary || ps.Name == "estuary"
+		}
+		if !hasEstuary {
+			services = append(services, &ipfssync.PinningService{Name: "estuary", EndPoint: ipfssync.EstuaryEndPoint, Token: EstuaryAPIKey})
+		}
+	}
+	PinningServices = services
+	DNSLinkProviders = cfg.DNSLinkProviders
+}
+
+// applyFlags lets flags override the settings which can be changed while running.
+func applyFlags() {
+	// Ignore has no defaults so we need to set them here (if nothing else set it)
+	if len(IgnoreFlag.Ignores) > 0 {
+		Ignore = IgnoreFlag.Ignores
+	} else if len(Ignore) == 0 {
+		Ignore = []string{"*.kate-swp", "*.swp", "*.part", "*.crdownload"}
+	}
+	if *SyncTimeFlag != time.Second*10 || SyncTime == 0 {
+		SyncTime = *SyncTimeFlag
+	}
+	if *TimeoutTimeFlag != time.Second*30 || TimeoutTime == 0 {
+		TimeoutTime = *TimeoutTimeFlag
+	}
+	if *QuietTimeFlag != time.Second || QuietTime == 0 {
+		QuietTime = *QuietTimeFlag
+	}
+	if *SettleTimeFlag != 0 {
+		SettleTime = *SettleTimeFlag
+	}
+	if *IgnoreHiddenFlag {
+		IgnoreHidden = true
+	}
+	if *GuardFlag {
+		Guard = true
+	}
 }
 
 // Process flags, and load config.
@@ -199,6 +291,10 @@ func ProcessFlags() {
 		fmt.Printf("ipfs-sync %s\n", version)
 		os.Exit(0)
 	}
+	// Keep command output clean, unless asked not to.
+	if flag.NArg() > 0 && !*VerboseFlag {
+		log.SetOutput(ioutil.Discard)
+	}
 	log.Println("ipfs-sync starting up...")
 
 	ConfigFile = *ConfigFileFlag
@@ -210,17 +306,12 @@ func ProcessFlags() {
 	}
 
 	// Process Dir
-	if len(DirKeys) == 0 {
+	if len(DirKeys) == 0 && flag.NArg() == 0 {
 		log.Fatalln(`dirs field is required as flag, or in config.`)
 	} else { // Check if Dir entries are at least somewhat valid.
 		for _, dk := range DirKeys {
-			if len(dk.Dir) == 0 {
-				log.Fatalln("Dir entry path cannot be empty. (ID:", dk.ID, ")")
-			}
-
-			// Check if trailing "/" exists, if not, append it.
-			if dk.Dir[len(dk.Dir)-1] != os.PathSeparator {
-				dk.Dir = dk.Dir + string(os.PathSeparator)
+			if err := dk.Prepare(); err != nil {
+				log.Fatalln(err)
 			}
 		}
 	}
@@ -233,34 +324,47 @@ func ProcessFlags() {
 		EndPoint = *EndPointFlag
 	}
 
-	// Ignore has no defaults so we need to set them here (if nothing else set it)
-	if len(IgnoreFlag.Ignores) > 0 {
-		Ignore = IgnoreFlag.Ignores
-	} else if len(Ignore) == 0 {
-		Ignore = []string{"kate-swp", "swp", "part", "crdownload"}
-	}
 	if *DBPathFlag != "" {
 		DBPath = *DBPathFlag
 	}
-	if DBPath != "" {
-		InitDB(DBPath)
+	applyFlags()
+	if *ConcurrencyFlag != 4 || Concurrency == 0 {
+		Concurrency = *ConcurrencyFlag
 	}
-	if *SyncTimeFlag != time.Second*10 || SyncTime == 0 {
-		SyncTime = *SyncTimeFlag
+	if *ControlSocketFlag != getHomeDir()+".ipfs-sync.sock" || ControlSocket == "" {
+		ControlSocket = *ControlSocketFlag
 	}
-	if *TimeoutTimeFlag != time.Second*30 || TimeoutTime == 0 {
-		TimeoutTime = *TimeoutTimeFlag
+	if *ControlAddrFlag != "" {
+		ControlAddr = *ControlAddrFlag
 	}
-	if *IgnoreHiddenFlag {
-		IgnoreHidden = true
+	if *MetricsAddrFlag != "" {
+		MetricsAddr = *MetricsAddrFlag
 	}
 	if *VerifyFilestoreFlag {
 		VerifyFilestore = true
 	}
 	Verbose = *VerboseFlag
+}
 
-	_, err := doRequest(TimeoutTime, "version")
-	if err != nil {
-		log.Fatalln("Failed to connect to end point:", err)
+// buildOptions returns the options for the syncer, from the config and flags.
+func buildOptions() *ipfssync.Options {
+	return &ipfssync.Options{
+		EndPoint:         EndPoint,
+		BasePath:         BasePath,
+		DB:               DBPath,
+		Dirs:             DirKeys,
+		Sync:             SyncTime,
+		Timeout:          TimeoutTime,
+		Quiet:            QuietTime,
+		Settle:           SettleTime,
+		Concurrency:      Concurrency,
+		Ignore:           Ignore,
+		IgnoreHidden:     IgnoreHidden,
+		Guard:            Guard,
+		Sensitive:        Sensitive,
+		PinningServices:  PinningServices,
+		DNSLinkProviders: DNSLinkProviders,
+		VerifyFilestore:  VerifyFilestore,
+		Verbose:          Verbose,
 	}
 }
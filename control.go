@@ -0,0 +1,425 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/TheDiscordian/ipfs-sync/ipfssync"
+)
+
+// ControlAPI is the path every control API endpoint is under.
+const ControlAPI = "/v1/"
+
+// DirStatus is the status of a DirKey, as returned by the control API.
+type DirStatus struct {
+	ID      string
+	Dir     string
+	MFSPath string
+	CID     string
+	Key     string
+	Paused  bool
+	Queued  int
+}
+
+// QueueStatus lists the files waiting to be added to a DirKey, as returned by the control API.
+type QueueStatus struct {
+	ID    string
+	Paths []string
+}
+
+// PendingStatus is what's changed in a DirKey since it was last published, as returned by the control API.
+type PendingStatus struct {
+	ID      string
+	CID     string // last published root
+	Root    string // root it'd be published as now
+	Changes []*ipfssync.Change
+}
+
+// DiffStatus is what changed in a DirKey between two roots, as returned by the control API.
+type DiffStatus struct {
+	ID      string
+	From    string
+	To      string
+	Changes []*ipfssync.Change
+	Summary *ipfssync.DiffSummary
+}
+
+// RestoreStatus is the result of restoring a root to a directory, as returned by the control API.
+type RestoreStatus struct {
+	CID   string
+	Dir   string
+	Files int // files restored
+}
+
+// QuarantineStatus is a file being held back from a DirKey because it looks sensitive, as returned by the control API.
+type QuarantineStatus struct {
+	ID     string
+	Path   string
+	Reason string
+}
+
+// dirStatus returns the current status of dk.
+func dirStatus(dk *ipfssync.DirKey) *DirStatus {
+	status := &DirStatus{ID: dk.ID, Dir: dk.Dir, MFSPath: dk.MFSPath, CID: dk.GetCID(), Key: dk.GetKey(), Paused: dk.Paused()}
+	if queue := dk.Queue(); queue != nil {
+		status.Queued = queue.Len()
+	}
+	return status
+}
+
+// quarantineStatuses returns every file being held back, sorted by dir and path.
+func quarantineStatuses() []*QuarantineStatus {
+	statuses := make([]*QuarantineStatus, 0)
+	for _, dk := range syncer.Dirs() {
+		quarantined := dk.Quarantined()
+		paths := make([]string, 0, len(quarantined))
+		for path := range quarantined {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			statuses = append(statuses, &QuarantineStatus{ID: dk.ID, Path: path, Reason: quarantined[path]})
+		}
+	}
+	return statuses
+}
+
+// writeJSON writes v to w as JSON with the given status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil && Verbose {
+		log.Println("Error writing control API response:", err)
+	}
+}
+
+// writeError writes msg as an ErrorStruct, the same way the IPFS daemon reports errors.
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, &ipfssync.ErrorStruct{Message: msg, Code: code, Type: "error"})
+}
+
+// controlHandler serves the control API:
+//
+//	GET  /v1/dirs              list every DirKey
+//	GET  /v1/dirs/<ID>         show one DirKey
+//	POST /v1/dirs/<ID>/resync  rehash and resync the directory
+//	POST /v1/dirs/<ID>/publish[?confirm=<CID>] publish the current root, even if it hasn't changed
+//	GET  /v1/dirs/<ID>/pending list what's changed since the last publish
+//	POST /v1/dirs/<ID>/pause   stop adding files and publishing
+//	POST /v1/dirs/<ID>/resume  resume adding files and publishing
+//	GET  /v1/dirs/<ID>/history list everything the directory has been published as
+//	GET  /v1/dirs/<ID>/diff[?from=<CID|timestamp>][&to=<CID|timestamp>] list what changed between two roots
+//	POST /v1/dirs/<ID>/rollback?to=<CID|timestamp>[&restore=true] republish an earlier root
+//	POST /v1/dirs/<ID>/allow?path=<path> let a quarantined file be published
+//	POST /v1/dirs/<ID>/restore?target=<dir>[&path=<path>] write the current root to target, in dk.Dir
+//	GET  /v1/queue             list the files waiting to be added
+//	GET  /v1/quarantine        list the files held back because they look sensitive
+func controlHandler(w http.ResponseWriter, r *http.Request) {
+	if Verbose {
+		log.Println("Control API request:", r.Method, r.URL.Path)
+	}
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, ControlAPI), "/"), "/")
+	switch {
+	case len(path) == 1 && path[0] == "dirs":
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		statuses := make([]*DirStatus, 0)
+		for _, dk := range syncer.Dirs() {
+			statuses = append(statuses, dirStatus(dk))
+		}
+		writeJSON(w, http.StatusOK, statuses)
+	case len(path) == 1 && path[0] == "queue":
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		queues := make([]*QueueStatus, 0)
+		for _, dk := range syncer.Dirs() {
+			qs := &QueueStatus{ID: dk.ID, Paths: []string{}}
+			if queue := dk.Queue(); queue != nil {
+				qs.Paths = queue.Paths()
+			}
+			queues = append(queues, qs)
+		}
+		writeJSON(w, http.StatusOK, queues)
+	case len(path) == 1 && path[0] == "quarantine":
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		writeJSON(w, http.StatusOK, quarantineStatuses())
+	case len(path) >= 2 && path[0] == "dirs":
+		dk := syncer.Dir(path[1])
+		if dk == nil {
+			writeError(w, http.StatusNotFound, "no dir with ID "+path[1])
+			return
+		}
+		if len(path) == 2 {
+			if r.Method != http.MethodGet {
+				writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+				return
+			}
+			writeJSON(w, http.StatusOK, dirStatus(dk))
+			return
+		}
+		if len(path) != 3 {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		if path[2] == "pending" {
+			if r.Method != http.MethodGet {
+				writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+				return
+			}
+			root, changes, err := syncer.PendingChanges(dk)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, &PendingStatus{ID: dk.ID, CID: dk.GetCID(), Root: root, Changes: changes})
+			return
+		}
+		if path[2] == "diff" {
+			if r.Method != http.MethodGet {
+				writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+				return
+			}
+			from, to, changes, err := syncer.DiffVersions(dk.ID, r.URL.Query().Get("from"), r.URL.Query().Get("to"))
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, &DiffStatus{ID: dk.ID, From: from, To: to, Changes: changes, Summary: ipfssync.Summarize(changes)})
+			return
+		}
+		if path[2] == "history" {
+			if r.Method != http.MethodGet {
+				writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+				return
+			}
+			records, err := syncer.History(dk.ID)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, records)
+			return
+		}
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		switch path[2] {
+		case "resync":
+			go func() {
+				log.Println("Resyncing", dk.ID, "...")
+				if err := syncer.SyncDir(dk); err != nil {
+					log.Println("Error syncing directory:", err)
+				}
+			}()
+			writeJSON(w, http.StatusAccepted, dirStatus(dk))
+		case "publish":
+			confirm := r.URL.Query().Get("confirm")
+			if err := syncer.Approve(dk, confirm); err != nil {
+				code := http.StatusInternalServerError
+				if errors.Is(err, ipfssync.ErrRootChanged) || errors.Is(err, ipfssync.ErrHeldBack) ||
+					errors.Is(err, ipfssync.ErrNotSettled) {
+					code = http.StatusConflict
+				} else if confirm == "" && dk.Confirm {
+					code = http.StatusBadRequest
+				}
+				writeError(w, code, err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, dirStatus(dk))
+		case "pause":
+			dk.SetPaused(true)
+			log.Println(dk.ID, "paused")
+			writeJSON(w, http.StatusOK, dirStatus(dk))
+		case "resume":
+			dk.SetPaused(false)
+			log.Println(dk.ID, "resumed")
+			writeJSON(w, http.StatusOK, dirStatus(dk))
+		case "rollback":
+			record, err := syncer.Rollback(dk.ID, r.URL.Query().Get("to"), r.URL.Query().Get("restore") == "true")
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, record)
+		case "allow":
+			if err := syncer.Allow(dk.ID, r.URL.Query().Get("path")); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, dirStatus(dk))
+		case "restore":
+			target := r.URL.Query().Get("target")
+			if err := checkRestoreTarget(dk, target); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			cid := dk.GetCID()
+			if cid == "" {
+				writeError(w, http.StatusConflict, fmt.Sprintf("'%s' hasn't been published yet", dk.ID))
+				return
+			}
+			n, err := syncer.Restore(dk, cid, r.URL.Query().Get("path"), target)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, &RestoreStatus{CID: cid, Dir: target, Files: n})
+		default:
+			writeError(w, http.StatusNotFound, "unknown action "+path[2])
+		}
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// withinDir returns true if path is dir or anything under it.
+func withinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
+}
+
+// checkRestoreTarget returns an error unless target is dk.Dir or a directory under it, reached without following any
+// symlinks, so restores through the control API can't write anywhere else.
+func checkRestoreTarget(dk *ipfssync.DirKey, target string) error {
+	if !filepath.IsAbs(target) {
+		return errors.New("target must be an absolute path")
+	}
+	if !withinDir(dk.Dir, target) {
+		return fmt.Errorf("target must be in %s", dk.Dir)
+	}
+	rel, _ := filepath.Rel(dk.Dir, target)
+	dir := filepath.Clean(dk.Dir)
+	for _, name := range strings.Split(rel, string(os.PathSeparator)) {
+		if name == "." {
+			continue
+		}
+		dir = filepath.Join(dir, name)
+		fi, err := os.Lstat(dir)
+		if os.IsNotExist(err) { // the rest is created by the restore
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is a symlink", dir)
+		}
+	}
+	return nil
+}
+
+// listenSocket listens on the Unix socket at path, removing it first if it's left over from a previous run.
+func listenSocket(path string) (net.Listener, error) {
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, errors.New("another instance is already listening on " + path)
+		}
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// only the user running ipfs-sync should be able to control it
+	os.Chmod(path, 0600)
+	return l, nil
+}
+
+// controlTokenFile returns the path of the file the token for the control API on ControlAddr is kept in, next to the
+// config file.
+func controlTokenFile() string {
+	if ConfigFile == "" {
+		return getHomeDir() + ".ipfs-sync.token"
+	}
+	return strings.TrimSuffix(ConfigFile, filepath.Ext(ConfigFile)) + ".token"
+}
+
+// writeControlToken generates a new token for the control API on ControlAddr, writing it to controlTokenFile where
+// only the user running ipfs-sync can read it.
+func writeControlToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	path := controlTokenFile()
+	os.Remove(path) // so it's created with our permissions, not whatever an old one had
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.WriteString(token); err != nil {
+		f.Close()
+		return "", err
+	}
+	return token, f.Close()
+}
+
+// requireToken only lets requests through to h which carry token as a bearer token, with a Host (and Origin, if they
+// have one) of ControlAddr. Any web page can send requests to a local address, but a browser won't send an
+// Authorization header cross-origin without a preflight, which is refused too, and a DNS rebinding page can't set Host.
+func requireToken(h http.Handler, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); r.Host != ControlAddr || (origin != "" && origin != "http://"+ControlAddr) {
+			writeError(w, http.StatusForbidden, "forbidden")
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "missing or invalid token, see "+controlTokenFile())
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// StartControl starts serving the control API on ControlSocket and ControlAddr, if they're set. Requests over
+// ControlAddr need the token written to controlTokenFile.
+func StartControl() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(ControlAPI, controlHandler)
+	if ControlSocket != "" {
+		l, err := listenSocket(ControlSocket)
+		if err != nil {
+			return err
+		}
+		log.Println("Control API listening on", ControlSocket)
+		go func() {
+			log.Println("Control API stopped:", http.Serve(l, mux))
+		}()
+	}
+	if ControlAddr != "" {
+		token, err := writeControlToken()
+		if err != nil {
+			return fmt.Errorf("error writing control API token: %w", err)
+		}
+		l, err := net.Listen("tcp", ControlAddr)
+		if err != nil {
+			return err
+		}
+		log.Println("Control API listening on", ControlAddr)
+		go func() {
+			log.Println("Control API stopped:", http.Serve(l, requireToken(mux, token)))
+		}()
+	}
+	return nil
+}
@@ -1,11 +1,17 @@
 module github.com/TheDiscordian/ipfs-sync
 
-go 1.16
+go 1.18
 
 require (
 	github.com/cespare/xxhash/v2 v2.1.1
 	github.com/fsnotify/fsnotify v1.4.9
 	github.com/syndtr/goleveldb v1.0.0
-	gopkg.in/yaml.v2 v2.4.0 // indirect
+	golang.org/x/crypto v0.21.0
 	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 )
+
+require (
+	github.com/golang/snappy v0.0.0-20180518054509-2e65f85255db // indirect
+	golang.org/x/sys v0.18.0 // indirect
+	gopkg.in/yaml.v2 v2.4.0 // indirect
+)
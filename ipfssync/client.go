@@ -0,0 +1,504 @@
+package ipfssync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+)
+
+// Errors a KuboError can be matched against with errors.Is.
+var (
+	ErrNotFound       = errors.New("not found")       // no such file, directory, key, name or block
+	ErrExists         = errors.New("already exists")  // something's already at the path or name
+	ErrPinned         = errors.New("pinned")          // a block can't be removed while it's pinned
+	ErrNotPinned      = errors.New("not pinned")      // the CID isn't pinned recursively
+	ErrBadBlock       = errors.New("bad block")       // a block is missing, or its file in the filestore is gone
+	ErrUnknownCommand = errors.New("unknown command") // the node doesn't have the command, it's probably too old
+)
+
+// kuboCodeNotFound is the Code Kubo reports errors with when something doesn't exist (cmds.ErrNotFound). The other
+// codes it uses (like cmds.ErrNormal for most errors, and cmds.ErrClient for bad arguments) don't say what went wrong.
+const kuboCodeNotFound = 3
+
+// KuboError is an error reported by the Kubo RPC API.
+type KuboError struct {
+	Command    string // like "files/cp"
+	StatusCode int
+	Message    string
+	Code       int
+	Type       string
+	PinnedBy   string // with ErrPinned, the recursive pin protecting the block, if the node said
+	kind       error
+}
+
+// Error returns the message from the node.
+func (e *KuboError) Error() string {
+	return e.Message
+}
+
+// Is returns true if target is the kind of error e is, one of the Err variables above.
+func (e *KuboError) Is(target error) bool {
+	return e.kind != nil && e.kind == target
+}
+
+// newKuboError returns a KuboError for the error es reported by cmd, classifying it by its status and Code where
+// they're specific enough, and by its message otherwise.
+func newKuboError(cmd string, status int, es *ErrorStruct) *KuboError {
+	e := &KuboError{Command: cmd, StatusCode: status, Message: es.Error(), Code: es.Code, Type: es.Type}
+	switch {
+	case status == http.StatusNotFound && e.Message == "": // not an ErrorStruct, so it's from the router
+		e.Message, e.kind = cmd+": 404 page not found", ErrUnknownCommand
+		return e
+	case e.Type == "error" && e.Code == kuboCodeNotFound:
+		e.kind = ErrNotFound
+	default:
+		e.kind = classify(e.Message)
+	}
+	if e.kind == ErrPinned {
+		// "pinned (recursive)" for the pin itself, or "pinned via <CID>"
+		if fields := strings.Fields(e.Message); len(fields) >= 3 && fields[1] == "via" {
+			e.PinnedBy = fields[2]
+		}
+	}
+	return e
+}
+
+// classify returns which of the Err variables above the error message msg from the node is, or nil if it isn't any of
+// them. It's the fallback for errors whose Code doesn't say, which is most of them (Kubo reports nearly everything as
+// cmds.ErrNormal, and some versions and errors don't come with a Code or Type at all), so this is the only place that
+// looks at messages. They're matched as loosely as possible, as they change between versions.
+func classify(msg string) error {
+	switch {
+	case strings.HasPrefix(msg, "failed to get block") || strings.HasSuffix(msg, "no such file or directory"):
+		return ErrBadBlock
+	case strings.Contains(msg, "not pinned") || strings.Contains(msg, "was not recursively pinned"):
+		return ErrNotPinned
+	case strings.HasPrefix(msg, "pinned"):
+		return ErrPinned
+	case strings.Contains(msg, "already has entry") || strings.Contains(msg, "already exists"):
+		return ErrExists
+	case strings.Contains(msg, "does not exist") || strings.Contains(msg, "not found") ||
+		strings.Contains(msg, "could not resolve") || strings.HasPrefix(msg, "no key by the given name"):
+		return ErrNotFound
+	}
+	return nil
+}
+
+// errorKind returns which of the Err variables above err is. Errors which didn't come from a Client are classified by
+// their message.
+func errorKind(err error) error {
+	var ke *KuboError
+	if errors.As(err, &ke) {
+		return ke.kind
+	}
+	return classify(err.Error())
+}
+
+// Client is a typed client for the parts of the Kubo RPC API ipfs-sync uses. Every request is bound to a context, and
+// errors reported by the node are returned as *KuboError.
+type Client struct {
+	EndPoint string       // like http://127.0.0.1:5001
+	HTTP     *http.Client // http.DefaultClient if nil
+}
+
+// do sends the request for cmd with args, returning the response if the node accepted it. The caller must close the
+// body of the response.
+func (c *Client) do(ctx context.Context, cmd string, args url.Values, body io.Reader, contentType string) (*http.Response, error) {
+	u := c.EndPoint + API + cmd
+	if len(args) > 0 {
+		u += "?" + args.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", u, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	hc := c.HTTP
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		es := new(ErrorStruct)
+		if json.Unmarshal(data, es) != nil || es.Error() == "" {
+			es = new(ErrorStruct)
+			if resp.StatusCode != http.StatusNotFound {
+				es.Message = fmt.Sprintf("%s: %s", cmd, resp.Status)
+			}
+		}
+		return nil, newKuboError(cmd, resp.StatusCode, es)
+	}
+	return resp, nil
+}
+
+// call does a request for cmd with args, decoding the response into out if it isn't nil.
+func (c *Client) call(ctx context.Context, cmd string, args url.Values, out interface{}) error {
+	resp, err := c.do(ctx, cmd, args, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+		return err
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("error decoding %s response: %w", cmd, err)
+	}
+	return nil
+}
+
+// streamError returns the error the node reported after it started streaming the response to cmd, if any. The body
+// of resp must have been read to the end first.
+func streamError(cmd string, resp *http.Response) error {
+	if msg := resp.Trailer.Get("X-Stream-Error"); msg != "" {
+		return newKuboError(cmd, resp.StatusCode, &ErrorStruct{Message: msg})
+	}
+	return nil
+}
+
+// stream does a request for cmd with args, writing the response to w as it arrives.
+func (c *Client) stream(ctx context.Context, cmd string, args url.Values, w io.Writer) error {
+	resp, err := c.do(ctx, cmd, args, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return err
+	}
+	return streamError(cmd, resp)
+}
+
+// ndjson does a request for cmd with args, whose response is a stream of JSON values, calling next to decode each one
+// as it arrives. If next returns an error, the request is stopped and it's returned.
+func (c *Client) ndjson(ctx context.Context, cmd string, args url.Values, next func(dec *json.Decoder) error) error {
+	resp, err := c.do(ctx, cmd, args, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for dec.More() {
+		if err := next(dec); err != nil {
+			return err
+		}
+	}
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+		return err
+	}
+	return streamError(cmd, resp)
+}
+
+// arg returns args for a command taking the given arguments.
+func arg(values ...string) url.Values {
+	return url.Values{"arg": values}
+}
+
+// VersionResponse is returned by `version`.
+type VersionResponse struct {
+	Version string
+}
+
+// Version returns the version of the node.
+func (c *Client) Version(ctx context.Context) (*VersionResponse, error) {
+	v := new(VersionResponse)
+	return v, c.call(ctx, "version", nil, v)
+}
+
+// FilesStatResponse is returned by `files/stat`.
+type FilesStatResponse struct {
+	Hash           string
+	Size           uint64
+	CumulativeSize uint64
+	Type           string
+}
+
+// FilesStat returns the CID of the MFS file or directory at path.
+func (c *Client) FilesStat(ctx context.Context, path string) (*FilesStatResponse, error) {
+	stat := new(FilesStatResponse)
+	args := arg(path)
+	args.Set("hash", "true")
+	return stat, c.call(ctx, "files/stat", args, stat)
+}
+
+// FilesLs lists the MFS directory at path, unsorted.
+func (c *Client) FilesLs(ctx context.Context, path string) ([]*MFSEntry, error) {
+	var ls struct {
+		Entries []*MFSEntry
+	}
+	args := arg(path)
+	args.Set("long", "true")
+	args.Set("U", "true")
+	return ls.Entries, c.call(ctx, "files/ls", args, &ls)
+}
+
+// FilesMkdir makes the MFS directory at path, along with any parents if parents is true.
+func (c *Client) FilesMkdir(ctx context.Context, path string, parents bool) error {
+	args := arg(path)
+	args.Set("parents", fmt.Sprint(parents))
+	return c.call(ctx, "files/mkdir", args, nil)
+}
+
+// FilesCp copies from, an MFS path or an IPFS path like /ipfs/<CID>, to the MFS path to.
+func (c *Client) FilesCp(ctx context.Context, from, to string) error {
+	return c.call(ctx, "files/cp", arg(from, to), nil)
+}
+
+// FilesMv moves the MFS path from to to.
+func (c *Client) FilesMv(ctx context.Context, from, to string) error {
+	return c.call(ctx, "files/mv", arg(from, to), nil)
+}
+
+// FilesRm removes the MFS path, which can only be a directory if force is true.
+func (c *Client) FilesRm(ctx context.Context, path string, force bool) error {
+	args := arg(path)
+	args.Set("force", fmt.Sprint(force))
+	return c.call(ctx, "files/rm", args, nil)
+}
+
+// LsResponse is returned by `ls`.
+type LsResponse struct {
+	Objects []*LsObject
+}
+
+// Ls lists the links of the directory at path, like /ipfs/<CID>, also filling in the Size of files if size is true.
+func (c *Client) Ls(ctx context.Context, path string, size bool) (*LsResponse, error) {
+	ls := new(LsResponse)
+	args := arg(path)
+	args.Set("resolve-type", "true")
+	args.Set("size", fmt.Sprint(size))
+	return ls, c.call(ctx, "ls", args, ls)
+}
+
+// Cat writes the contents of the file at path, like /ipfs/<CID>, to w.
+func (c *Client) Cat(ctx context.Context, path string, w io.Writer) error {
+	return c.stream(ctx, "cat", arg(path), w)
+}
+
+// DagExport writes the DAG under cid to w as a CAR file.
+func (c *Client) DagExport(ctx context.Context, cid string, w io.Writer) error {
+	return c.stream(ctx, "dag/export", arg(cid), w)
+}
+
+// AddRequest is a file to `add`.
+type AddRequest struct {
+	Data     io.Reader
+	Name     string
+	AbsPath  string // path of the file on disk, required by Nocopy
+	Nocopy   bool   // add it to the filestore, instead of copying it into the blockstore
+	OnlyHash bool   // only work out its CID
+}
+
+// Add adds the file in req, without pinning it.
+func (c *Client) Add(ctx context.Context, req *AddRequest) (*HashStruct, error) {
+	args := url.Values{}
+	args.Set("nocopy", fmt.Sprint(req.Nocopy))
+	args.Set("pin", "false")
+	args.Set("quieter", "true")
+	args.Set("only-hash", fmt.Sprint(req.OnlyHash))
+	hash := new(HashStruct)
+	return hash, c.upload(ctx, "add", args, req.Name, req.AbsPath, req.Data, hash)
+}
+
+// upload does a request for cmd with args, streaming data to it as a file called name, and decoding the response into
+// out. absPath is only needed by `add` with nocopy.
+func (c *Client) upload(ctx context.Context, cmd string, args url.Values, name, absPath string, data io.Reader, out interface{}) error {
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	writer := multipart.NewWriter(pw)
+	go func() {
+		h := make(textproto.MIMEHeader)
+		if absPath != "" {
+			h.Set("Abspath", absPath)
+		}
+		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, "file", url.QueryEscape(name)))
+		h.Set("Content-Type", "application/octet-stream")
+		part, err := writer.CreatePart(h)
+		if err == nil {
+			_, err = io.Copy(part, data)
+		}
+		if err == nil {
+			err = writer.Close() // writes the closing boundary, so it must happen before the pipe is closed
+		}
+		pw.CloseWithError(err)
+	}()
+
+	resp, err := c.do(ctx, cmd, args, pr, writer.FormDataContentType())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("error decoding %s response: %w", cmd, err)
+	}
+	return nil
+}
+
+// PinResponse is returned by `pin/add`, `pin/rm` and `pin/update`.
+type PinResponse struct {
+	Pins []string
+}
+
+// PinAdd pins cid recursively.
+func (c *Client) PinAdd(ctx context.Context, cid string) (*PinResponse, error) {
+	pins := new(PinResponse)
+	return pins, c.call(ctx, "pin/add", arg(cid), pins)
+}
+
+// PinRm removes the recursive pin of cid.
+func (c *Client) PinRm(ctx context.Context, cid string) (*PinResponse, error) {
+	pins := new(PinResponse)
+	return pins, c.call(ctx, "pin/rm", arg(cid), pins)
+}
+
+// PinUpdate moves the recursive pin of from to to, unpinning from.
+func (c *Client) PinUpdate(ctx context.Context, from, to string) (*PinResponse, error) {
+	pins := new(PinResponse)
+	return pins, c.call(ctx, "pin/update", arg(from, to), pins)
+}
+
+// RefResp is a result streamed by `refs`.
+type RefResp struct {
+	Err string
+	Ref string
+}
+
+// Refs calls each with every CID linked to from cid, recursively, each only once.
+func (c *Client) Refs(ctx context.Context, cid string, each func(ref string) error) error {
+	args := arg(cid)
+	args.Set("unique", "true")
+	args.Set("recursive", "true")
+	return c.ndjson(ctx, "refs", args, func(dec *json.Decoder) error {
+		ref := new(RefResp)
+		if err := dec.Decode(ref); err != nil {
+			return fmt.Errorf("error decoding refs response: %w", err)
+		}
+		if ref.Err != "" {
+			return newKuboError("refs", http.StatusOK, &ErrorStruct{Message: ref.Err})
+		}
+		return each(ref.Ref)
+	})
+}
+
+// BlockRmResponse is returned by `block/rm`, which reports errors removing the block in it.
+type BlockRmResponse struct {
+	Hash  string
+	Error string
+}
+
+// BlockRm removes the block cid from the blockstore.
+func (c *Client) BlockRm(ctx context.Context, cid string) error {
+	rm := new(BlockRmResponse)
+	if err := c.call(ctx, "block/rm", arg(cid), rm); err != nil {
+		return err
+	}
+	if rm.Error != "" {
+		return newKuboError("block/rm", http.StatusOK, &ErrorStruct{Message: rm.Error})
+	}
+	return nil
+}
+
+// FileStoreStatus is the status of a block in the filestore.
+type FileStoreStatus int
+
+// NoFile is the FileStoreStatus of a block whose file is gone.
+const NoFile FileStoreStatus = 11
+
+// FileStoreKey is the CID of a block in the filestore.
+type FileStoreKey struct {
+	Slash string `json:"/"`
+}
+
+// FileStoreEntry is for results returned by `filestore/verify`, only processes Status and Key, as that's all ipfs-sync uses.
+type FileStoreEntry struct {
+	Status FileStoreStatus
+	Key    FileStoreKey
+}
+
+// FilestoreVerify calls each with every block in the filestore, and its status.
+func (c *Client) FilestoreVerify(ctx context.Context, each func(entry *FileStoreEntry) error) error {
+	return c.ndjson(ctx, "filestore/verify", nil, func(dec *json.Decoder) error {
+		entry := new(FileStoreEntry)
+		if err := dec.Decode(entry); err != nil {
+			return fmt.Errorf("error decoding filestore/verify response: %w", err)
+		}
+		return each(entry)
+	})
+}
+
+// KeyList lists every IPNS key in the node.
+func (c *Client) KeyList(ctx context.Context) (*Keys, error) {
+	keys := new(Keys)
+	return keys, c.call(ctx, "key/list", nil, keys)
+}
+
+// KeyGen generates an IPNS key called name.
+func (c *Client) KeyGen(ctx context.Context, name string) (*Key, error) {
+	key := new(Key)
+	return key, c.call(ctx, "key/gen", arg(name), key)
+}
+
+// NamePublishResponse is returned by `name/publish`.
+type NamePublishResponse struct {
+	Name  string
+	Value string
+}
+
+// NamePublish publishes path, like a CID, to the IPNS key called key.
+func (c *Client) NamePublish(ctx context.Context, path, key string) (*NamePublishResponse, error) {
+	pub := new(NamePublishResponse)
+	args := arg(path)
+	args.Set("key", key)
+	return pub, c.call(ctx, "name/publish", args, pub)
+}
+
+// NameResolveResponse is returned by `name/resolve`.
+type NameResolveResponse struct {
+	Path string
+}
+
+// NameResolve resolves the IPNS name, skipping the node's cache if nocache is true.
+func (c *Client) NameResolve(ctx context.Context, name string, nocache bool) (*NameResolveResponse, error) {
+	res := new(NameResolveResponse)
+	args := arg(name)
+	args.Set("nocache", fmt.Sprint(nocache))
+	return res, c.call(ctx, "name/resolve", args, res)
+}
+
+// RoutingGet writes the IPNS record of name, like /ipns/<ID>, to w.
+func (c *Client) RoutingGet(ctx context.Context, name string, w io.Writer) error {
+	return c.stream(ctx, "routing/get", arg(name), w)
+}
+
+// IPNSEntry is the part of an IPNS record returned by `name/inspect` ipfs-sync uses.
+type IPNSEntry struct {
+	Value    string
+	Sequence uint64
+}
+
+// NameInspectResponse is returned by `name/inspect`.
+type NameInspectResponse struct {
+	Entry IPNSEntry
+}
+
+// NameInspect decodes the IPNS record in record, as returned by RoutingGet.
+func (c *Client) NameInspect(ctx context.Context, record io.Reader) (*NameInspectResponse, error) {
+	res := new(NameInspectResponse)
+	return res, c.upload(ctx, "name/inspect", nil, "record", "", record, res)
+}
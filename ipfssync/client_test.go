@@ -0,0 +1,168 @@
+package ipfssync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientErrors(t *testing.T) {
+	fk := newFakeKubo()
+	defer fk.Close()
+	c := &Client{EndPoint: fk.URL}
+	ctx := context.Background()
+
+	hash, err := c.Add(ctx, &AddRequest{Data: strings.NewReader("hello"), Name: "hello.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fk.lock.Lock()
+	dir := fk.putDir(map[string]string{"hello.txt": hash.Hash})
+	fk.lock.Unlock()
+	if _, err := c.PinAdd(ctx, dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.FilesCp(ctx, "/ipfs/"+hash.Hash, "/hello.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, statErr := c.FilesStat(ctx, "/missing")
+	_, pinErr := c.PinRm(ctx, hash.Hash)
+	if _, err := c.KeyGen(ctx, "dup"); err != nil {
+		t.Fatal(err)
+	}
+	_, keyErr := c.KeyGen(ctx, "dup")
+	for name, test := range map[string]struct {
+		err  error
+		kind error
+	}{
+		"files/stat of a missing file":  {statErr, ErrNotFound},
+		"files/cp over a file":          {c.FilesCp(ctx, "/ipfs/"+hash.Hash, "/hello.txt"), ErrExists},
+		"files/cp of a missing block":   {c.FilesCp(ctx, "/ipfs/"+fakeCID([]byte("nope")), "/nope.txt"), ErrBadBlock},
+		"block/rm of a pinned block":    {c.BlockRm(ctx, hash.Hash), ErrPinned},
+		"pin/rm of an indirect pin":     {pinErr, ErrNotPinned},
+		"key/gen of an existing key":    {keyErr, ErrExists},
+		"a command the node hasn't got": {c.call(ctx, "nope", nil, nil), ErrUnknownCommand},
+	} {
+		var ke *KuboError
+		if !errors.As(test.err, &ke) || !errors.Is(test.err, test.kind) {
+			t.Errorf("%s returned %#v, expected %v", name, test.err, test.kind)
+		}
+	}
+
+	var ke *KuboError
+	if err := c.BlockRm(ctx, hash.Hash); !errors.As(err, &ke) || ke.PinnedBy != dir || ke.Command != "block/rm" {
+		t.Errorf("Pinned block error was %#v, expected it to be pinned by %s", err, dir)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := c.Version(cancelled); !errors.Is(err, context.Canceled) {
+		t.Errorf("Request with a cancelled context returned %v", err)
+	}
+}
+
+func TestNewKuboError(t *testing.T) {
+	for _, test := range []struct {
+		status int
+		es     ErrorStruct
+		kind   error
+	}{
+		{500, ErrorStruct{Message: "routing: not found", Code: kuboCodeNotFound, Type: "error"}, ErrNotFound},
+		{500, ErrorStruct{Message: "no record for this name", Code: kuboCodeNotFound, Type: "error"}, ErrNotFound},
+		{500, ErrorStruct{Message: "file does not exist", Code: 0, Type: "error"}, ErrNotFound},
+		{500, ErrorStruct{Message: "pinned via bafyroot", Code: 0, Type: "error"}, ErrPinned},
+		{400, ErrorStruct{Message: "invalid path", Code: 1, Type: "error"}, nil},
+		{500, ErrorStruct{Error2: "failed to get block for bafkone: blockstore: block not found"}, ErrBadBlock}, // no Code
+		{404, ErrorStruct{}, ErrUnknownCommand},
+	} {
+		if e := newKuboError("test", test.status, &test.es); e.kind != test.kind {
+			t.Errorf("%d %+v was classified as %v, expected %v", test.status, test.es, e.kind, test.kind)
+		}
+	}
+}
+
+func TestClientStreams(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Stream-Error")
+		switch strings.TrimPrefix(r.URL.Path, API) {
+		case "refs":
+			fmt.Fprintln(w, `{"Ref":"bafkone","Err":""}`)
+			fmt.Fprintln(w, `{"Ref":"bafktwo","Err":""}`)
+			w.(http.Flusher).Flush()
+			w.Header().Set("X-Stream-Error", "failed to get block for bafkthree: blockstore: block not found")
+		case "filestore/verify":
+			fmt.Fprintln(w, `{"Status":0,"Key":{"/":"bafkok"}}`)
+			fmt.Fprintln(w, `{"Status":11,"Key":{"/":"bafkgone"}}`)
+		}
+	}))
+	defer server.Close()
+	c := &Client{EndPoint: server.URL}
+	ctx := context.Background()
+
+	var refs []string
+	err := c.Refs(ctx, "bafkroot", func(ref string) error {
+		refs = append(refs, ref)
+		return nil
+	})
+	if len(refs) != 2 || refs[0] != "bafkone" || refs[1] != "bafktwo" {
+		t.Errorf("Unexpected refs %v", refs)
+	}
+	if !errors.Is(err, ErrBadBlock) {
+		t.Errorf("Error after streaming refs was %v, expected a bad block", err)
+	}
+
+	var gone []string
+	err = c.FilestoreVerify(ctx, func(entry *FileStoreEntry) error {
+		if entry.Status == NoFile {
+			gone = append(gone, entry.Key.Slash)
+		}
+		return nil
+	})
+	if err != nil || len(gone) != 1 || gone[0] != "bafkgone" {
+		t.Errorf("Filestore verify found %v missing, %v", gone, err)
+	}
+
+	stop := errors.New("stop")
+	if err := c.FilestoreVerify(ctx, func(*FileStoreEntry) error { return stop }); err != stop {
+		t.Errorf("Stopping filestore verify returned %v", err)
+	}
+}
+
+func TestStopCancelsRequests(t *testing.T) {
+	block := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-block:
+		}
+	}))
+	defer server.Close()
+	defer close(block)
+	s, err := NewSyncer(&Options{EndPoint: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- s.Cat(s.Context(), "/ipfs/bafkone", ioutil.Discard) }()
+	time.Sleep(time.Millisecond * 50)
+	s.Stop()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Request in flight during Stop returned %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Request in flight wasn't cancelled by Stop")
+	}
+	if err := s.Context().Err(); err != nil {
+		t.Errorf("Context after Stop is already done: %v", err)
+	}
+}
@@ -1,24 +1,12 @@
-package main
+package ipfssync
 
 import (
 	"io"
-	"log"
 	"os"
-	"os/signal"
 	"strings"
-	"syscall"
 
 	"github.com/cespare/xxhash/v2"
-	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/util"
-	"sync"
-)
-
-var (
-	DB *leveldb.DB
-
-	HashLock *sync.RWMutex
-	Hashes   map[string]*FileHash
 )
 
 type FileHash struct {
@@ -27,8 +15,10 @@ type FileHash struct {
 	FakeHash   []byte // timestamp
 }
 
-// Update cross-references the hash at PathOnDisk with the one in the db, updating if necessary. Returns true if updated.
-func (fh *FileHash) Update() bool {
+// updateHash cross-references the hash at fh.PathOnDisk with the one in the db, updating if necessary. Returns true if
+// updated.
+func (s *Syncer) updateHash(fh *FileHash) bool {
+	DB := s.DB
 	if DB == nil || fh == nil {
 		return false
 	}
@@ -51,8 +41,10 @@ func (fh *FileHash) Update() bool {
 	return hashChanged && tsChanged
 }
 
-// Delete removes the PathOnFisk:Hash from the db, works with directories. path is used in case fh is nil (directory)
-func (fh *FileHash) Delete(path string) {
+// deleteHash removes the PathOnDisk:Hash of fh from the db, works with directories. path is used in case fh is nil
+// (directory). HashLock should be held by the caller.
+func (s *Syncer) deleteHash(fh *FileHash, path string) {
+	DB := s.DB
 	if DB == nil {
 		return
 	}
@@ -62,16 +54,65 @@ func (fh *FileHash) Delete(path string) {
 	iter := DB.NewIterator(util.BytesPrefix([]byte(path)), nil)
 	for iter.Next() {
 		path := iter.Key()
-		if Verbose {
-			log.Println("Deleting", string(path), "from DB ...")
+		if s.opt().Verbose {
+			s.log.Println("Deleting", string(path), "from DB ...")
 		}
 		DB.Delete(path, nil)
 		DB.Delete([]byte("ts_"+string(path)), nil)
-		delete(Hashes, string(path))
+		delete(s.Hashes, string(path))
 	}
 	iter.Release()
 }
 
+// moveHashes moves the records for from (and everything under it, if it's a directory) to to. HashLock should be
+// held by the caller.
+func (s *Syncer) moveHashes(from, to string) {
+	DB := s.DB
+	if DB == nil {
+		return
+	}
+	isMoved := func(path string) bool {
+		return path == from || strings.HasPrefix(path, from+string(os.PathSeparator))
+	}
+	for _, prefix := range []string{"", "ts_"} {
+		iter := DB.NewIterator(util.BytesPrefix([]byte(prefix+from)), nil)
+		for iter.Next() {
+			path := string(iter.Key()[len(prefix):])
+			if !isMoved(path) {
+				continue
+			}
+			if s.opt().Verbose {
+				s.log.Println("Moving", path, "to", to+path[len(from):], "in DB ...")
+			}
+			DB.Put([]byte(prefix+to+path[len(from):]), iter.Value(), nil)
+			DB.Delete(iter.Key(), nil)
+		}
+		iter.Release()
+	}
+	for path, fh := range s.Hashes {
+		if isMoved(path) {
+			delete(s.Hashes, path)
+			fh.PathOnDisk = to + path[len(from):]
+			s.Hashes[fh.PathOnDisk] = fh
+		}
+	}
+}
+
+// unchanged returns true if the file at path still matches the hash recorded for it, so adding it again wouldn't change
+// anything.
+func (s *Syncer) unchanged(path string, dontHash bool) bool {
+	s.HashLock.RLock()
+	fh := s.Hashes[path]
+	var recorded []byte
+	if fh != nil && dontHash {
+		recorded = fh.FakeHash
+	} else if fh != nil {
+		recorded = fh.Hash
+	}
+	s.HashLock.RUnlock()
+	return recorded != nil && string(GetHashValue(path, dontHash)) == string(recorded)
+}
+
 // Recalculate simply recalculates the Hash, updating Hash and PathOnDisk, and returning a copy of the pointer.
 func (fh *FileHash) Recalculate(PathOnDisk string, dontHash bool) *FileHash {
 	fh.PathOnDisk = PathOnDisk
@@ -106,57 +147,35 @@ func GetHashValue(fpath string, dontHash bool) []byte {
 		size := fi.Size()
 		time := fi.ModTime().Unix()
 		return []byte{byte(0xff & size), byte(0xff & (size >> 8)), byte(0xff & (size >> 16)), byte(0xff & (size >> 32)),
-			byte(0xff & (size >> 40)), byte(0xff & (size >> 48)), byte(0xff & (size >> 56)), byte(0xff & (size >> 64)),
+			byte(0xff & (size >> 40)), byte(0xff & (size >> 48)), byte(0xff & (size >> 56)), byte(0xff & (size >> 63)),
 			byte(0xff & time), byte(0xff & (time >> 8)), byte(0xff & (time >> 16)), byte(0xff & (time >> 32)),
-			byte(0xff & (time >> 40)), byte(0xff & (time >> 48)), byte(0xff & (time >> 56)), byte(0xff & (time >> 64)),
+			byte(0xff & (time >> 40)), byte(0xff & (time >> 48)), byte(0xff & (time >> 56)), byte(0xff & (time >> 63)),
 		}
 	}
 }
 
-// HashDir recursively searches through a directory, hashing every file, and returning them as a list []*FileHash.
-func HashDir(path string, dontHash bool) (map[string]*FileHash, error) {
-	files, err := filePathWalkDir(path)
+// hashDir recursively searches through the directory of dk, hashing every file which isn't ignored, and returning them
+// as a map of *FileHash.
+func (s *Syncer) hashDir(dk *DirKey) (map[string]*FileHash, error) {
+	dontHash := dk.DontHash
+	files, err := s.filePathWalkDir(dk)
 	if err != nil {
 		return nil, err
 	}
 	hashes := make(map[string]*FileHash, len(files))
 	for _, file := range files {
-		if Verbose {
-			log.Println("Loading", file, "...")
-		}
-		splitName := strings.Split(file, ".")
-		if findInStringSlice(Ignore, splitName[len(splitName)-1]) > -1 {
-			continue
+		if s.opt().Verbose {
+			s.log.Println("Loading", file, "...")
 		}
-
 		// Load existing data from DB
 		var hash, timestamp []byte
 		if !dontHash {
-			hash, _ = DB.Get([]byte(file), nil)
+			hash, _ = s.DB.Get([]byte(file), nil)
 		}
-		timestamp, _ = DB.Get([]byte("ts_"+file), nil)
+		timestamp, _ = s.DB.Get([]byte("ts_"+file), nil)
 		fh := &FileHash{PathOnDisk: file, Hash: hash, FakeHash: timestamp}
 		fh.Recalculate(file, dontHash) // Recalculate using info from DB (avoiding rehash if possible)
 		hashes[file] = fh
 	}
 	return hashes, nil
 }
-
-// InitDB initializes a database at `path`.
-func InitDB(path string) {
-	Hashes = make(map[string]*FileHash)
-	HashLock = new(sync.RWMutex)
-	tdb, err := leveldb.OpenFile(path, nil)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	DB = tdb
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	signal.Notify(c, os.Interrupt, syscall.SIGINT)
-	go func() {
-		<-c
-		DB.Close()
-		os.Exit(1)
-	}()
-}
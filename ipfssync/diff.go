@@ -0,0 +1,283 @@
+package ipfssync
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Types of Change.
+const (
+	ChangeAdded    = "added"
+	ChangeRemoved  = "removed"
+	ChangeModified = "modified"
+)
+
+// Change is a file which differs between two roots.
+type Change struct {
+	Path string // relative to the root, separated by "/"
+	Type string // ChangeAdded, ChangeRemoved, or ChangeModified
+	Size uint64 // size of the new file, or the old one if it was removed
+}
+
+// DiffSummary counts the Changes between two roots.
+type DiffSummary struct {
+	Added       int
+	Removed     int
+	Modified    int
+	Size        uint64 // total size of the files added or modified
+	Unavailable bool   `json:",omitempty"` // too much changed to count it when published, see SummaryLimit
+}
+
+// SummaryLimit is the most directories compared to summarize what changed in a publish. If more changed than that, the
+// summary is recorded as unavailable, rather than holding up the publish.
+var SummaryLimit = 1000
+
+// errSummaryLimit is returned by diffDirs when it would compare more than SummaryLimit directories.
+var errSummaryLimit = errors.New("too many changed directories")
+
+// Summarize counts changes.
+func Summarize(changes []*Change) *DiffSummary {
+	ds := new(DiffSummary)
+	for _, change := range changes {
+		switch change.Type {
+		case ChangeAdded:
+			ds.Added++
+		case ChangeRemoved:
+			ds.Removed++
+			continue
+		case ChangeModified:
+			ds.Modified++
+		}
+		ds.Size += change.Size
+	}
+	return ds
+}
+
+// String returns a short summary like "2 added, 1 removed, 0 modified (1.5 KiB)".
+func (ds *DiffSummary) String() string {
+	if ds.Unavailable {
+		return "diff unavailable"
+	}
+	return fmt.Sprintf("%d added, %d removed, %d modified (%s)", ds.Added, ds.Removed, ds.Modified, FormatSize(ds.Size))
+}
+
+// FormatSize returns size in bytes as a human readable string, like "1.5 KiB".
+func FormatSize(size uint64) string {
+	if size < 1024 {
+		return fmt.Sprintf("%d B", size)
+	}
+	value, unit := float64(size)/1024, 0
+	for value >= 1024 && unit < 4 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTP"[unit])
+}
+
+var (
+	// ErrRootChanged is returned by Approve when the dir changed after the root being approved was reviewed.
+	ErrRootChanged = errors.New("the dir has changed since it was reviewed")
+	// ErrHeldBack is returned by Approve when the guard is holding back files, see DirKey.Quarantined.
+	ErrHeldBack = errors.New("held back")
+	// ErrNotSettled is returned by Approve when an Atomic dir still has changes waiting to be applied.
+	ErrNotSettled = errors.New("staging not settled")
+)
+
+// DiffRoots returns every file that differs between the directories from and to (either may be empty), sorted by
+// path. Directories which are the same in both aren't listed at all, so unchanged parts of the tree are cheap.
+func (s *Syncer) DiffRoots(from, to string) ([]*Change, error) {
+	return s.diffRoots(from, to, -1)
+}
+
+// diffRoots is DiffRoots, returning errSummaryLimit if more than limit directories differ (unless limit is negative).
+func (s *Syncer) diffRoots(from, to string, limit int) ([]*Change, error) {
+	var changes []*Change
+	if err := s.diffDirs(from, to, "", &changes, &limit); err != nil {
+		return nil, err
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+// diffDirs adds the differences between the directories from and to, under prefix, to changes. limit is how many more
+// directories can be compared, if it isn't negative.
+func (s *Syncer) diffDirs(from, to, prefix string, changes *[]*Change, limit *int) error {
+	if from == to {
+		return nil
+	}
+	if *limit == 0 {
+		return errSummaryLimit
+	} else if *limit > 0 {
+		*limit--
+	}
+	links := make(map[string][2]*LsLink) // the link in from, and the link in to
+	for i, cid := range []string{from, to} {
+		if cid == "" {
+			continue
+		}
+		ls, err := s.ls(s.Context(), "/ipfs/"+cid, true)
+		if err != nil {
+			return fmt.Errorf("error listing %s: %w", cid, err)
+		}
+		for _, link := range ls {
+			pair := links[link.Name]
+			pair[i] = link
+			links[link.Name] = pair
+		}
+	}
+	for name, pair := range links {
+		o, n := pair[0], pair[1]
+		path := prefix + name
+		oldDir, newDir := o != nil && o.Type == UnixFSDir, n != nil && n.Type == UnixFSDir
+		var oldCID, newCID string
+		if oldDir {
+			oldCID = o.Hash
+		}
+		if newDir {
+			newCID = n.Hash
+		}
+		if err := s.diffDirs(oldCID, newCID, path+"/", changes, limit); err != nil {
+			return err
+		}
+		switch {
+		case o != nil && !oldDir && n != nil && !newDir:
+			if o.Hash != n.Hash {
+				*changes = append(*changes, &Change{Path: path, Type: ChangeModified, Size: n.Size})
+			}
+		default:
+			if o != nil && !oldDir {
+				*changes = append(*changes, &Change{Path: path, Type: ChangeRemoved, Size: o.Size})
+			}
+			if n != nil && !newDir {
+				*changes = append(*changes, &Change{Path: path, Type: ChangeAdded, Size: n.Size})
+			}
+		}
+	}
+	return nil
+}
+
+// PendingChanges returns the current MFS root of dk (its staging copy, if dk is Atomic), and everything that's changed
+// in it since dk was last published. If dk is encrypted, the paths are decrypted.
+func (s *Syncer) PendingChanges(dk *DirKey) (string, []*Change, error) {
+	root := s.GetFileCID(s.Context(), dk.workPath())
+	if root == "" {
+		return "", nil, fmt.Errorf("%s isn't in the MFS", dk.workPath())
+	}
+	changes, err := s.DiffRoots(dk.GetCID(), root)
+	if err != nil {
+		return "", nil, err
+	}
+	dk.decryptChanges(changes)
+	return root, changes, nil
+}
+
+// decryptChanges decrypts the paths of changes, if dk is encrypted.
+func (dk *DirKey) decryptChanges(changes []*Change) {
+	if dk.crypt == nil {
+		return
+	}
+	for _, change := range changes {
+		names := strings.Split(change.Path, "/")
+		for i, name := range names {
+			if plain, err := dk.crypt.DecryptName(name); err == nil {
+				names[i] = plain
+			}
+		}
+		change.Path = strings.Join(names, "/")
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+}
+
+// DiffVersions returns what changed in the dir with the given ID between the roots from and to, which can each be a
+// CID or a timestamp from its publish history (see FindRecord), along with the roots compared. to defaults to the
+// current root, and from to the root published before to. Paths are decrypted if the dir is encrypted.
+func (s *Syncer) DiffVersions(id, from, to string) (string, string, []*Change, error) {
+	dk := s.Dir(id)
+	if dk == nil {
+		return "", "", nil, fmt.Errorf("no dir with ID '%s'", id)
+	}
+	to, err := s.resolveVersion(dk, to)
+	if err != nil {
+		return "", "", nil, err
+	}
+	if from == "" {
+		from, err = s.previousVersion(dk, to)
+	} else {
+		from, err = s.resolveVersion(dk, from)
+	}
+	if err != nil {
+		return "", "", nil, err
+	}
+	changes, err := s.DiffRoots(from, to)
+	if err != nil {
+		return "", "", nil, err
+	}
+	dk.decryptChanges(changes)
+	return from, to, changes, nil
+}
+
+// resolveVersion returns the root of dk target refers to, a CID or a timestamp from its publish history. If target is
+// empty, it's the current root.
+func (s *Syncer) resolveVersion(dk *DirKey, target string) (string, error) {
+	if target == "" {
+		if cid := dk.GetCID(); cid != "" {
+			return cid, nil
+		}
+		return "", fmt.Errorf("'%s' hasn't been published yet", dk.ID)
+	}
+	if _, err := time.Parse(time.RFC3339, target); err == nil {
+		record, err := s.FindRecord(dk.ID, target)
+		if err != nil {
+			return "", err
+		}
+		return record.CID, nil
+	}
+	return strings.TrimPrefix(target, "/ipfs/"), nil
+}
+
+// previousVersion returns the root dk was published as before it was last published as cid.
+func (s *Syncer) previousVersion(dk *DirKey, cid string) (string, error) {
+	records, err := s.History(dk.ID)
+	if err != nil {
+		return "", err
+	}
+	i := len(records) - 1
+	for i >= 0 && records[i].CID != cid {
+		i--
+	}
+	for ; i >= 0; i-- {
+		if records[i].CID != cid { // skip republishing the same root
+			return records[i].CID, nil
+		}
+	}
+	return "", fmt.Errorf("'%s' wasn't published as anything before %s", dk.ID, cid)
+}
+
+// summarize returns what changed in dk between the roots from and to, or nil if it can't be worked out. If more than
+// SummaryLimit directories changed, the summary is marked unavailable.
+func (s *Syncer) summarize(dk *DirKey, from, to string) *DiffSummary {
+	changes, err := s.diffRoots(from, to, SummaryLimit)
+	if errors.Is(err, errSummaryLimit) {
+		return &DiffSummary{Unavailable: true}
+	} else if err != nil {
+		if s.opt().Verbose {
+			s.log.Println("Error comparing", from, "to", to+":", err)
+		}
+		return nil
+	}
+	return Summarize(changes)
+}
+
+// Approve publishes dk by hand, which is the only way a dir with Manual set is published. If root isn't empty, dk is
+// only published if its MFS root still matches it, so exactly what was reviewed with PendingChanges goes live. root is
+// required if dk.Confirm is set. ErrHeldBack or ErrNotSettled are returned if dk can't be published yet.
+func (s *Syncer) Approve(dk *DirKey, root string) error {
+	if root == "" && dk.Confirm {
+		return fmt.Errorf("'%s' can only be published by confirming the root being published", dk.ID)
+	}
+	_, err := s.publishDir(dk, true, root)
+	return err
+}
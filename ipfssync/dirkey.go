@@ -0,0 +1,210 @@
+package ipfssync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// DirKey used for keeping track of directories, and it's used in the `dirs` config paramerter and Options.Dirs.
+type DirKey struct {
+	// config values
+	ID              string           `json:"ID" yaml:"ID"`
+	Dir             string           `yaml:"Dir"`
+	Nocopy          bool             `yaml:"Nocopy"`
+	DontHash        bool             `yaml:"DontHash"`
+	Pin             bool             `yaml:"Pin"`
+	Estuary         bool             `yaml:"Estuary"`
+	Concurrency     int              `yaml:"Concurrency"`     // 0 uses Options.Concurrency
+	PinningServices []string         `yaml:"PinningServices"` // names of the remote pinning services to pin to
+	Ignore          []string         `yaml:"Ignore"`          // gitignore-style patterns, on top of Options.Ignore
+	Retain          *RetentionPolicy `yaml:"Retain"`          // previous roots to keep pinned, nil to only keep the current one
+	DNSLinkProvider string           `yaml:"DNSLinkProvider"` // name of the DNSLink provider to update DNSLinkDomains with
+	DNSLinkDomains  []string         `yaml:"DNSLinkDomains"`  // domains whose DNSLink is pointed at every new root
+	Follow          string           `yaml:"Follow"`          // IPNS name or DNSLink domain to mirror into Dir, instead of syncing Dir
+	TwoWay          bool             `yaml:"TwoWay"`          // merge in changes published by other instances sharing the IPNS key
+	Encrypt         *Encryption      `yaml:"Encrypt"`         // encrypt file contents and names before adding them, nil to add them as-is
+	Manual          bool             `yaml:"Manual"`          // only publish when approved, see Syncer.Approve
+	Confirm         bool             `yaml:"Confirm"`         // with Manual, approving requires the root being published
+	Atomic          bool             `yaml:"Atomic"`          // stage changes, only publishing once they've all been applied
+	Export          *ExportPolicy    `yaml:"Export"`          // write a CAR file of every new root, nil to not export
+
+	// probably best to let this be managed automatically
+	CID     string
+	MFSPath string
+	Key     string // IPNS name
+
+	lock     sync.Mutex // guards CID, Key, paused, queue, watched, changes, adding, moving, addGen, quarantined and allowed
+	workLock sync.Mutex // held while syncing or publishing
+	paused   bool
+	queue    *EventQueue
+	watched  int           // amount of directories being watched
+	changes  ChangeSummary // changes since the last publish
+	done     chan bool     // stops the watcher
+	adding   int           // batches of files being added
+	moving   int           // renames waiting to be paired up, or to be applied to the MFS
+	addGen   uint64        // changes whenever a batch starts or finishes
+
+	followed map[string]*followedFile // files downloaded by FollowDir, if there's no DB
+	crypt    *Cipher                  // from Encrypt, set when dk is synced
+	header   *encryptionHeader        // what crypt was derived with
+
+	quarantined map[string]string // files held back by the guard, and why
+	allowed     map[string][]byte // files allowed despite the guard, with their hashes, if there's no DB
+
+	ignoreRules []*ignoreRule
+	ignoreLock  sync.Mutex               // guards ignoreFiles
+	ignoreFiles map[string][]*ignoreRule // rules from each IgnoreFile loaded so far, by directory
+
+	pinWatches map[string]*pinWatch // latest remote pin being watched on each pinning service, guarded by lock
+	exports    []*pendingExport     // roots waiting to be exported, guarded by lock
+	exporting  bool                 // roots are being exported, guarded by lock
+}
+
+// Prepare checks if dk is at least somewhat valid, and fills in the fields derived from the config.
+func (dk *DirKey) Prepare() error {
+	if len(dk.Dir) == 0 {
+		return fmt.Errorf("Dir entry path cannot be empty. (ID: %s )", dk.ID)
+	}
+
+	// Check if trailing "/" exists, if not, append it.
+	if dk.Dir[len(dk.Dir)-1] != os.PathSeparator {
+		dk.Dir = dk.Dir + string(os.PathSeparator)
+	}
+	splitPath := strings.Split(dk.Dir, string(os.PathSeparator))
+	dk.MFSPath = splitPath[len(splitPath)-2]
+
+	if dk.Follow != "" && (dk.TwoWay || dk.Atomic) {
+		return fmt.Errorf("Follow can't be used with TwoWay or Atomic. (ID: %s )", dk.ID)
+	}
+
+	if dk.Export != nil && dk.Export.Dir == "" {
+		return fmt.Errorf("Export needs a Dir. (ID: %s )", dk.ID)
+	}
+
+	if dk.Encrypt != nil {
+		if dk.Nocopy || dk.Follow != "" || dk.TwoWay {
+			return fmt.Errorf("Encrypt can't be used with Nocopy, Follow, or TwoWay. (ID: %s )", dk.ID)
+		}
+		if _, err := dk.Encrypt.secret(); err != nil {
+			return fmt.Errorf("%w (ID: %s )", err, dk.ID)
+		}
+	}
+
+	dk.ignoreRules = parseIgnore(dk.Ignore, 0, false)
+
+	// Estuary is just another pinning service now.
+	if dk.Estuary && findInStringSlice(dk.PinningServices, "estuary") == -1 {
+		dk.PinningServices = append(dk.PinningServices, "estuary")
+	}
+	return nil
+}
+
+// mfsPath returns the MFS path of path, a path under dk.Dir, with every name encrypted if dk is encrypted. If dk is
+// Atomic, it's the path in the staging copy.
+func (dk *DirKey) mfsPath(path string) string {
+	rel := filepath.ToSlash(path[len(dk.Dir):])
+	if dk.crypt != nil {
+		names := strings.Split(rel, "/")
+		for i, name := range names {
+			if name != "" {
+				names[i] = dk.crypt.EncryptName(name)
+			}
+		}
+		rel = strings.Join(names, "/")
+	}
+	return dk.workPath() + "/" + rel
+}
+
+// GetCID returns the CID dk was last published as.
+func (dk *DirKey) GetCID() string {
+	dk.lock.Lock()
+	defer dk.lock.Unlock()
+	return dk.CID
+}
+
+// SetCID sets the CID dk was last published as.
+func (dk *DirKey) SetCID(cid string) {
+	dk.lock.Lock()
+	dk.CID = cid
+	dk.lock.Unlock()
+}
+
+// GetKey returns the IPNS name of dk.
+func (dk *DirKey) GetKey() string {
+	dk.lock.Lock()
+	defer dk.lock.Unlock()
+	return dk.Key
+}
+
+// SetKey sets the IPNS name of dk.
+func (dk *DirKey) SetKey(key string) {
+	dk.lock.Lock()
+	dk.Key = key
+	dk.lock.Unlock()
+}
+
+// Paused returns true if adding files and publishing is paused for dk.
+func (dk *DirKey) Paused() bool {
+	dk.lock.Lock()
+	defer dk.lock.Unlock()
+	return dk.paused
+}
+
+// SetPaused pauses or resumes adding files and publishing for dk. Changes are still queued while paused.
+func (dk *DirKey) SetPaused(paused bool) {
+	dk.lock.Lock()
+	dk.paused = paused
+	dk.lock.Unlock()
+}
+
+// Watched returns the amount of directories being watched for changes in dk.
+func (dk *DirKey) Watched() int {
+	dk.lock.Lock()
+	defer dk.lock.Unlock()
+	return dk.watched
+}
+
+func (dk *DirKey) addWatched(delta int) {
+	dk.lock.Lock()
+	dk.watched += delta
+	dk.lock.Unlock()
+}
+
+// Queue returns the queue of files waiting to be added to dk, or nil if dk isn't being watched.
+func (dk *DirKey) Queue() *EventQueue {
+	dk.lock.Lock()
+	defer dk.lock.Unlock()
+	return dk.queue
+}
+
+// ChangeSummary counts the files changed in a dir between publishes.
+type ChangeSummary struct {
+	Added   int // added or modified
+	Removed int
+	Moved   int
+}
+
+// String returns a short summary like "+2 -1 ~0".
+func (cs ChangeSummary) String() string {
+	return fmt.Sprintf("+%d -%d ~%d", cs.Added, cs.Removed, cs.Moved)
+}
+
+func (dk *DirKey) addChanges(added, removed, moved int) {
+	dk.lock.Lock()
+	dk.changes.Added += added
+	dk.changes.Removed += removed
+	dk.changes.Moved += moved
+	dk.lock.Unlock()
+}
+
+// takeChanges returns the changes since the last publish, and starts counting again.
+func (dk *DirKey) takeChanges() ChangeSummary {
+	dk.lock.Lock()
+	defer dk.lock.Unlock()
+	changes := dk.changes
+	dk.changes = ChangeSummary{}
+	return changes
+}
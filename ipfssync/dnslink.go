@@ -0,0 +1,149 @@
+package ipfssync
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNSLink provider types, for DNSLinkConfig.Type.
+const (
+	DNSLinkRFC2136  = "rfc2136"
+	DNSLinkZoneFile = "zonefile"
+)
+
+// DNSLinkProvider updates the DNSLink records (https://dnslink.io) of domains.
+type DNSLinkProvider interface {
+	// SetDNSLink points the TXT record at _dnslink.<domain> to path, like "/ipfs/<CID>".
+	SetDNSLink(domain, path string) error
+}
+
+// DNSLinkConfig configures a DNSLinkProvider, which dirs can use by name. It's used in the `DNSLinkProviders` config
+// parameter.
+type DNSLinkConfig struct {
+	Name string `yaml:"Name"`
+	Type string `yaml:"Type"` // DNSLinkRFC2136 or DNSLinkZoneFile
+	TTL  int    `yaml:"TTL"`  // TTL of the TXT records (default 60)
+
+	// DNSLinkRFC2136
+	Server        string `yaml:"Server"`        // address of the DNS server to send updates to (ex: 127.0.0.1:53)
+	Zone          string `yaml:"Zone"`          // zone the domains are in (ex: example.com)
+	TSIGKey       string `yaml:"TSIGKey"`       // name of the TSIG key to sign updates with, if any
+	TSIGSecret    string `yaml:"TSIGSecret"`    // base64 encoded TSIG secret
+	TSIGAlgorithm string `yaml:"TSIGAlgorithm"` // hmac-sha256 (default), hmac-sha512, or hmac-sha1
+
+	// DNSLinkZoneFile
+	File string `yaml:"File"` // zone file to write the TXT records to, meant to be $INCLUDEd in a zone
+
+	// Provider is used instead of Type if it's set, so library users can bring their own.
+	Provider DNSLinkProvider `yaml:"-"`
+}
+
+// provider returns the DNSLinkProvider described by dc.
+func (dc *DNSLinkConfig) provider(timeout time.Duration) (DNSLinkProvider, error) {
+	if dc.Provider != nil {
+		return dc.Provider, nil
+	}
+	ttl := dc.TTL
+	if ttl <= 0 {
+		ttl = 60
+	}
+	switch dc.Type {
+	case DNSLinkRFC2136:
+		if dc.Server == "" || dc.Zone == "" {
+			return nil, fmt.Errorf("DNSLink provider '%s' requires a Server and Zone", dc.Name)
+		}
+		return &RFC2136Provider{Server: dc.Server, Zone: dc.Zone, TTL: ttl, TSIGKey: dc.TSIGKey, TSIGSecret: dc.TSIGSecret,
+			TSIGAlgorithm: dc.TSIGAlgorithm, Timeout: timeout}, nil
+	case DNSLinkZoneFile:
+		if dc.File == "" {
+			return nil, fmt.Errorf("DNSLink provider '%s' requires a File", dc.Name)
+		}
+		return &ZoneFileProvider{File: dc.File, TTL: ttl}, nil
+	}
+	return nil, fmt.Errorf("DNSLink provider '%s' has unknown type '%s'", dc.Name, dc.Type)
+}
+
+// dnslinkName returns the fully qualified name the DNSLink record of domain is at.
+func dnslinkName(domain string) string {
+	return "_dnslink." + strings.TrimSuffix(domain, ".") + "."
+}
+
+// ZoneFileProvider is a DNSLinkProvider which keeps TXT records in a zone file. It owns the whole file, so it should
+// be $INCLUDEd from the real zone file, and the DNS server reloaded when it changes.
+type ZoneFileProvider struct {
+	File string
+	TTL  int
+
+	lock sync.Mutex
+}
+
+// SetDNSLink replaces the record for domain in the zone file, keeping everything else.
+func (zp *ZoneFileProvider) SetDNSLink(domain, path string) error {
+	zp.lock.Lock()
+	defer zp.lock.Unlock()
+	name := dnslinkName(domain)
+	record := fmt.Sprintf("%s\t%d\tIN\tTXT\t\"dnslink=%s\"", name, zp.TTL, path)
+
+	var lines []string
+	if f, err := os.Open(zp.File); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if fields := strings.Fields(scanner.Text()); len(fields) > 0 && strings.EqualFold(fields[0], name) {
+				continue
+			}
+			lines = append(lines, scanner.Text())
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	lines = append(lines, record)
+
+	// write to a temporary file first, so the DNS server never sees half a file
+	tmp, err := ioutil.TempFile(filepath.Dir(zp.File), "."+filepath.Base(zp.File))
+	if err != nil {
+		return err
+	}
+	_, err = tmp.WriteString(strings.Join(lines, "\n") + "\n")
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), zp.File)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// updateDNSLink points the DNSLink records of dk at cid.
+func (s *Syncer) updateDNSLink(dk *DirKey, cid string) {
+	if len(dk.DNSLinkDomains) == 0 {
+		return
+	}
+	provider := s.dnslinks.Load().(map[string]DNSLinkProvider)[dk.DNSLinkProvider]
+	if provider == nil {
+		s.error(dk, fmt.Errorf("DNSLink provider '%s' isn't configured", dk.DNSLinkProvider))
+		return
+	}
+	for _, domain := range dk.DNSLinkDomains {
+		if err := provider.SetDNSLink(domain, "/ipfs/"+cid); err != nil {
+			s.error(dk, fmt.Errorf("error updating DNSLink of %s: %w", domain, err))
+		} else if s.opt().Verbose {
+			s.log.Println("Updated DNSLink of", domain, "to", cid)
+		}
+	}
+}
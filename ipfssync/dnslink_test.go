@@ -0,0 +1,180 @@
+package ipfssync
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// dnsRR is a resource record read by readRR.
+type dnsRR struct {
+	name   string
+	rrtype uint16
+	class  uint16
+	ttl    uint32
+	rdata  []byte
+}
+
+// readName reads an uncompressed name from msg at off, returning it and the offset after it.
+func readName(msg []byte, off int) (string, int) {
+	var labels []string
+	for msg[off] != 0 {
+		labels = append(labels, string(msg[off+1:off+1+int(msg[off])]))
+		off += 1 + int(msg[off])
+	}
+	return strings.Join(labels, ".") + ".", off + 1
+}
+
+// readRR reads a resource record from msg at off, returning it and the offset after it.
+func readRR(msg []byte, off int) (*dnsRR, int) {
+	rr := new(dnsRR)
+	rr.name, off = readName(msg, off)
+	rr.rrtype = binary.BigEndian.Uint16(msg[off:])
+	rr.class = binary.BigEndian.Uint16(msg[off+2:])
+	rr.ttl = binary.BigEndian.Uint32(msg[off+4:])
+	length := int(binary.BigEndian.Uint16(msg[off+8:]))
+	rr.rdata = msg[off+10 : off+10+length]
+	return rr, off + 10 + length
+}
+
+// fakeDNSServer answers every message on a local UDP port with rcode, sending what it received on msgs.
+func fakeDNSServer(t *testing.T, rcode byte) (string, chan []byte) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	msgs := make(chan []byte, 10)
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			msg := append([]byte(nil), buf[:n]...)
+			msgs <- msg
+			resp := append([]byte(nil), msg[:12]...)
+			resp[2] |= 0x80 // response
+			resp[3] = rcode
+			conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), msgs
+}
+
+func TestRFC2136Provider(t *testing.T) {
+	addr, msgs := fakeDNSServer(t, 0)
+	rp := &RFC2136Provider{Server: addr, Zone: "example.com", TTL: 60}
+	if err := rp.SetDNSLink("www.example.com", "/ipfs/bafytest"); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-msgs
+	if opcode := msg[2] >> 3 & 0xf; opcode != dnsOpUpdate {
+		t.Error("Unexpected opcode", opcode)
+	}
+	if zones, updates := binary.BigEndian.Uint16(msg[4:]), binary.BigEndian.Uint16(msg[8:]); zones != 1 || updates != 2 {
+		t.Fatal("Unexpected section counts", zones, updates)
+	}
+	zone, off := readName(msg, 12)
+	if zone != "example.com." {
+		t.Error("Unexpected zone", zone)
+	}
+	del, off := readRR(msg, off+4)
+	if del.name != "_dnslink.www.example.com." || del.rrtype != dnsTypeTXT || del.class != dnsClassANY || len(del.rdata) != 0 {
+		t.Errorf("Unexpected delete %+v", del)
+	}
+	add, off := readRR(msg, off)
+	if add.name != del.name || add.class != dnsClassIN || add.ttl != 60 || string(add.rdata[1:]) != "dnslink=/ipfs/bafytest" {
+		t.Errorf("Unexpected add %+v", add)
+	}
+	if off != len(msg) {
+		t.Error("Unexpected data after the updates")
+	}
+
+	// signed
+	rp.TSIGKey, rp.TSIGSecret = "ipfs-sync", "c2VjcmV0"
+	if err := rp.SetDNSLink("example.com", "/ipfs/bafytest"); err != nil {
+		t.Fatal(err)
+	}
+	msg = <-msgs
+	if binary.BigEndian.Uint16(msg[10:]) != 1 {
+		t.Fatal("TSIG record missing")
+	}
+	_, off = readName(msg, 12)
+	_, off = readRR(msg, off+4)
+	_, off = readRR(msg, off)
+	tsig, _ := readRR(msg, off)
+	algorithm, roff := readName(tsig.rdata, 0)
+	if tsig.name != "ipfs-sync." || tsig.rrtype != dnsTypeTSIG || algorithm != "hmac-sha256." {
+		t.Errorf("Unexpected TSIG %+v", tsig)
+	}
+	if macSize := binary.BigEndian.Uint16(tsig.rdata[roff+8:]); macSize != 32 {
+		t.Error("Unexpected MAC size", macSize)
+	}
+	rp.TSIGAlgorithm = "hmac-md5"
+	if err := rp.SetDNSLink("example.com", "/ipfs/bafytest"); err == nil {
+		t.Error("Unsupported TSIG algorithm was accepted")
+	}
+
+	addr, _ = fakeDNSServer(t, 5)
+	rp = &RFC2136Provider{Server: addr, Zone: "example.com", TTL: 60}
+	if err := rp.SetDNSLink("example.com", "/ipfs/bafytest"); err == nil || !strings.Contains(err.Error(), "REFUSED") {
+		t.Error("Expected REFUSED, got", err)
+	}
+}
+
+func TestZoneFileProvider(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dnslink.zone")
+	if err := ioutil.WriteFile(file, []byte("; managed by ipfs-sync\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	zp := &ZoneFileProvider{File: file, TTL: 60}
+	for _, set := range [][2]string{
+		{"example.com", "/ipfs/bafyfirst"},
+		{"example.org.", "/ipfs/bafyother"},
+		{"example.com", "/ipfs/bafysecond"},
+	} {
+		if err := zp.SetDNSLink(set[0], set[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "; managed by ipfs-sync\n" +
+		"_dnslink.example.org.\t60\tIN\tTXT\t\"dnslink=/ipfs/bafyother\"\n" +
+		"_dnslink.example.com.\t60\tIN\tTXT\t\"dnslink=/ipfs/bafysecond\"\n"
+	if string(data) != want {
+		t.Errorf("Zone file contains:\n%s\nexpected:\n%s", data, want)
+	}
+}
+
+func TestPublishDNSLink(t *testing.T) {
+	fk := newFakeKubo()
+	defer fk.Close()
+	file := filepath.Join(t.TempDir(), "dnslink.zone")
+	dk := testDirKey(t, "dnslink", map[string]string{"index.html": "hi"})
+	dk.DNSLinkProvider = "zone"
+	dk.DNSLinkDomains = []string{"example.com"}
+	s := testSyncer(t, fk, &Options{
+		Dirs:             []*DirKey{dk},
+		DNSLinkProviders: []*DNSLinkConfig{{Name: "zone", Type: DNSLinkZoneFile, File: file}},
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cid := fk.Resolve(dk.ID); !strings.Contains(string(data), "dnslink=/ipfs/"+cid) {
+		t.Errorf("DNSLink wasn't pointed at %s:\n%s", cid, data)
+	}
+}
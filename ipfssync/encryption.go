@@ -0,0 +1,423 @@
+package ipfssync
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// encMagic starts every file encrypted by ipfs-sync.
+	encMagic = "ipfssync-enc-v1\n"
+	// encChunkSize is how much of a file is sealed at once, each chunk is followed by its tag.
+	encChunkSize = 64 * 1024
+	// kdfIterations is how many PBKDF2-HMAC-SHA256 iterations keys are derived with.
+	kdfIterations = 200000
+	// EncryptionHeader is the file at the root of every encrypted dir holding the parameters its key is derived with.
+	// It's not encrypted, and as encrypted names never contain a ".", it can't clash with a file from the dir.
+	EncryptionHeader = "ipfs-sync-encryption.json"
+)
+
+// encryptionHeader is the contents of an EncryptionHeader.
+type encryptionHeader struct {
+	Version    int
+	KDF        string
+	Iterations int
+	Salt       []byte // random for every dir, so a passphrase has to be attacked one dir at a time
+}
+
+// ErrDecrypt is returned when something can't be decrypted, because it was encrypted with a different key, or it's
+// been tampered with or truncated.
+var ErrDecrypt = errors.New("decryption failed, wrong key or corrupted data")
+
+// Encryption configures client-side encryption for a dir. Exactly one of Passphrase and KeyFile must be set.
+type Encryption struct {
+	Passphrase string `yaml:"Passphrase"`
+	KeyFile    string `yaml:"KeyFile"` // path to a file containing the key, like 32 random bytes
+}
+
+// sameEncryption returns true if a and b encrypt the same way.
+func sameEncryption(a, b *Encryption) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// secret returns the passphrase or the contents of the key file.
+func (e *Encryption) secret() ([]byte, error) {
+	switch {
+	case e.Passphrase != "" && e.KeyFile != "":
+		return nil, errors.New("only one of Passphrase and KeyFile can be set")
+	case e.Passphrase != "":
+		return []byte(e.Passphrase), nil
+	case e.KeyFile != "":
+		secret, err := ioutil.ReadFile(e.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading key file: %w", err)
+		}
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("key file %s is empty", e.KeyFile)
+		}
+		return secret, nil
+	}
+	return nil, errors.New("either Passphrase or KeyFile must be set")
+}
+
+// Cipher returns the Cipher for e, deriving its keys from the passphrase or key file with salt.
+func (e *Encryption) Cipher(salt []byte) (*Cipher, error) {
+	secret, err := e.secret()
+	if err != nil {
+		return nil, err
+	}
+	return NewCipher(secret, salt), nil
+}
+
+// Cipher encrypts file contents with AES-256-GCM, in chunks so files can be streamed, and file names
+// deterministically, so the same file always ends up at the same path in the MFS.
+type Cipher struct {
+	contentKey []byte
+	nameKey    []byte
+	names      cipher.AEAD
+}
+
+// NewCipher returns a Cipher with keys derived from secret, a passphrase or the contents of a key file, and salt.
+func NewCipher(secret, salt []byte) *Cipher {
+	return newCipher(secret, salt, kdfIterations)
+}
+
+// newCipher is NewCipher, with the given amount of PBKDF2 iterations.
+func newCipher(secret, salt []byte, iterations int) *Cipher {
+	master := pbkdf2.Key(secret, salt, iterations, 32, sha256.New)
+	c := &Cipher{contentKey: hmacSum(master, []byte("content")), nameKey: hmacSum(master, []byte("names"))}
+	c.names = newGCM(hmacSum(master, []byte("name encryption")))
+	return c
+}
+
+// hmacSum returns the HMAC-SHA256 of data.
+func hmacSum(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// newGCM returns AES-256-GCM with key, which must be 32 bytes.
+func newGCM(key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err) // only happens with a bad key size
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+// chunkNonce returns the nonce of the chunk at index, the last byte marks the final chunk so truncation is detected.
+func chunkNonce(index uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, index)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// Encrypt writes r to w encrypted, returning the amount of plaintext read. Every file gets a random salt, which its
+// key is derived from.
+func (c *Cipher) Encrypt(w io.Writer, r io.Reader) (int64, error) {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(append([]byte(encMagic), salt...)); err != nil {
+		return 0, err
+	}
+	aead := newGCM(hmacSum(c.contentKey, salt))
+	br := bufio.NewReader(r)
+	buf := make([]byte, encChunkSize, encChunkSize+aead.Overhead())
+	var total int64
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(br, buf)
+		total += int64(n)
+		final := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err == nil {
+			_, err = br.Peek(1)
+			if final = err == io.EOF; final {
+				err = nil
+			}
+		}
+		if err != nil && !final {
+			return total, err
+		}
+		if _, err := w.Write(aead.Seal(buf[:0], chunkNonce(index, final), buf[:n], nil)); err != nil {
+			return total, err
+		}
+		if final {
+			return total, nil
+		}
+	}
+}
+
+// Decrypt writes r, which was encrypted by Encrypt, to w. ErrDecrypt is returned if it can't be authenticated, though
+// anything before the bad chunk will have been written already.
+func (c *Cipher) Decrypt(w io.Writer, r io.Reader) error {
+	header := make([]byte, len(encMagic)+32)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(encMagic)]) != encMagic {
+		return ErrDecrypt
+	}
+	aead := newGCM(hmacSum(c.contentKey, header[len(encMagic):]))
+	br := bufio.NewReader(r)
+	buf := make([]byte, encChunkSize+aead.Overhead())
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(br, buf)
+		final := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err == nil {
+			_, err = br.Peek(1)
+			if final = err == io.EOF; final {
+				err = nil
+			}
+		}
+		if err != nil && !final {
+			return err
+		}
+		plain, err := aead.Open(buf[:0], chunkNonce(index, final), buf[:n], nil)
+		if err != nil {
+			return ErrDecrypt
+		}
+		if _, err := w.Write(plain); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+// EncryptName encrypts a single file or directory name. The nonce is derived from the name, so the result is always
+// the same, and it only contains characters which are safe in paths.
+func (c *Cipher) EncryptName(name string) string {
+	nonce := hmacSum(c.nameKey, []byte(name))[:c.names.NonceSize()]
+	return base64.RawURLEncoding.EncodeToString(c.names.Seal(nonce, nonce, []byte(name), nil))
+}
+
+// DecryptName decrypts a name encrypted by EncryptName.
+func (c *Cipher) DecryptName(name string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(name)
+	if err != nil || len(data) < c.names.NonceSize() {
+		return "", ErrDecrypt
+	}
+	nonce := data[:c.names.NonceSize()]
+	plain, err := c.names.Open(nil, nonce, data[len(nonce):], nil)
+	if err != nil || !hmac.Equal(nonce, hmacSum(c.nameKey, plain)[:len(nonce)]) {
+		return "", ErrDecrypt
+	}
+	return string(plain), nil
+}
+
+// Fingerprint identifies the key of c, without revealing anything about it.
+func (c *Cipher) Fingerprint() string {
+	return hex.EncodeToString(hmacSum(c.nameKey, []byte("fingerprint"))[:8])
+}
+
+// fingerprintKey returns the DB key the Fingerprint of the dir with the given ID is stored under.
+func fingerprintKey(id string) []byte {
+	return []byte("encryption/" + id)
+}
+
+// readHeader returns the EncryptionHeader in the directory cid, or nil if it doesn't have one.
+func (s *Syncer) readHeader(cid string) (*encryptionHeader, error) {
+	links, err := s.Ls(s.Context(), "/ipfs/"+cid)
+	if err != nil {
+		return nil, fmt.Errorf("error listing %s: %w", cid, err)
+	}
+	for _, link := range links {
+		if link.Name != EncryptionHeader {
+			continue
+		}
+		var data bytes.Buffer
+		if err := s.Cat(s.Context(), "/ipfs/"+link.Hash, &data); err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", EncryptionHeader, err)
+		}
+		header := new(encryptionHeader)
+		if err := json.Unmarshal(data.Bytes(), header); err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", EncryptionHeader, err)
+		}
+		if header.Version != 1 || header.KDF != "PBKDF2-HMAC-SHA256" || len(header.Salt) < 16 ||
+			header.Iterations < 10000 || header.Iterations > 10000000 {
+			return nil, fmt.Errorf("unsupported %s", EncryptionHeader)
+		}
+		return header, nil
+	}
+	return nil, nil
+}
+
+// prepareEncryption derives the Cipher of dk, with the salt from the EncryptionHeader of its MFS copy, or a new one if
+// it doesn't have one yet. If the salt is new, the fingerprint of the key changes, so checkEncryption starts the MFS
+// copy over.
+func (s *Syncer) prepareEncryption(dk *DirKey) error {
+	if dk.Encrypt == nil {
+		dk.crypt = nil
+		return nil
+	}
+	var header *encryptionHeader
+	if cid := s.GetFileCID(s.Context(), dk.workPath()); cid != "" {
+		var err error
+		if header, err = s.readHeader(cid); err != nil {
+			return err
+		}
+	}
+	if header == nil {
+		header = &encryptionHeader{Version: 1, KDF: "PBKDF2-HMAC-SHA256", Iterations: kdfIterations, Salt: make([]byte, 32)}
+		if _, err := rand.Read(header.Salt); err != nil {
+			return err
+		}
+	}
+	secret, err := dk.Encrypt.secret()
+	if err != nil {
+		return err
+	}
+	dk.crypt = newCipher(secret, header.Salt, header.Iterations)
+	dk.header = header
+	return nil
+}
+
+// writeHeader adds the EncryptionHeader of dk to its MFS copy, if it isn't there already.
+func (s *Syncer) writeHeader(dk *DirKey) error {
+	path := dk.workPath() + "/" + EncryptionHeader
+	if dk.header == nil || s.GetFileCID(s.Context(), path) != "" {
+		return nil
+	}
+	data, _ := json.Marshal(dk.header)
+	ctx, cancel := s.reqContext(s.Context(), s.opt().Timeout)
+	defer cancel()
+	hash, err := s.client.Add(ctx, &AddRequest{Data: bytes.NewReader(data), Name: EncryptionHeader})
+	if err != nil {
+		return err
+	}
+	if err := s.MakeDir(s.Context(), dk.workPath()); err != nil {
+		return err
+	}
+	return s.CopyCID(s.Context(), hash.Hash, path)
+}
+
+// checkEncryption starts the MFS copy of dk over if it's been encrypted differently (or not at all) since it was last
+// synced, so everything is added again.
+func (s *Syncer) checkEncryption(dk *DirKey) {
+	var fingerprint string
+	if dk.crypt != nil {
+		fingerprint = dk.crypt.Fingerprint()
+	}
+	old, _ := s.DB.Get(fingerprintKey(dk.ID), nil)
+	if string(old) == fingerprint {
+		return
+	}
+	s.log.Println("Encryption of", dk.ID, "changed, adding everything again ...")
+	s.RemoveFile(s.Context(), dk.workPath())
+	s.HashLock.Lock()
+	s.deleteHash(nil, dk.Dir)
+	s.HashLock.Unlock()
+	if fingerprint == "" {
+		s.DB.Delete(fingerprintKey(dk.ID), nil)
+	} else {
+		s.DB.Put(fingerprintKey(dk.ID), []byte(fingerprint), nil)
+	}
+}
+
+// DecryptTree writes the plaintext of cid, the root of a dir encrypted with enc, to target.
+func (s *Syncer) DecryptTree(cid, target string, enc *Encryption) error {
+	header, err := s.readHeader(cid)
+	if err != nil {
+		return err
+	}
+	if header == nil {
+		return fmt.Errorf("%s has no %s, it wasn't encrypted by ipfs-sync", cid, EncryptionHeader)
+	}
+	secret, err := enc.secret()
+	if err != nil {
+		return err
+	}
+	return s.decryptTree(cid, target, newCipher(secret, header.Salt, header.Iterations), true)
+}
+
+// decryptTree writes the plaintext of cid, a directory encrypted with c, to target. root is true for the root of the
+// dir, which holds the EncryptionHeader.
+func (s *Syncer) decryptTree(cid, target string, c *Cipher, root bool) error {
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	links, err := s.Ls(s.Context(), "/ipfs/"+cid)
+	if err != nil {
+		return fmt.Errorf("error listing %s: %w", cid, err)
+	}
+	for _, link := range links {
+		if root && link.Name == EncryptionHeader {
+			continue
+		}
+		name, err := c.DecryptName(link.Name)
+		if err == nil && (name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/"+string(os.PathSeparator))) {
+			err = errors.New("invalid file name")
+		}
+		if err != nil {
+			return fmt.Errorf("error decrypting name '%s' in %s: %w", link.Name, cid, err)
+		}
+		path := filepath.Join(target, name)
+		switch link.Type {
+		case UnixFSDir:
+			if err := s.decryptTree(link.Hash, path, c, false); err != nil {
+				return err
+			}
+		case UnixFSFile, UnixFSRaw:
+			s.log.Println("Decrypting", path, "...")
+			if err := s.decryptFile(link.Hash, path, c); err != nil {
+				return fmt.Errorf("error decrypting %s: %w", path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// decryptFile writes the plaintext of the file cid to path, replacing it in one go once it's been authenticated.
+func (s *Syncer) decryptFile(cid, path string, c *Cipher) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), tempPrefix)
+	if err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(s.Cat(s.Context(), "/ipfs/"+cid, pw))
+	}()
+	err = c.Decrypt(tmp, pr)
+	pr.Close()
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
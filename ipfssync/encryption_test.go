@@ -0,0 +1,141 @@
+package ipfssync
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCipher(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	c := NewCipher([]byte("correct horse battery staple"), salt)
+	for _, size := range []int{0, 1, encChunkSize - 1, encChunkSize, encChunkSize + 1, encChunkSize*3 + 5} {
+		plain := bytes.Repeat([]byte{'x'}, size)
+		var enc, dec bytes.Buffer
+		if n, err := c.Encrypt(&enc, bytes.NewReader(plain)); err != nil || n != int64(size) {
+			t.Fatalf("Encrypting %d bytes returned %d, %v", size, n, err)
+		}
+		if bytes.Contains(enc.Bytes(), []byte("xxxx")) {
+			t.Errorf("Encrypting %d bytes left plaintext in the output", size)
+		}
+		if err := c.Decrypt(&dec, bytes.NewReader(enc.Bytes())); err != nil || !bytes.Equal(dec.Bytes(), plain) {
+			t.Errorf("Decrypting %d bytes returned %d bytes, %v", size, dec.Len(), err)
+		}
+		// dropping the last chunk must be noticed, even if it ends on a chunk boundary
+		if size > encChunkSize {
+			truncated := enc.Bytes()[:len(encMagic)+32+encChunkSize+16]
+			if err := c.Decrypt(ioutil.Discard, bytes.NewReader(truncated)); !errors.Is(err, ErrDecrypt) {
+				t.Errorf("Decrypting %d truncated bytes returned %v", size, err)
+			}
+		}
+		tampered := append([]byte(nil), enc.Bytes()...)
+		tampered[len(tampered)-1] ^= 1
+		if err := c.Decrypt(ioutil.Discard, bytes.NewReader(tampered)); !errors.Is(err, ErrDecrypt) {
+			t.Errorf("Decrypting %d tampered bytes returned %v", size, err)
+		}
+	}
+
+	name := c.EncryptName("tax return.pdf")
+	if name != c.EncryptName("tax return.pdf") || strings.Contains(name, "tax") || strings.ContainsAny(name, "/.") {
+		t.Errorf("Unexpected encrypted name '%s'", name)
+	}
+	if got, err := c.DecryptName(name); err != nil || got != "tax return.pdf" {
+		t.Errorf("Decrypted name is '%s', %v", got, err)
+	}
+	if _, err := NewCipher([]byte("wrong"), salt).DecryptName(name); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("Decrypting a name with the wrong key returned %v", err)
+	}
+	if NewCipher([]byte("correct horse battery staple"), []byte("fedcba9876543210")).EncryptName("tax return.pdf") == name {
+		t.Error("Name encrypted the same way with a different salt")
+	}
+}
+
+func TestEncryptedDir(t *testing.T) {
+	fk := newFakeKubo()
+	defer fk.Close()
+	files := map[string]string{"secret.txt": "hunter2", "sub/notes.md": "private notes"}
+	dk := testDirKey(t, "encrypted", files)
+	dk.Encrypt = &Encryption{Passphrase: "correct horse battery staple"}
+	other := testDirKey(t, "encrypted2", map[string]string{"secret.txt": "hunter3"})
+	other.Encrypt = &Encryption{Passphrase: "correct horse battery staple"}
+	for _, dk := range []*DirKey{dk, other} {
+		if err := dk.Prepare(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db := filepath.Join(t.TempDir(), "db")
+	s := testSyncer(t, fk, &Options{DB: db, Dirs: []*DirKey{dk, other}})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	stopped := false
+	defer func() {
+		if !stopped {
+			s.Stop()
+		}
+	}()
+
+	// every dir gets its own salt, kept in its header
+	if _, ok := fk.Cat(s.basePath + dk.MFSPath + "/" + EncryptionHeader); !ok {
+		t.Errorf("%s wasn't added", EncryptionHeader)
+	}
+	if dk.crypt.EncryptName("secret.txt") == other.crypt.EncryptName("secret.txt") {
+		t.Error("Two dirs with the same passphrase encrypted a name the same way")
+	}
+
+	if _, ok := fk.Cat(s.basePath + dk.MFSPath + "/secret.txt"); ok {
+		t.Error("File name wasn't encrypted")
+	}
+	mfsPath := s.basePath + dk.MFSPath + "/" + dk.crypt.EncryptName("secret.txt")
+	if data, ok := fk.Cat(mfsPath); !ok || strings.Contains(data, "hunter2") {
+		t.Errorf("Expected encrypted contents at %s, found '%s'", mfsPath, data)
+	}
+
+	// a change is encrypted too
+	writeFiles(t, dk.Dir, map[string]string{"sub/notes.md": "more private notes"})
+	notesPath := s.basePath + dk.MFSPath + "/" + dk.crypt.EncryptName("sub") + "/" + dk.crypt.EncryptName("notes.md")
+	oldNotes, _ := fk.Cat(notesPath)
+	waitFor(t, "change to be added", func() bool {
+		data, ok := fk.Cat(notesPath)
+		return ok && data != oldNotes
+	})
+	if !s.PublishDir(dk, false) {
+		t.Fatal("Dir wasn't published")
+	}
+
+	target := t.TempDir()
+	if err := s.DecryptTree(fk.Resolve(dk.ID), target, &Encryption{Passphrase: "correct horse battery staple"}); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"secret.txt": "hunter2", "sub/notes.md": "more private notes"} {
+		data, err := ioutil.ReadFile(filepath.Join(target, filepath.FromSlash(name)))
+		if err != nil || string(data) != want {
+			t.Errorf("%s contains '%s', expected '%s' (%v)", name, data, want, err)
+		}
+	}
+	if err := s.DecryptTree(fk.Resolve(dk.ID), t.TempDir(), &Encryption{Passphrase: "wrong"}); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("Decrypting with the wrong key returned %v", err)
+	}
+	if _, err := ioutil.ReadFile(filepath.Join(target, EncryptionHeader)); err == nil {
+		t.Errorf("%s was decrypted", EncryptionHeader)
+	}
+
+	// the salt is read back when restarting, so nothing's added again
+	name := dk.crypt.EncryptName("secret.txt")
+	s.Stop()
+	stopped = true
+	s = testSyncer(t, fk, &Options{DB: db, Dirs: []*DirKey{dk}})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	if got := dk.crypt.EncryptName("secret.txt"); got != name {
+		t.Errorf("Name encrypted as '%s' after restarting, expected '%s'", got, name)
+	}
+	if _, ok := fk.Cat(s.basePath + dk.MFSPath + "/" + name); !ok {
+		t.Error("File was removed after restarting")
+	}
+}
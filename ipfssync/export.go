@@ -0,0 +1,150 @@
+package ipfssync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// exportTimeFormat is the format of the timestamp in the name of exported CAR files, it sorts oldest first.
+const exportTimeFormat = "2006-01-02T150405.000Z"
+
+// ExportPolicy writes a CAR file of every root a dir is published as, as offline backups which can be restored on any
+// node with `ipfs dag import`.
+type ExportPolicy struct {
+	Dir  string `yaml:"Dir"`  // local directory CAR files are written to, as <ID>_<timestamp>_<CID>.car
+	Keep int    `yaml:"Keep"` // how many CAR files of the dir to keep, 0 to keep them all
+}
+
+// ExportCAR writes the DAG under cid to a CAR file at path, replacing it in one go once it's complete.
+func (s *Syncer) ExportCAR(cid, path string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), tempPrefix)
+	if err != nil {
+		return err
+	}
+	err = s.DagExport(s.Context(), cid, tmp)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// pendingExport is a root of a dir waiting to be exported.
+type pendingExport struct {
+	cid    string
+	at     time.Time     // when it was published
+	policy *ExportPolicy // dk.Export when it was published
+}
+
+// exportRoot exports cid, the new root of dk, in the background if dk has an export policy. Roots are exported one at
+// a time per dir, in the order they were published.
+func (s *Syncer) exportRoot(dk *DirKey, cid string) {
+	if dk.Export == nil {
+		return
+	}
+	dk.lock.Lock()
+	defer dk.lock.Unlock()
+	dk.exports = append(dk.exports, &pendingExport{cid: cid, at: time.Now(), policy: dk.Export})
+	if !dk.exporting {
+		dk.exporting = true
+		go s.runExports(dk)
+	}
+}
+
+// runExports exports every root waiting to be exported for dk, until there are none left.
+func (s *Syncer) runExports(dk *DirKey) {
+	for {
+		dk.lock.Lock()
+		if len(dk.exports) == 0 {
+			dk.exporting = false
+			dk.lock.Unlock()
+			return
+		}
+		pe := dk.exports[0]
+		dk.exports = dk.exports[1:]
+		dk.lock.Unlock()
+		s.export(dk, pe)
+	}
+}
+
+// export writes a CAR file of the root pe of dk, then removes the oldest CAR files of dk beyond what it keeps.
+func (s *Syncer) export(dk *DirKey, pe *pendingExport) {
+	if err := os.MkdirAll(pe.policy.Dir, 0755); err != nil {
+		s.error(dk, fmt.Errorf("error creating export dir: %w", err))
+		return
+	}
+	name := fmt.Sprintf("%s_%s_%s.car", dk.ID, pe.at.UTC().Format(exportTimeFormat), pe.cid)
+	s.log.Println("Exporting", pe.cid, "to", name, "...")
+	if err := s.ExportCAR(pe.cid, filepath.Join(pe.policy.Dir, name)); errors.Is(err, context.Canceled) {
+		return // stopped
+	} else if err != nil {
+		s.error(dk, fmt.Errorf("error exporting %s: %w", pe.cid, err))
+		return
+	}
+	if pe.policy.Keep <= 0 {
+		return
+	}
+	exports, err := listExports(dk.ID, pe.policy.Dir)
+	if err != nil {
+		s.error(dk, fmt.Errorf("error listing exports: %w", err))
+		return
+	}
+	for len(exports) > pe.policy.Keep {
+		if s.opt().Verbose {
+			s.log.Println("Removing old export", exports[0], "...")
+		}
+		if err := os.Remove(exports[0]); err != nil {
+			s.error(dk, fmt.Errorf("error removing old export: %w", err))
+		}
+		exports = exports[1:]
+	}
+}
+
+// Exports returns the paths of the CAR files exported for dk, oldest first.
+func (s *Syncer) Exports(dk *DirKey) ([]string, error) {
+	if dk.Export == nil {
+		return nil, nil
+	}
+	return listExports(dk.ID, dk.Export.Dir)
+}
+
+// listExports returns the paths of the CAR files exported for the dir id to dir, oldest first.
+func listExports(id, dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var exports []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, id+"_") || !strings.HasSuffix(name, ".car") {
+			continue
+		}
+		// the ID of another dir could start with this one's
+		stamp := strings.SplitN(name[len(id)+1:], "_", 2)[0]
+		if _, err := time.Parse(exportTimeFormat, stamp); err != nil {
+			continue
+		}
+		exports = append(exports, name)
+	}
+	sort.Strings(exports)
+	for i, name := range exports {
+		exports[i] = filepath.Join(dir, name)
+	}
+	return exports, nil
+}
@@ -0,0 +1,212 @@
+package ipfssync
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// tempPrefix starts the name of every file being downloaded, they're always ignored.
+const tempPrefix = ".ipfs-sync-"
+
+// followedFile is what's remembered about a file downloaded by FollowDir, so it's only downloaded again if it changes.
+type followedFile struct {
+	CID   string
+	Stamp []byte // size and modification time after downloading, see GetHashValue
+}
+
+// followKey returns the DB key the followedFile at path is stored under.
+func followKey(path string) []byte {
+	return []byte("follow/" + path)
+}
+
+// followed returns what's remembered about the file at path, or nil if it wasn't downloaded by FollowDir.
+func (s *Syncer) followed(dk *DirKey, path string) *followedFile {
+	if s.DB == nil {
+		return dk.followed[path]
+	}
+	data, err := s.DB.Get(followKey(path), nil)
+	if err != nil {
+		return nil
+	}
+	ff := new(followedFile)
+	if json.Unmarshal(data, ff) != nil {
+		return nil
+	}
+	return ff
+}
+
+// setFollowed remembers ff for the file at path, or forgets it if ff is nil.
+func (s *Syncer) setFollowed(dk *DirKey, path string, ff *followedFile) {
+	if s.DB == nil {
+		if dk.followed == nil {
+			dk.followed = make(map[string]*followedFile)
+		}
+		if ff == nil {
+			delete(dk.followed, path)
+		} else {
+			dk.followed[path] = ff
+		}
+		return
+	}
+	if ff == nil {
+		s.DB.Delete(followKey(path), nil)
+		return
+	}
+	jsonData, _ := json.Marshal(ff)
+	s.DB.Put(followKey(path), jsonData, nil)
+}
+
+// walkRemote recursively lists the directory at path, adding every file which isn't ignored to files (by its path
+// on disk, under dir) and every directory to dirs.
+func (s *Syncer) walkRemote(dk *DirKey, path, dir string, files map[string]string, dirs map[string]bool) error {
+	links, err := s.Ls(s.Context(), path)
+	if err != nil {
+		return fmt.Errorf("error listing %s: %w", path, err)
+	}
+	for _, link := range links {
+		if link.Name == "" || link.Name == "." || link.Name == ".." || strings.ContainsAny(link.Name, "/"+string(os.PathSeparator)) {
+			s.error(dk, fmt.Errorf("skipping '%s' in %s, it isn't a valid file name", link.Name, path))
+			continue
+		}
+		diskPath := dir + link.Name
+		switch link.Type {
+		case UnixFSDir:
+			if s.Ignored(dk, diskPath, true) {
+				continue
+			}
+			dirs[diskPath] = true
+			if err := s.walkRemote(dk, "/ipfs/"+link.Hash, diskPath+string(os.PathSeparator), files, dirs); err != nil {
+				return err
+			}
+		case UnixFSFile, UnixFSRaw:
+			if !s.Ignored(dk, diskPath, false) {
+				files[diskPath] = link.Hash
+			}
+		}
+	}
+	return nil
+}
+
+// download writes the file cid to path, replacing it in one go once it's finished.
+func (s *Syncer) download(cid, path string) error {
+	return s.fetch(cid, path, false)
+}
+
+// fetch is download, only replacing path if the file downloaded adds as cid when verify is true.
+func (s *Syncer) fetch(cid, path string, verify bool) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), tempPrefix)
+	if err != nil {
+		return err
+	}
+	err = s.Cat(s.Context(), "/ipfs/"+cid, tmp)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && verify {
+		err = s.verifyFile(tmp.Name(), cid)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// FollowDir brings dk.Dir up to date with what dk.Follow resolves to, if it's changed since it was last followed or
+// force is true. New and changed files are downloaded, and anything that's no longer there is deleted, apart from
+// ignored files. Files changed locally since they were downloaded are downloaded again.
+func (s *Syncer) FollowDir(dk *DirKey, force bool) error {
+	dk.workLock.Lock()
+	defer dk.workLock.Unlock()
+
+	cid, err := s.ResolveIPNS(s.Context(), strings.TrimPrefix(dk.Follow, "/ipns/"))
+	if err != nil {
+		return fmt.Errorf("error resolving %s: %w", dk.Follow, err)
+	}
+	if cid == dk.GetCID() && !force {
+		return nil
+	}
+	if s.opt().Verbose {
+		s.log.Println("Following", dk.Follow, "to", cid, "...")
+	}
+	if err := os.MkdirAll(dk.Dir, 0755); err != nil {
+		return err
+	}
+	files := make(map[string]string)
+	dirs := make(map[string]bool)
+	if err := s.walkRemote(dk, "/ipfs/"+cid, dk.Dir, files, dirs); err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var failed bool
+	for _, path := range paths {
+		if ff := s.followed(dk, path); ff != nil && ff.CID == files[path] && string(ff.Stamp) == string(GetHashValue(path, true)) {
+			continue
+		}
+		s.log.Println("Downloading", path, "...")
+		if err := s.download(files[path], path); err != nil {
+			s.error(dk, fmt.Errorf("error downloading %s: %w", path, err))
+			failed = true
+			continue
+		}
+		s.setFollowed(dk, path, &followedFile{CID: files[path], Stamp: GetHashValue(path, true)})
+	}
+
+	local, err := s.filePathWalkDir(dk)
+	if err != nil {
+		return err
+	}
+	emptied := make(map[string]bool)
+	for _, path := range local {
+		// only files which were downloaded and have since been removed remotely are deleted, anything else is local
+		if _, ok := files[path]; ok || s.followed(dk, path) == nil {
+			continue
+		}
+		s.log.Println("Deleting", path, "...")
+		if err := os.Remove(path); err != nil {
+			s.error(dk, err)
+			continue
+		}
+		s.setFollowed(dk, path, nil)
+		emptied[filepath.Dir(path)] = true
+	}
+	// remove directories that are gone too if deleting files left them empty, deepest first
+	gone := make([]string, 0, len(emptied))
+	for dir := range emptied {
+		gone = append(gone, dir)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(gone)))
+	root := filepath.Clean(dk.Dir)
+	for _, dir := range gone {
+		for ; dir != root && strings.HasPrefix(dir, root) && !dirs[dir]; dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil { // not empty
+				break
+			}
+		}
+	}
+
+	if failed { // try again next time
+		return nil
+	}
+	dk.SetCID(cid)
+	s.log.Println(dk.ID, "followed", dk.Follow, "to", cid)
+	return nil
+}
@@ -0,0 +1,360 @@
+package ipfssync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDir watches dk for changes, adding, moving and removing files in the MFS as needed. Send to the returned
+// channel to stop.
+func (s *Syncer) watchDir(dk *DirKey) chan bool {
+	dir, nocopy, dontHash := dk.Dir, dk.Nocopy, dk.DontHash
+
+	localDirs := make(map[string]bool)
+	watching := make(map[string]bool)
+	ids := make(map[string]fileID)
+	moves := make(chan *pendingMove)
+	queue := NewEventQueue()
+	dk.lock.Lock()
+	dk.queue = queue
+	dk.lock.Unlock()
+
+	// creates a new file watcher
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		s.error(dk, err)
+		return nil
+	}
+
+	watchThis := func(path string, fi fs.DirEntry, err error) error {
+		// remember what's on disk, so it can be recognized if it's moved
+		if fi != nil {
+			if info, err := fi.Info(); err == nil {
+				ids[path] = fileID{inode: getInode(info), isDir: fi.IsDir()}
+			}
+		}
+		// since fsnotify can watch all the files in a directory, watchers only need to be added to each nested directory
+		// we must check for nil as a panic is possible if fi is for some reason nil
+		if fi != nil && fi.IsDir() {
+			if s.Ignored(dk, path, true) {
+				return fs.SkipDir
+			}
+			if watching[path] {
+				return nil
+			}
+			err := watcher.Add(path)
+			if err == nil {
+				watching[path] = true
+				dk.addWatched(1)
+			}
+			return err
+		}
+
+		return nil
+	}
+
+	toMFS := dk.mfsPath
+
+	// fileAdded updates the hash DB after a file has been added
+	fileAdded := func(job *AddJob, err error) {
+		if errors.Is(err, context.Canceled) { // stopped, so it's added next time
+			return
+		}
+		fname := job.From
+		s.HashLock.Lock()
+		if s.Hashes != nil {
+			if s.Hashes[fname] != nil {
+				s.Hashes[fname].Recalculate(fname, dontHash)
+			} else {
+				s.Hashes[fname] = new(FileHash).Recalculate(fname, dontHash)
+			}
+			s.updateHash(s.Hashes[fname])
+		}
+		s.HashLock.Unlock()
+	}
+
+	// addJobs returns the jobs to add every path in ready, which must be sorted
+	addJobs := func(ready []*QueuedPath) []*AddJob {
+		jobs := make([]*AddJob, 0, len(ready))
+		for _, qp := range ready {
+			splitName := strings.Split(qp.Path, string(os.PathSeparator))
+			parentDir := strings.Join(splitName[:len(splitName)-1], string(os.PathSeparator))
+			makeDir := !localDirs[parentDir]
+			if makeDir {
+				localDirs[parentDir] = true
+			}
+			if fi, err := os.Stat(qp.Path); err == nil {
+				ids[qp.Path] = fileID{inode: getInode(fi), isDir: fi.IsDir()}
+			}
+			jobs = append(jobs, &AddJob{From: qp.Path, To: toMFS(qp.Path), MakeDir: makeDir, Overwrite: qp.Overwrite})
+		}
+		return jobs
+	}
+
+	// batches are added one at a time by their own goroutine, holding workLock like SyncDir does, so events keep being
+	// handled while files are added. Files which still match their recorded hash, like ones just restored, are skipped.
+	batches := make(chan []*AddJob)
+	batchDone := make(chan bool, 1)
+	adding := false
+	go func() {
+		for jobs := range batches {
+			dk.workLock.Lock()
+			changed := jobs[:0]
+			for _, job := range jobs {
+				if !s.unchanged(job.From, dontHash) {
+					changed = append(changed, job)
+				}
+			}
+			if len(changed) > 0 {
+				s.AddFiles(dk, changed, fileAdded)
+			}
+			dk.workLock.Unlock()
+			dk.endAdd()
+			batchDone <- true
+		}
+	}()
+
+	addDir := func(path string, fi fs.DirEntry, err error) error {
+		if fi != nil && fi.IsDir() {
+			if s.Ignored(dk, path, true) {
+				return fs.SkipDir
+			}
+			return nil
+		} else if !s.Ignored(dk, path, false) {
+			queue.Push(path, false)
+		}
+
+		return nil
+	}
+
+	// forget drops everything we know about fpath (and anything under it), removing it from the MFS unless it was moved.
+	forget := func(fpath string, removed bool) {
+		id := ids[fpath]
+		delete(ids, fpath)
+		dk.unquarantine(fpath)
+		delete(localDirs, fpath)
+		// remove watcher, just in case it's a directory
+		if watching[fpath] {
+			delete(watching, fpath)
+			watcher.Remove(fpath)
+			dk.addWatched(-1)
+		}
+		if id.isDir {
+			for path := range ids {
+				if strings.HasPrefix(path, fpath+string(os.PathSeparator)) {
+					delete(ids, path)
+					delete(localDirs, path)
+					if watching[path] {
+						delete(watching, path)
+						watcher.Remove(path)
+						dk.addWatched(-1)
+					}
+				}
+			}
+		}
+		if !removed {
+			return
+		}
+		queue.Take(fpath)
+		mfsPath := toMFS(fpath)
+		s.log.Println("Removing", mfsPath, "...")
+		err := s.RemoveFile(s.Context(), mfsPath)
+		if err != nil {
+			if !errors.Is(err, ErrNotFound) { // otherwise it's already gone, like after a merge
+				s.error(dk, err)
+			}
+		} else {
+			dk.addChanges(0, 1, 0)
+		}
+		s.HashLock.Lock()
+		if s.Hashes != nil {
+			s.deleteHash(s.Hashes[fpath], fpath)
+		}
+		s.HashLock.Unlock()
+	}
+
+	// moveTo completes a move started by another rename event, falling back to adding fpath if the MFS move fails. If
+	// the guard would hold back anything at fpath, it isn't moved, so it's removed from the MFS and quarantined instead.
+	moveTo := func(pm *pendingMove, fpath string) {
+		pm.claimed = true
+		if s.opt().Guard {
+			for path, reason := range s.guardMove(dk, fpath, pm.id.isDir) {
+				if dk.quarantine(path, reason) {
+					s.error(dk, &SensitiveFileError{Path: path, Reason: reason})
+				}
+				pm.claimed = false
+			}
+		}
+		if pm.claimed {
+			mfsPath := toMFS(fpath)
+			s.log.Println("Moving", pm.mfsPath, "to", mfsPath, "...")
+			mfsSplit := strings.Split(mfsPath, "/")
+			err := s.MakeDir(s.Context(), strings.Join(mfsSplit[:len(mfsSplit)-1], "/"))
+			if err == nil {
+				s.RemoveFile(s.Context(), mfsPath) // in case the move replaced something
+				err = s.MoveFile(s.Context(), pm.mfsPath, mfsPath)
+			}
+			if err != nil {
+				s.error(dk, fmt.Errorf("error moving %s: %w", pm.mfsPath, err))
+				pm.claimed = false
+			}
+		}
+		go func() { pm.owner <- pm }()
+		if !pm.claimed {
+			if pm.id.isDir {
+				filepath.WalkDir(fpath, addDir)
+			} else {
+				queue.Push(fpath, true)
+			}
+			return
+		}
+		dk.addChanges(0, 0, 1)
+		s.HashLock.Lock()
+		if s.Hashes != nil {
+			s.moveHashes(pm.diskPath, fpath)
+		}
+		s.HashLock.Unlock()
+		// anything which changed before the move still needs to be added
+		for _, path := range pm.queued {
+			queue.Push(fpath+path[len(pm.diskPath):], true)
+		}
+	}
+
+	// starting at the root of the project, walk each file/directory searching for directories
+	if err := filepath.WalkDir(dir, watchThis); err != nil {
+		s.error(dk, err)
+	}
+
+	done := make(chan bool, 1)
+
+	go func() {
+		defer watcher.Close()
+		ticker := time.NewTicker(time.Second / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			// watch for events
+			case event, ok := <-watcher.Events:
+				if !ok {
+					s.log.Println("NOT OK")
+					return
+				}
+				if s.opt().Verbose {
+					s.log.Println("fsnotify event:", event)
+				}
+				s.metrics.WatcherEvents.Inc(event.Op.String())
+				if len(event.Name) < len(dir) { // dir itself
+					continue
+				}
+				if filepath.Base(event.Name) == IgnoreFile {
+					// the rules changed, so watch anything no longer ignored, and sync whatever's now (un)ignored
+					dk.ForgetIgnoreFiles()
+					filepath.WalkDir(filepath.Dir(event.Name), watchThis)
+					go s.resyncDir(dk)
+				}
+				isDir := ids[event.Name].isDir
+				if fi, err := os.Stat(event.Name); err == nil {
+					isDir = fi.IsDir()
+				}
+				if s.Ignored(dk, event.Name, isDir) {
+					continue
+				}
+				switch event.Op {
+				case fsnotify.Create:
+					fi, err := os.Stat(event.Name)
+					if err != nil {
+						s.log.Println("WATCHER ERROR", err)
+					} else if pm := s.moves.claim(event.Name, fi, dontHash); pm != nil {
+						if pm.owner == moves {
+							// inotify shares a watch between both paths, so the old one must be removed first
+							forget(pm.diskPath, false)
+						}
+						if fi.IsDir() {
+							filepath.WalkDir(event.Name, watchThis)
+						} else {
+							ids[event.Name] = fileID{inode: getInode(fi)}
+						}
+						moveTo(pm, event.Name)
+					} else if !fi.Mode().IsDir() {
+						queue.Push(event.Name, true)
+					} else if err := filepath.WalkDir(event.Name, watchThis); err == nil {
+						filepath.WalkDir(event.Name, addDir)
+					} else {
+						s.error(dk, err)
+					}
+				case fsnotify.Write:
+					queue.Push(event.Name, true)
+				case fsnotify.Remove, fsnotify.Rename:
+					// check if file is *actually* gone
+					_, err := os.Stat(event.Name)
+					if err == nil {
+						continue
+					}
+					id, known := ids[event.Name]
+					if event.Op == fsnotify.Rename {
+						if !known { // already moved or removed
+							continue
+						}
+						// the filestore references files by their path on disk, so nocopy files must be re-added
+						if !nocopy {
+							pm := &pendingMove{diskPath: event.Name, mfsPath: toMFS(event.Name), id: id, owner: moves}
+							pm.queued = queue.Take(event.Name)
+							if !id.isDir {
+								s.HashLock.RLock()
+								if fh := s.Hashes[event.Name]; fh != nil {
+									hash := *fh
+									pm.hash = &hash
+								}
+								s.HashLock.RUnlock()
+							}
+							if s.moves.stash(pm) {
+								dk.addMoving(1)
+							}
+							continue
+						}
+					}
+					forget(event.Name, true)
+				}
+			case pm := <-moves:
+				forget(pm.diskPath, !pm.claimed)
+				dk.addMoving(-1)
+			case <-batchDone:
+				adding = false
+			case <-ticker.C:
+				if adding || dk.Paused() {
+					continue
+				}
+				if ready := queue.Ready(s.opt().Quiet, s.opt().Settle); len(ready) > 0 {
+					// counted as being added from now, so dk doesn't look settled before the batch starts
+					dk.beginAdd()
+					adding = true
+					batches <- addJobs(ready)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					s.log.Println("WATCHER NOT OK")
+					return
+				}
+				s.error(dk, err)
+			case <-done:
+				close(batches)
+				dk.lock.Lock()
+				dk.queue = nil
+				dk.watched = 0
+				dk.moving = 0
+				dk.lock.Unlock()
+				return
+			}
+		}
+	}()
+
+	return done
+}
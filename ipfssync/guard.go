@@ -0,0 +1,300 @@
+package ipfssync
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// DefaultSensitive is used when Options.Sensitive is nil.
+var DefaultSensitive = []string{".env", ".env.*", "id_rsa", "id_dsa", "id_ecdsa", "id_ed25519", "*.pem", "*.key", "*.p12",
+	"*.pfx", "*.kdbx", "*.tfstate", "credentials.json", "**/.aws/credentials", ".netrc", ".npmrc", ".pypirc", ".git-credentials"}
+
+// guardScanSize is how much of each file is scanned for secrets.
+const guardScanSize = 1 << 20
+
+// secretDetector finds a kind of secret in a file's contents.
+type secretDetector struct {
+	name    string
+	re      *regexp.Regexp
+	entropy float64 // minimum entropy (bits per character) of the first submatch, 0 to not check it
+}
+
+var secretDetectors = []*secretDetector{
+	{name: "private key", re: regexp.MustCompile(`-----BEGIN[A-Z ]*PRIVATE KEY( BLOCK)?-----`)},
+	{name: "AWS access key", re: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{name: "GitHub token", re: regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,}\b`)},
+	{name: "Slack token", re: regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9-]{10,}`)},
+	{name: "Google API key", re: regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`)},
+	{name: "Stripe key", re: regexp.MustCompile(`\b[rs]k_live_[0-9A-Za-z]{24,}\b`)},
+	{name: "high-entropy secret", entropy: 3.5,
+		re: regexp.MustCompile(`(?i)(?:secret|token|passw(?:or)?d|api[_-]?key|access[_-]?key|auth)[a-z_-]*["']?\s*[:=]\s*["']?([A-Za-z0-9+/=_.-]{20,})`)},
+}
+
+// SensitiveFileError is passed to OnError when a file is quarantined by the guard.
+type SensitiveFileError struct {
+	Path   string
+	Reason string
+}
+
+func (e *SensitiveFileError) Error() string {
+	return fmt.Sprintf("%s looks sensitive (%s), the dir won't be published until it's allowed or removed", e.Path, e.Reason)
+}
+
+// entropy returns the Shannon entropy of s, in bits per character.
+func entropy(s string) float64 {
+	counts := make(map[rune]int)
+	for _, r := range s {
+		counts[r]++
+	}
+	var e float64
+	for _, n := range counts {
+		p := float64(n) / float64(len(s))
+		e -= p * math.Log2(p)
+	}
+	return e
+}
+
+// scanSecrets returns the name of the first kind of secret found in data, or "" if there aren't any.
+func scanSecrets(data []byte) string {
+	for _, d := range secretDetectors {
+		for _, m := range d.re.FindAllSubmatch(data, -1) {
+			if d.entropy == 0 || (len(m) > 1 && entropy(string(m[1])) >= d.entropy) {
+				return d.name
+			}
+		}
+	}
+	return ""
+}
+
+// scanFile returns why the file at path, a path under dk.Dir, shouldn't be published, or "" if it looks fine.
+func (s *Syncer) scanFile(dk *DirKey, path string) string {
+	parts := strings.Split(filepath.ToSlash(path[len(dk.Dir):]), "/")
+	rules := s.sensitive.Load().([]*ignoreRule)
+	for i := range parts {
+		// the last rule to match wins
+		for j := len(rules) - 1; j >= 0; j-- {
+			if rules[j].match(parts[:i+1], i < len(parts)-1) {
+				if !rules[j].negate {
+					return "name matches " + strings.Join(rules[j].pattern, "/")
+				}
+				break
+			}
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "" // it'll fail to be added anyway
+	}
+	defer f.Close()
+	data, _ := ioutil.ReadAll(io.LimitReader(f, guardScanSize))
+	head := data
+	if len(head) > 8000 {
+		head = head[:8000]
+	}
+	if bytes.IndexByte(head, 0) != -1 {
+		return "" // binary
+	}
+	if secret := scanSecrets(data); secret != "" {
+		return "contains a " + secret
+	}
+	return ""
+}
+
+// allowedKey returns the DB key recording that the file at path was allowed, along with its hash when it was.
+func allowedKey(path string) []byte {
+	return []byte("allowed/" + path)
+}
+
+// allowed returns true if the file at path was allowed to be published, even though it looks sensitive. Only the
+// contents it was allowed with are, so if it's changed since, it's forgotten and has to be allowed again.
+func (s *Syncer) allowed(dk *DirKey, path string) bool {
+	var hash []byte
+	if s.DB == nil {
+		dk.lock.Lock()
+		hash = dk.allowed[path]
+		dk.lock.Unlock()
+	} else {
+		hash, _ = s.DB.Get(allowedKey(path), nil)
+	}
+	if hash == nil {
+		return false
+	}
+	if current := GetHashValue(path, false); current != nil && bytes.Equal(current, hash) {
+		return true
+	}
+	s.disallow(dk, path)
+	return false
+}
+
+// disallow forgets that the file at path was allowed.
+func (s *Syncer) disallow(dk *DirKey, path string) {
+	if s.DB == nil {
+		dk.lock.Lock()
+		delete(dk.allowed, path)
+		dk.lock.Unlock()
+		return
+	}
+	s.DB.Delete(allowedKey(path), nil)
+}
+
+// guardMove returns every file at or under path, which was just moved there, that the guard would hold back, with the
+// reason why.
+func (s *Syncer) guardMove(dk *DirKey, path string, isDir bool) map[string]string {
+	flagged := make(map[string]string)
+	check := func(path string) {
+		if s.allowed(dk, path) {
+			return
+		}
+		if reason := s.scanFile(dk, path); reason != "" {
+			flagged[path] = reason
+		}
+	}
+	if !isDir {
+		check(path)
+		return flagged
+	}
+	filepath.WalkDir(path, func(fpath string, d fs.DirEntry, err error) error {
+		switch {
+		case err != nil:
+		case d.IsDir():
+			if fpath != path && s.Ignored(dk, fpath, true) {
+				return fs.SkipDir
+			}
+		case !s.Ignored(dk, fpath, false):
+			check(fpath)
+		}
+		return nil
+	})
+	return flagged
+}
+
+// guardJobs returns the jobs which can be added, quarantining any files which look sensitive. Their hashes are
+// forgotten, so they're scanned again when dk is next synced.
+func (s *Syncer) guardJobs(dk *DirKey, jobs []*AddJob) []*AddJob {
+	safe := jobs[:0:0]
+	for _, job := range jobs {
+		reason := ""
+		if !s.allowed(dk, job.From) {
+			reason = s.scanFile(dk, job.From)
+		}
+		if reason == "" {
+			dk.unquarantine(job.From)
+			safe = append(safe, job)
+			continue
+		}
+		if dk.quarantine(job.From, reason) {
+			s.error(dk, &SensitiveFileError{Path: job.From, Reason: reason})
+		}
+		if job.MakeDir { // later jobs in the same directory expect it to exist
+			toSplit := strings.Split(job.To, "/")
+			s.MakeDir(s.Context(), strings.Join(toSplit[:len(toSplit)-1], "/"))
+		}
+		s.HashLock.Lock()
+		if s.DB != nil {
+			s.DB.Delete([]byte(job.From), nil)
+			s.DB.Delete([]byte("ts_"+job.From), nil)
+		}
+		delete(s.Hashes, job.From)
+		s.HashLock.Unlock()
+	}
+	return safe
+}
+
+// quarantine holds back the file at path for reason, returning true if it wasn't already held back for it.
+func (dk *DirKey) quarantine(path, reason string) bool {
+	dk.lock.Lock()
+	defer dk.lock.Unlock()
+	if dk.quarantined == nil {
+		dk.quarantined = make(map[string]string)
+	}
+	if dk.quarantined[path] == reason {
+		return false
+	}
+	dk.quarantined[path] = reason
+	return true
+}
+
+// unquarantine stops holding back path, and anything under it.
+func (dk *DirKey) unquarantine(path string) {
+	dk.lock.Lock()
+	defer dk.lock.Unlock()
+	for qpath := range dk.quarantined {
+		if qpath == path || strings.HasPrefix(qpath, path+string(os.PathSeparator)) {
+			delete(dk.quarantined, qpath)
+		}
+	}
+}
+
+// Quarantined returns every file being held back from dk because it looks sensitive, with the reason why. Nothing is
+// published for dk until they're all allowed or removed.
+func (dk *DirKey) Quarantined() map[string]string {
+	dk.lock.Lock()
+	defer dk.lock.Unlock()
+	quarantined := make(map[string]string, len(dk.quarantined))
+	for path, reason := range dk.quarantined {
+		quarantined[path] = reason
+	}
+	return quarantined
+}
+
+// heldBack returns true, with a warning, if dk can't be published because the guard is holding back files.
+func (s *Syncer) heldBack(dk *DirKey) bool {
+	if !s.opt().Guard {
+		return false
+	}
+	quarantined := dk.Quarantined()
+	if len(quarantined) == 0 {
+		return false
+	}
+	s.log.Printf("[WARNING] Not publishing %s, %d sensitive file(s) need to be allowed or removed first (see `ipfs-sync quarantine`)\n",
+		dk.ID, len(quarantined))
+	return true
+}
+
+// Allow lets the file at path (absolute, or relative to the dir) in the dir with the given ID be published, even
+// though it looks sensitive, for as long as its contents don't change. If the dir is being watched, the file is added
+// right away.
+func (s *Syncer) Allow(id, path string) error {
+	dk := s.Dir(id)
+	if dk == nil {
+		return fmt.Errorf("no dir with ID '%s'", id)
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dk.Dir, path)
+	}
+	path = filepath.Clean(path)
+	if !strings.HasPrefix(path, dk.Dir) {
+		return fmt.Errorf("%s isn't in %s", path, dk.Dir)
+	}
+	hash := GetHashValue(path, false)
+	if hash == nil {
+		return fmt.Errorf("error reading %s", path)
+	}
+	if s.DB != nil {
+		if err := s.DB.Put(allowedKey(path), hash, nil); err != nil {
+			return err
+		}
+	} else {
+		dk.lock.Lock()
+		if dk.allowed == nil {
+			dk.allowed = make(map[string][]byte)
+		}
+		dk.allowed[path] = hash
+		dk.lock.Unlock()
+	}
+	dk.unquarantine(path)
+	s.log.Println(path, "allowed")
+	if queue := dk.Queue(); queue != nil {
+		queue.Push(path, true)
+	}
+	return nil
+}
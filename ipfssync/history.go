@@ -0,0 +1,172 @@
+package ipfssync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// PublishRecord is an entry in the publish history of a DirKey.
+type PublishRecord struct {
+	Time     time.Time
+	CID      string
+	Sequence *uint64       `json:",omitempty"` // sequence number of the IPNS record published, nil if the node couldn't say
+	Changes  ChangeSummary // files changed since the previous publish
+	Diff     *DiffSummary  `json:",omitempty"` // difference from the previous root, if it could be worked out
+	Rollback bool          `json:",omitempty"` // published by Rollback
+}
+
+// historyPrefix returns the DB key prefix the publish history of id is stored under.
+func historyPrefix(id string) string {
+	return "history/" + id + "/"
+}
+
+// lastRecord returns the most recent entry in the publish history of id, or nil if there isn't one.
+func (s *Syncer) lastRecord(id string) *PublishRecord {
+	prefix := historyPrefix(id)
+	iter := s.DB.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	defer iter.Release()
+	for ok := iter.Last(); ok; ok = iter.Prev() {
+		if len(iter.Key()) != len(prefix)+20 {
+			continue
+		}
+		record := new(PublishRecord)
+		if json.Unmarshal(iter.Value(), record) == nil {
+			return record
+		}
+	}
+	return nil
+}
+
+// recordPublish adds record to the publish history of dk, filling in its Time and Sequence.
+func (s *Syncer) recordPublish(dk *DirKey, record *PublishRecord) {
+	if s.DB == nil {
+		return
+	}
+	record.Time = time.Now()
+	if seq, err := s.IPNSSequence(s.Context(), dk.GetKey()); err == nil {
+		record.Sequence = &seq
+	} else if s.opt().Verbose {
+		s.log.Println("Error reading the IPNS sequence of", dk.ID+":", err)
+	}
+	jsonData, _ := json.Marshal(record)
+	key := fmt.Sprintf("%s%020d", historyPrefix(dk.ID), record.Time.UnixNano())
+	if err := s.DB.Put([]byte(key), jsonData, nil); err != nil {
+		s.error(dk, fmt.Errorf("error recording publish history: %w", err))
+	}
+}
+
+// History returns the publish history of id, oldest first.
+func (s *Syncer) History(id string) ([]*PublishRecord, error) {
+	if s.DB == nil {
+		return nil, errors.New("publish history requires a DB")
+	}
+	prefix := historyPrefix(id)
+	records := make([]*PublishRecord, 0)
+	iter := s.DB.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		if len(iter.Key()) != len(prefix)+20 { // belongs to an ID with prefix as its prefix
+			continue
+		}
+		record := new(PublishRecord)
+		if err := json.Unmarshal(iter.Value(), record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, iter.Error()
+}
+
+// FindRecord returns the entry in the publish history of id matching target, which is either a CID or an RFC 3339
+// timestamp. For a timestamp, it's the entry which was published at that time.
+func (s *Syncer) FindRecord(id, target string) (*PublishRecord, error) {
+	records, err := s.History(id)
+	if err != nil {
+		return nil, err
+	}
+	if t, err := time.Parse(time.RFC3339, target); err == nil {
+		if t.Nanosecond() == 0 { // given to the second, like `history` shows them
+			t = t.Add(time.Second - 1)
+		}
+		var found *PublishRecord
+		for _, record := range records {
+			if record.Time.After(t) {
+				break
+			}
+			found = record
+		}
+		if found == nil {
+			return nil, fmt.Errorf("%s wasn't published before %s", id, target)
+		}
+		return found, nil
+	}
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].CID == target {
+			return records[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%s was never published as %s", id, target)
+}
+
+// Rollback republishes the dir with the given ID as an earlier root from its publish history (see FindRecord), pinning
+// it again. If restore is true the MFS copy of the dir is replaced with the old root, otherwise the dir is paused so
+// the next publish doesn't undo the rollback.
+func (s *Syncer) Rollback(id, target string, restore bool) (*PublishRecord, error) {
+	dk := s.Dir(id)
+	if dk == nil {
+		return nil, fmt.Errorf("no dir with ID '%s'", id)
+	}
+	record, err := s.FindRecord(id, target)
+	if err != nil {
+		return nil, err
+	}
+
+	dk.workLock.Lock()
+	defer dk.workLock.Unlock()
+	oldCID := dk.GetCID()
+	if oldCID != record.CID {
+		if dk.Pin {
+			if err := s.pinRoot(dk, oldCID, record.CID); err != nil {
+				return nil, fmt.Errorf("error pinning %s: %w", record.CID, err)
+			}
+		}
+		s.updatePinRemote(dk, oldCID, record.CID, dk.MFSPath)
+	}
+	if restore {
+		s.log.Println("Restoring", dk.MFSPath, "to", record.CID, "...")
+		s.RemoveFile(s.Context(), dk.MFSPath)
+		if err := s.CopyCID(s.Context(), record.CID, dk.MFSPath); err != nil {
+			return nil, fmt.Errorf("error restoring MFS: %w", err)
+		}
+		if dk.Atomic {
+			s.RemoveFile(s.Context(), dk.workPath())
+			if err := s.CopyCID(s.Context(), record.CID, dk.workPath()); err != nil {
+				return nil, fmt.Errorf("error restoring staging copy: %w", err)
+			}
+		}
+	} else {
+		dk.SetPaused(true)
+	}
+	if err := s.Publish(s.Context(), record.CID, dk.ID); err != nil {
+		s.metrics.PublishFailures.Inc(dk.ID)
+		return nil, fmt.Errorf("error publishing: %w", err)
+	}
+	s.metrics.Publishes.Inc(dk.ID)
+	dk.SetCID(record.CID)
+	dk.takeChanges()
+	s.recordPublish(dk, &PublishRecord{CID: record.CID, Diff: s.summarize(dk, oldCID, record.CID), Rollback: true})
+	if dk.TwoWay {
+		s.setMergeBase(dk, record.CID)
+	}
+	s.applyRetention(dk, oldCID)
+	s.updateDNSLink(dk, record.CID)
+	s.log.Println(dk.ID, "rolled back to", record.CID)
+	if onPublish := s.opt().OnPublish; onPublish != nil {
+		onPublish(dk, record.CID)
+	}
+	return s.lastRecord(dk.ID), nil
+}
@@ -0,0 +1,170 @@
+package ipfssync
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// IgnoreFile holds gitignore-style rules for the directory it's in, and everything under it.
+const IgnoreFile = ".ipfs-syncignore"
+
+// ignoreRule is a single gitignore-style pattern.
+type ignoreRule struct {
+	pattern  []string // split on "/"
+	depth    int      // amount of directories between the synced dir and the directory the rule is relative to
+	negate   bool     // pattern started with "!"
+	dirOnly  bool     // pattern ended with "/"
+	anchored bool     // pattern contained a "/", so it's matched against the whole path instead of just the name
+}
+
+// legacyExtensions are the extensions Ignore used to default to, back when it only took extensions. They're still
+// treated as extensions when written as plain words, so old configs keep working.
+var legacyExtensions = map[string]bool{"kate-swp": true, "swp": true, "part": true, "crdownload": true}
+
+// bareWord returns true if line is a plain word, like the extensions Ignore used to take, rather than a pattern.
+func bareWord(line string) bool {
+	return line != "" && !strings.ContainsAny(line, `/*?[\!# `)
+}
+
+// parseIgnore compiles lines of gitignore-style patterns, relative to the directory depth directories into the synced
+// dir. If legacy is true, the legacyExtensions are treated as extensions, like Ignore used to.
+func parseIgnore(lines []string, depth int, legacy bool) []*ignoreRule {
+	rules := make([]*ignoreRule, 0, len(lines))
+	for _, line := range lines {
+		line = strings.TrimSuffix(line, "\r")
+		if !strings.HasSuffix(line, `\ `) {
+			line = strings.TrimRight(line, " ")
+		}
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if legacy && legacyExtensions[line] {
+			line = "*." + line
+		}
+
+		rule := &ignoreRule{depth: depth}
+		if line[0] == '!' {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			rule.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		rule.pattern = strings.Split(line, "/")
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// match returns true if rule matches the path split into parts, relative to the synced dir.
+func (rule *ignoreRule) match(parts []string, isDir bool) bool {
+	if rule.dirOnly && !isDir {
+		return false
+	}
+	parts = parts[rule.depth:]
+	if rule.anchored {
+		return matchSegments(rule.pattern, parts)
+	}
+	ok, _ := path.Match(rule.pattern[0], parts[len(parts)-1])
+	return ok
+}
+
+// matchSegments matches a path split on "/" against a pattern split on "/", where "**" matches any amount of
+// directories.
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			pattern = pattern[1:]
+			if len(pattern) == 0 {
+				return len(name) > 0 // "foo/**" matches everything inside foo, but not foo itself
+			}
+			for i := range name {
+				if matchSegments(pattern, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// ignoreFileRules returns the rules from the IgnoreFile in dir (relative to dk.Dir, split on "/"), loading them if
+// they haven't been yet.
+func (dk *DirKey) ignoreFileRules(dir []string) []*ignoreRule {
+	key := strings.Join(dir, "/")
+	dk.ignoreLock.Lock()
+	defer dk.ignoreLock.Unlock()
+	if rules, ok := dk.ignoreFiles[key]; ok {
+		return rules
+	}
+	var rules []*ignoreRule
+	if data, err := ioutil.ReadFile(filepath.Join(dk.Dir, filepath.FromSlash(key), IgnoreFile)); err == nil {
+		rules = parseIgnore(strings.Split(string(data), "\n"), len(dir), false)
+	}
+	if dk.ignoreFiles == nil {
+		dk.ignoreFiles = make(map[string][]*ignoreRule)
+	}
+	dk.ignoreFiles[key] = rules
+	return rules
+}
+
+// ForgetIgnoreFiles drops every loaded IgnoreFile, so they're read again the next time they're needed.
+func (dk *DirKey) ForgetIgnoreFiles() {
+	dk.ignoreLock.Lock()
+	dk.ignoreFiles = nil
+	dk.ignoreLock.Unlock()
+}
+
+// Ignored returns true if fpath, a path under dk.Dir, shouldn't be synced. Anything under an ignored directory is
+// ignored too.
+func (s *Syncer) Ignored(dk *DirKey, fpath string, isDir bool) bool {
+	if len(fpath) < len(dk.Dir) {
+		return false // dk.Dir itself
+	}
+	rel := filepath.ToSlash(strings.Trim(fpath[len(dk.Dir):], string(os.PathSeparator)))
+	if rel == "" {
+		return false
+	}
+	parts := strings.Split(rel, "/")
+	ignoreRules := s.ignoreRules.Load().([]*ignoreRule)
+	ignoreHidden := s.opt().IgnoreHidden
+	rules := make([]*ignoreRule, 0, len(ignoreRules)+len(dk.ignoreRules))
+	rules = append(append(rules, ignoreRules...), dk.ignoreRules...)
+	for i, name := range parts {
+		if (ignoreHidden && len(name) > 0 && name[0] == '.') || strings.HasPrefix(name, tempPrefix) {
+			return true
+		}
+		rules = append(rules, dk.ignoreFileRules(parts[:i])...)
+		// the last rule to match wins
+		for j := len(rules) - 1; j >= 0; j-- {
+			if rules[j].match(parts[:i+1], isDir || i < len(parts)-1) {
+				if !rules[j].negate {
+					return true
+				}
+				break
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package ipfssync
+
+import (
+	"bytes"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIgnored(t *testing.T) {
+	fk := newFakeKubo()
+	defer fk.Close()
+	dk := testDirKey(t, "ignored", map[string]string{
+		"docs/" + IgnoreFile: "*.txt\n!keep.txt\n",
+	})
+	dk.Ignore = []string{"/dist", "cache/", "logs/**/*.log"}
+	if err := dk.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	var logged bytes.Buffer
+	s := testSyncer(t, fk, &Options{
+		Ignore: []string{"swp", "node_modules", "*.tmp", "!important.tmp"},
+		Logger: log.New(&logged, "", 0),
+	})
+	// plain words which aren't legacy extensions used to be extensions too, so they're warned about
+	if warnings := strings.Count(logged.String(), "[WARNING]"); warnings != 1 || !strings.Contains(logged.String(), "'*.node_modules'") {
+		t.Errorf("Expected a warning about node_modules, logged: %s", logged.String())
+	}
+
+	for name, test := range map[string]struct {
+		isDir   bool
+		ignored bool
+	}{
+		"a.swp":                       {false, true},  // legacy extension
+		"swp":                         {false, false}, // it's an extension, not a name
+		"node_modules":                {true, true},   // plain words are names
+		"src/node_modules/x/index.js": {false, true},  // anything under an ignored dir
+		"src/node_modules.js":         {false, false},
+		"a.tmp":                       {false, true},
+		"sub/important.tmp":           {false, false}, // negated
+		"dist":                        {true, true},
+		"src/dist":                    {true, false}, // anchored to the root of the dir
+		"cache":                       {true, true},
+		"cache.txt/cache":             {false, false}, // dir only
+		"logs/a.log":                  {false, true},  // ** matches no directories
+		"logs/2021/01/a.log":          {false, true},  // or several
+		"logs/a.txt":                  {false, false},
+		"docs/a.txt":                  {false, true}, // from the IgnoreFile
+		"docs/sub/b.txt":              {false, true},
+		"docs/keep.txt":               {false, false},
+		"a.txt":                       {false, false}, // the IgnoreFile only applies under docs
+	} {
+		if got := s.Ignored(dk, filepath.Join(dk.Dir, filepath.FromSlash(name)), test.isDir); got != test.ignored {
+			t.Errorf("Ignored(%s) returned %t, expected %t", name, got, test.ignored)
+		}
+	}
+}
+
+func TestIgnoredDirRemoved(t *testing.T) {
+	fk := newFakeKubo()
+	defer fk.Close()
+	dk := testDirKey(t, "ignoreddir", map[string]string{"a.txt": "a", "build/out.txt": "out"})
+	s := testSyncer(t, fk, &Options{DB: filepath.Join(t.TempDir(), "db")})
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	if err := s.SyncDir(dk); err != nil {
+		t.Fatal(err)
+	}
+	if s.GetFileCID(s.Context(), dk.MFSPath+"/build") == "" {
+		t.Fatal("build wasn't added")
+	}
+
+	// a directory that becomes ignored is removed from the MFS, not just emptied
+	dk.Ignore = []string{"build/"}
+	if err := dk.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SyncDir(dk); err != nil {
+		t.Fatal(err)
+	}
+	if s.GetFileCID(s.Context(), dk.MFSPath+"/build") != "" {
+		t.Error("Ignored directory is still in the MFS")
+	}
+	if s.GetFileCID(s.Context(), dk.MFSPath+"/a.txt") == "" {
+		t.Error("a.txt was removed too")
+	}
+}
@@ -0,0 +1,8 @@
+package ipfssync
+
+import "os"
+
+// getInode always returns 0 on Windows, moves are matched by hash instead.
+func getInode(fi os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,506 @@
+package ipfssync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	KeySpace = "ipfs-sync."
+	API      = "/api/v0/"
+)
+
+func findInStringSlice(slice []string, val string) int {
+	for i, item := range slice {
+		if item == val {
+			return i
+		}
+	}
+	return -1
+}
+
+// reqContext returns a context for a request to the IPFS node, derived from ctx. If timeout is 0 it isn't used.
+func (s *Syncer) reqContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// Context returns the context requests the Syncer makes on its own are made with. It's cancelled by Stop, so nothing
+// is left waiting on the node, and replaced by a new one for anything done afterwards.
+func (s *Syncer) Context() context.Context {
+	s.rootLock.Lock()
+	defer s.rootLock.Unlock()
+	return s.root
+}
+
+// Client returns the client used to talk to the IPFS node.
+func (s *Syncer) Client() *Client {
+	return s.client
+}
+
+// HashStruct is useful when you only care about the returned hash.
+type HashStruct struct {
+	Hash string
+}
+
+// GetFileCID gets a file CID based on MFS path relative to BasePath.
+func (s *Syncer) GetFileCID(ctx context.Context, filePath string) string {
+	rctx, cancel := s.reqContext(ctx, s.opt().Timeout)
+	defer cancel()
+	fStat, err := s.client.FilesStat(rctx, s.basePath+filePath)
+	if err != nil {
+		return ""
+	}
+	return fStat.Hash
+}
+
+// RemoveFile removes a file from the MFS relative to BasePath.
+func (s *Syncer) RemoveFile(ctx context.Context, fpath string) error {
+	rctx, cancel := s.reqContext(ctx, s.opt().Timeout)
+	defer cancel()
+	return s.client.FilesRm(rctx, s.basePath+fpath, true)
+}
+
+// MoveFile moves a file or directory within the MFS, both paths are relative to BasePath.
+func (s *Syncer) MoveFile(ctx context.Context, from, to string) error {
+	rctx, cancel := s.reqContext(ctx, s.opt().Timeout)
+	defer cancel()
+	return s.client.FilesMv(rctx, s.basePath+from, s.basePath+to)
+}
+
+// MakeDir makes a directory along with parents in path
+func (s *Syncer) MakeDir(ctx context.Context, path string) error {
+	rctx, cancel := s.reqContext(ctx, s.opt().Timeout)
+	defer cancel()
+	return s.client.FilesMkdir(rctx, s.basePath+path, true)
+}
+
+// CopyCID copies cid, which may be a directory, into the MFS relative to BasePath.
+func (s *Syncer) CopyCID(ctx context.Context, cid, to string) error {
+	rctx, cancel := s.reqContext(ctx, s.opt().Timeout)
+	defer cancel()
+	return s.client.FilesCp(rctx, "/ipfs/"+cid, s.basePath+to)
+}
+
+// MFSDirType is the Type `files/ls` reports for directories.
+const MFSDirType = 1
+
+// MFSEntry is an entry returned by `files/ls`.
+type MFSEntry struct {
+	Name string
+	Type int
+	Size int64
+	Hash string
+}
+
+// ListDir lists the contents of a MFS directory relative to BasePath.
+func (s *Syncer) ListDir(ctx context.Context, path string) ([]*MFSEntry, error) {
+	rctx, cancel := s.reqContext(ctx, s.opt().Timeout)
+	defer cancel()
+	return s.client.FilesLs(rctx, s.basePath+path)
+}
+
+// UnixFS types, as reported by `ls`.
+const (
+	UnixFSRaw     = 0
+	UnixFSDir     = 1
+	UnixFSFile    = 2
+	UnixFSSymlink = 4
+)
+
+// LsLink is a link returned by `ls`.
+type LsLink struct {
+	Name string
+	Hash string
+	Size uint64
+	Type int
+}
+
+// LsObject is an object returned by `ls`.
+type LsObject struct {
+	Hash  string
+	Links []*LsLink
+}
+
+// Ls lists the links of the directory at path, like /ipfs/<CID>.
+func (s *Syncer) Ls(ctx context.Context, path string) ([]*LsLink, error) {
+	return s.ls(ctx, path, false)
+}
+
+// ls is Ls, also filling in the Size of files if size is true, which is slower.
+func (s *Syncer) ls(ctx context.Context, path string, size bool) ([]*LsLink, error) {
+	rctx, cancel := s.reqContext(ctx, 0) // no timeout
+	defer cancel()
+	ls, err := s.client.Ls(rctx, path, size)
+	if err != nil {
+		return nil, err
+	}
+	if len(ls.Objects) == 0 {
+		return nil, errors.New("Unexpected output in ls: no objects")
+	}
+	return ls.Objects[0].Links, nil
+}
+
+// Cat writes the contents of the file at path, like /ipfs/<CID>, to w.
+func (s *Syncer) Cat(ctx context.Context, path string, w io.Writer) error {
+	rctx, cancel := s.reqContext(ctx, 0) // no timeout
+	defer cancel()
+	return s.client.Cat(rctx, path, w)
+}
+
+// DagExport writes the DAG under cid to w as a CAR file, which can be imported on any node with `ipfs dag import`.
+func (s *Syncer) DagExport(ctx context.Context, cid string, w io.Writer) error {
+	rctx, cancel := s.reqContext(ctx, 0) // no timeout
+	defer cancel()
+	return s.client.DagExport(rctx, cid, w)
+}
+
+// A simple IPFS add, if onlyhash is true, only the CID is generated and returned
+func (s *Syncer) IPFSAddFile(ctx context.Context, fpath string, nocopy, onlyhash bool) (*HashStruct, error) {
+	return s.ipfsAdd(ctx, fpath, nocopy, onlyhash, nil)
+}
+
+// ipfsAdd is IPFSAddFile, encrypting the file with c as it's streamed if c isn't nil.
+func (s *Syncer) ipfsAdd(ctx context.Context, fpath string, nocopy, onlyhash bool, c *Cipher) (*HashStruct, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var data io.Reader = &countingReader{r: f, m: s.metrics.BytesAdded}
+	if c != nil {
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		go func(plain io.Reader) {
+			_, err := c.Encrypt(pw, plain)
+			pw.CloseWithError(err)
+		}(data)
+		data = pr
+	}
+
+	if s.opt().Verbose {
+		s.log.Println("Doing add request...")
+	}
+	rctx, cancel := s.reqContext(ctx, 0) // no timeout
+	defer cancel()
+	hash, err := s.client.Add(rctx, &AddRequest{Data: data, Name: f.Name(), AbsPath: fpath, Nocopy: nocopy,
+		OnlyHash: onlyhash})
+	if err != nil {
+		return nil, err
+	}
+
+	if s.opt().Verbose {
+		s.log.Println("File hash:", hash.Hash)
+	}
+	return hash, nil
+}
+
+// countingReader adds the number of bytes read from r to m.
+type countingReader struct {
+	r io.Reader
+	m *MetricVec
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.m.Add("", float64(n))
+	return n, err
+}
+
+// AddFile adds a file to the MFS relative to BasePath. from should be the full path to the file intended to be added.
+// If makedir is true, it'll create the directory it'll be placed in.
+// If overwrite is true, it'll perform an rm before copying to MFS.
+func (s *Syncer) AddFile(ctx context.Context, from, to string, nocopy bool, makedir bool,
+	overwrite bool) (string, error) {
+	s.log.Println("Adding file from", from, "to", s.basePath+to, "...")
+	hash, err := s.IPFSAddFile(ctx, from, nocopy, false)
+	if err != nil {
+		return "", err
+	}
+	return hash.Hash, s.CopyFile(ctx, hash.Hash, from, to, nocopy, makedir, overwrite)
+}
+
+// CopyFile copies an already added CID to the MFS relative to BasePath, the remaining arguments are the same as AddFile.
+func (s *Syncer) CopyFile(ctx context.Context, cid, from, to string, nocopy bool, makedir bool, overwrite bool) error {
+	if makedir {
+		toSplit := strings.Split(to, "/")
+		parent := strings.Join(toSplit[:len(toSplit)-1], "/")
+		if s.opt().Verbose {
+			s.log.Printf("Creating parent directory '%s' in MFS...\n", parent)
+		}
+		err := s.MakeDir(ctx, parent)
+		if err != nil {
+			return err
+		}
+	}
+
+	if overwrite {
+		if s.opt().Verbose {
+			s.log.Println("Removing existing file (if any)...")
+		}
+		s.RemoveFile(ctx, to)
+	}
+
+	// send files/cp request
+	if s.opt().Verbose {
+		s.log.Println("Adding file to mfs path:", s.basePath+to)
+	}
+	err := s.CopyCID(ctx, cid, to)
+	if err != nil {
+		if s.opt().Verbose {
+			s.log.Println("Error on files/cp:", err)
+			s.log.Println("fpath:", from)
+		}
+		// only the filestore can go bad, and encrypted files aren't added this way
+		if nocopy && s.HandleBadBlockError(ctx, err, from, nocopy) {
+			s.log.Println("files/cp failure due to filestore, retrying (recursive)")
+			_, err = s.AddFile(ctx, from, to, nocopy, makedir, overwrite)
+		}
+	}
+	return err
+}
+
+// Completely removes a CID, even if pinned
+func (s *Syncer) RemoveCID(ctx context.Context, cid string) {
+	found := false
+	rctx, cancel := s.reqContext(ctx, 0) // no timeout
+	defer cancel()
+	err := s.client.Refs(rctx, cid, func(ref string) error {
+		found = true
+		if s.opt().Verbose {
+			s.log.Println("Removing block:", ref)
+		}
+		s.RemoveBlock(ctx, ref)
+		return nil
+	})
+	if err != nil {
+		s.log.Println("Error listing refs of", cid+":", err)
+	}
+	if !found {
+		if s.opt().Verbose {
+			s.log.Println("Removing block:", cid)
+		}
+		s.RemoveBlock(ctx, cid)
+	}
+}
+
+// remove block, even if pinned
+func (s *Syncer) RemoveBlock(ctx context.Context, cid string) {
+	err := s.removeBlock(ctx, cid)
+	var ke *KuboError
+	for errors.As(err, &ke) && errors.Is(ke, ErrPinned) {
+		pin := ke.PinnedBy
+		if pin == "" { // IPFS returns "pinned (recursive)" when the block itself is pinned, without saying which pin
+			pin = cid
+		}
+		s.log.Println("Effected block is pinned, removing pin:", pin)
+		if err := s.Unpin(ctx, pin); err != nil {
+			s.log.Println("Error removing pin:", err)
+			break
+		}
+		err = s.removeBlock(ctx, cid)
+	}
+
+	if err != nil {
+		s.log.Println("Error removing bad block:", err)
+	}
+}
+
+// removeBlock does a single `block/rm` of cid.
+func (s *Syncer) removeBlock(ctx context.Context, cid string) error {
+	rctx, cancel := s.reqContext(ctx, s.opt().Timeout)
+	defer cancel()
+	return s.client.BlockRm(rctx, cid)
+}
+
+// CleanFilestore removes blocks that point to files that don't exist
+func (s *Syncer) CleanFilestore(ctx context.Context) {
+	select {
+	case s.cleanupLock <- 1:
+		defer func() { <-s.cleanupLock }()
+	default:
+		return
+	}
+	if s.opt().Verbose {
+		s.log.Println("Removing blocks that point to a file that doesn't exist from filestore...")
+	}
+
+	rctx, cancel := s.reqContext(ctx, 0) // no timeout
+	defer cancel()
+	err := s.client.FilestoreVerify(rctx, func(fsEntry *FileStoreEntry) error {
+		if fsEntry.Status == NoFile { // if the block points to a file that doesn't exist, remove it.
+			s.log.Println("Removing reference from filestore:", fsEntry.Key.Slash)
+			s.RemoveBlock(ctx, fsEntry.Key.Slash)
+		}
+		return nil
+	})
+	if err != nil {
+		s.log.Println("Error verifying filestore:", err)
+	}
+}
+
+// HandleBackBlockError runs CleanFilestore() and returns true if there was a bad block error.
+func (s *Syncer) HandleBadBlockError(ctx context.Context, err error, fpath string, nocopy bool) bool {
+	if errorKind(err) == ErrBadBlock {
+		if s.opt().Verbose {
+			s.log.Println("Handling bad block error:", err)
+		}
+		if fpath == "" { // TODO attempt to get fpath from error msg when possible
+			s.CleanFilestore(ctx)
+		} else {
+			cid, err := s.IPFSAddFile(ctx, fpath, nocopy, true)
+			if err == nil {
+				s.RemoveCID(ctx, cid.Hash)
+			} else {
+				s.log.Println("Error handling bad block error:", err)
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Pin CID
+func (s *Syncer) Pin(ctx context.Context, cid string) error {
+	rctx, cancel := s.reqContext(ctx, 0) // no timeout
+	defer cancel()
+	pins, err := s.client.PinAdd(rctx, cid)
+	if err == nil && s.opt().Verbose {
+		s.log.Println("Pinned:", pins.Pins)
+	}
+	return err
+}
+
+// Unpin removes the recursive pin of cid.
+func (s *Syncer) Unpin(ctx context.Context, cid string) error {
+	rctx, cancel := s.reqContext(ctx, 0) // no timeout
+	defer cancel()
+	_, err := s.client.PinRm(rctx, cid)
+	return err
+}
+
+// ErrorStruct allows us to read the errors received by the IPFS daemon.
+type ErrorStruct struct {
+	Message string // used for error text
+	Error2  string `json:"Error"` // also used for error text
+	Code    int
+	Type    string
+}
+
+// Outputs the error text contained in the struct, statistfies error interface.
+func (es *ErrorStruct) Error() string {
+	switch {
+	case es.Message != "":
+		return es.Message
+	case es.Error2 != "":
+		return es.Error2
+	}
+	return ""
+}
+
+// UpdatePin updates a recursive pin to a new CID, unpinning old content. If the update fails, to is pinned instead,
+// and an error is only returned if that fails too.
+func (s *Syncer) UpdatePin(ctx context.Context, from, to string, nocopy bool) error {
+	rctx, cancel := s.reqContext(ctx, 0) // no timeout
+	_, err := s.client.PinUpdate(rctx, from, to)
+	cancel()
+	if err != nil {
+		s.log.Println("Error updating pin:", err)
+		if s.opt().Verbose {
+			s.log.Println("From CID:", from, "To CID:", to)
+		}
+		if s.HandleBadBlockError(ctx, err, "", nocopy) {
+			if s.opt().Verbose {
+				s.log.Println("Bad blocks found, running pin/update again (recursive)")
+			}
+			return s.UpdatePin(ctx, from, to, nocopy)
+		}
+		err = s.Pin(ctx, to)
+		if err != nil {
+			s.log.Println("[ERROR] Error adding pin:", err)
+		}
+	}
+	return err
+}
+
+// Key contains information about an IPNS key.
+type Key struct {
+	Id   string
+	Name string
+}
+
+// Keys is used to store a slice of Key.
+type Keys struct {
+	Keys []Key
+}
+
+// ListKeys lists all the keys in the IPFS daemon.
+// TODO Only return keys in the namespace.
+func (s *Syncer) ListKeys(ctx context.Context) (*Keys, error) {
+	rctx, cancel := s.reqContext(ctx, s.opt().Timeout)
+	defer cancel()
+	return s.client.KeyList(rctx)
+}
+
+// ResolveIPNS takes an IPNS key and returns the CID it resolves to.
+func (s *Syncer) ResolveIPNS(ctx context.Context, key string) (string, error) {
+	return s.resolveIPNS(ctx, key, false)
+}
+
+// IPNSSequence returns the sequence number of the IPNS record of key, an IPNS name, as the node has it.
+func (s *Syncer) IPNSSequence(ctx context.Context, key string) (uint64, error) {
+	rctx, cancel := s.reqContext(ctx, s.opt().Timeout)
+	defer cancel()
+	var record bytes.Buffer
+	if err := s.client.RoutingGet(rctx, "/ipns/"+key, &record); err != nil {
+		return 0, err
+	}
+	res, err := s.client.NameInspect(rctx, &record)
+	if err != nil {
+		return 0, err
+	}
+	return res.Entry.Sequence, nil
+}
+
+// resolveIPNS is ResolveIPNS, skipping the node's cache if nocache is true, so records published by other nodes are seen
+// right away.
+func (s *Syncer) resolveIPNS(ctx context.Context, key string, nocache bool) (string, error) {
+	rctx, cancel := s.reqContext(ctx, 0) // no timeout
+	defer cancel()
+	path, err := s.client.NameResolve(rctx, key, nocache)
+	if err != nil {
+		return "", err
+	}
+	pathSplit := strings.Split(path.Path, "/")
+	if len(pathSplit) < 3 {
+		return "", errors.New("Unexpected output in name/resolve: " + path.Path)
+	}
+	return pathSplit[2], nil
+}
+
+// Generates an IPNS key in the keyspace based on name.
+func (s *Syncer) GenerateKey(ctx context.Context, name string) (Key, error) {
+	rctx, cancel := s.reqContext(ctx, s.opt().Timeout)
+	defer cancel()
+	key, err := s.client.KeyGen(rctx, KeySpace+name)
+	if err != nil {
+		return Key{}, err
+	}
+	return *key, nil
+}
+
+// Publish CID to IPNS
+func (s *Syncer) Publish(ctx context.Context, cid, key string) error {
+	rctx, cancel := s.reqContext(ctx, 0) // no timeout
+	defer cancel()
+	_, err := s.client.NamePublish(rctx, cid, KeySpace+key)
+	return err
+}
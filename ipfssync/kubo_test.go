@@ -0,0 +1,504 @@
+package ipfssync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// fakeNode is a block in the blockstore of fakeKubo, either a file or a directory.
+type fakeNode struct {
+	data     []byte
+	links    map[string]string // name to CID, nil for files
+	filePath string            // set if the block was added with nocopy
+}
+
+func (n *fakeNode) isDir() bool {
+	return n.links != nil
+}
+
+// fakeMFS is a mutable file or directory in the MFS of fakeKubo.
+type fakeMFS struct {
+	cid      string              // for files
+	children map[string]*fakeMFS // nil for files
+}
+
+// fakeKubo is an in-process stand-in for the Kubo RPC API, with an in-memory blockstore, MFS, pins, keys and IPNS.
+// Only the parts of the API ipfs-sync uses are implemented.
+type fakeKubo struct {
+	*httptest.Server
+
+	lock    sync.Mutex
+	blocks  map[string]*fakeNode
+	mfs     *fakeMFS
+	pins    map[string]bool   // recursive pins
+	keys    map[string]string // name to ID
+	records map[string]string // IPNS ID to CID
+	seqs    map[string]uint64 // IPNS ID to the sequence number of its record
+}
+
+// newFakeKubo starts a fakeKubo.
+func newFakeKubo() *fakeKubo {
+	fk := &fakeKubo{
+		blocks:  make(map[string]*fakeNode),
+		mfs:     &fakeMFS{children: make(map[string]*fakeMFS)},
+		pins:    make(map[string]bool),
+		keys:    make(map[string]string),
+		records: make(map[string]string),
+		seqs:    make(map[string]uint64),
+	}
+	fk.Server = httptest.NewServer(http.HandlerFunc(fk.serve))
+	return fk
+}
+
+// fakeCID returns a CID-like string for data.
+func fakeCID(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "bafk" + hex.EncodeToString(sum[:16])
+}
+
+// putDir stores a directory with links, returning its CID.
+func (fk *fakeKubo) putDir(links map[string]string) string {
+	names := make([]string, 0, len(links))
+	for name := range links {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString("dir\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s %s\n", name, links[name])
+	}
+	cid := fakeCID([]byte(b.String()))
+	fk.blocks[cid] = &fakeNode{links: links}
+	return cid
+}
+
+// mfsCID stores the directories under m in the blockstore, returning the CID of m.
+func (fk *fakeKubo) mfsCID(m *fakeMFS) string {
+	if m.children == nil {
+		return m.cid
+	}
+	links := make(map[string]string, len(m.children))
+	for name, child := range m.children {
+		links[name] = fk.mfsCID(child)
+	}
+	return fk.putDir(links)
+}
+
+// fromBlocks builds an MFS entry from the DAG at cid.
+func (fk *fakeKubo) fromBlocks(cid string) (*fakeMFS, error) {
+	node := fk.blocks[cid]
+	if node == nil {
+		return nil, fmt.Errorf("failed to get block for %s: blockstore: block not found", cid)
+	}
+	if !node.isDir() {
+		if node.filePath != "" {
+			if _, err := os.Stat(node.filePath); err != nil {
+				return nil, fmt.Errorf("failed to get block for %s: open %s: no such file or directory", cid, node.filePath)
+			}
+		}
+		return &fakeMFS{cid: cid}, nil
+	}
+	m := &fakeMFS{children: make(map[string]*fakeMFS, len(node.links))}
+	for name, child := range node.links {
+		cm, err := fk.fromBlocks(child)
+		if err != nil {
+			return nil, err
+		}
+		m.children[name] = cm
+	}
+	return m, nil
+}
+
+// lookup returns the MFS entry at p, and its parent.
+func (fk *fakeKubo) lookup(p string) (entry, parent *fakeMFS) {
+	entry = fk.mfs
+	for _, name := range strings.Split(strings.Trim(path.Clean(p), "/"), "/") {
+		if name == "" {
+			continue
+		}
+		if entry == nil || entry.children == nil {
+			return nil, nil
+		}
+		parent, entry = entry, entry.children[name]
+	}
+	return entry, parent
+}
+
+// refs returns every CID linked to from cid, recursively.
+func (fk *fakeKubo) refs(cid string, seen map[string]bool) []string {
+	var refs []string
+	node := fk.blocks[cid]
+	if node == nil {
+		return nil
+	}
+	for _, child := range node.links {
+		if !seen[child] {
+			seen[child] = true
+			refs = append(refs, child)
+			refs = append(refs, fk.refs(child, seen)...)
+		}
+	}
+	return refs
+}
+
+// pinnedBy returns the recursive pin protecting cid, if any.
+func (fk *fakeKubo) pinnedBy(cid string) string {
+	if fk.pins[cid] {
+		return cid
+	}
+	for pin := range fk.pins {
+		for _, ref := range fk.refs(pin, make(map[string]bool)) {
+			if ref == cid {
+				return pin
+			}
+		}
+	}
+	return ""
+}
+
+// Resolve returns what the IPNS key named name (without KeySpace) was last published as.
+func (fk *fakeKubo) Resolve(name string) string {
+	fk.lock.Lock()
+	defer fk.lock.Unlock()
+	return fk.records[fk.keys[KeySpace+name]]
+}
+
+// Cat returns the contents of the file at the MFS path p.
+func (fk *fakeKubo) Cat(p string) (string, bool) {
+	fk.lock.Lock()
+	defer fk.lock.Unlock()
+	entry, _ := fk.lookup(p)
+	if entry == nil || entry.children != nil || fk.blocks[entry.cid] == nil {
+		return "", false
+	}
+	return string(fk.blocks[entry.cid].data), true
+}
+
+// HasBlock returns true if cid is in the blockstore.
+func (fk *fakeKubo) HasBlock(cid string) bool {
+	fk.lock.Lock()
+	defer fk.lock.Unlock()
+	return fk.blocks[cid] != nil
+}
+
+// Pinned returns true if cid is pinned recursively.
+func (fk *fakeKubo) Pinned(cid string) bool {
+	fk.lock.Lock()
+	defer fk.lock.Unlock()
+	return fk.pins[cid]
+}
+
+func fakeError(w http.ResponseWriter, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(w).Encode(&ErrorStruct{Message: msg, Code: 0, Type: "error"})
+}
+
+func (fk *fakeKubo) serve(w http.ResponseWriter, r *http.Request) {
+	cmd := strings.TrimPrefix(r.URL.Path, API)
+	q := r.URL.Query()
+	args := q["arg"]
+	if cmd == "add" || cmd == "name/inspect" {
+		fk.add(w, r)
+		return
+	}
+
+	fk.lock.Lock()
+	defer fk.lock.Unlock()
+	enc := json.NewEncoder(w)
+	w.Header().Set("Content-Type", "application/json")
+	switch cmd {
+	case "version":
+		enc.Encode(map[string]string{"Version": "0.0.0-fake"})
+	case "files/stat":
+		entry, _ := fk.lookup(args[0])
+		if entry == nil {
+			fakeError(w, "file does not exist")
+			return
+		}
+		enc.Encode(&HashStruct{Hash: fk.mfsCID(entry)})
+	case "files/ls":
+		entry, _ := fk.lookup(args[0])
+		if entry == nil {
+			fakeError(w, "file does not exist")
+			return
+		}
+		type lsStruct struct {
+			Entries []*MFSEntry
+		}
+		ls := &lsStruct{Entries: make([]*MFSEntry, 0, len(entry.children))}
+		for name, child := range entry.children {
+			e := &MFSEntry{Name: name, Hash: fk.mfsCID(child)}
+			if child.children != nil {
+				e.Type = MFSDirType
+			} else {
+				e.Size = int64(len(fk.blocks[child.cid].data))
+			}
+			ls.Entries = append(ls.Entries, e)
+		}
+		enc.Encode(ls)
+	case "files/mkdir":
+		entry := fk.mfs
+		for _, name := range strings.Split(strings.Trim(path.Clean(args[0]), "/"), "/") {
+			if name == "" {
+				continue
+			}
+			child := entry.children[name]
+			if child == nil {
+				if q.Get("parents") != "true" {
+					fakeError(w, "file does not exist")
+					return
+				}
+				child = &fakeMFS{children: make(map[string]*fakeMFS)}
+				entry.children[name] = child
+			} else if child.children == nil {
+				fakeError(w, "not a directory")
+				return
+			}
+			entry = child
+		}
+	case "files/cp":
+		src, err := fk.fromBlocks(strings.TrimPrefix(args[0], "/ipfs/"))
+		if err != nil {
+			fakeError(w, err.Error())
+			return
+		}
+		dest, parent := fk.lookup(args[1])
+		if dest != nil {
+			fakeError(w, "directory already has entry by that name")
+			return
+		}
+		if parent == nil || parent.children == nil {
+			fakeError(w, "file does not exist")
+			return
+		}
+		parent.children[path.Base(args[1])] = src
+	case "files/mv":
+		src, srcParent := fk.lookup(args[0])
+		if src == nil || srcParent == nil {
+			fakeError(w, "file does not exist")
+			return
+		}
+		dest, parent := fk.lookup(args[1])
+		name := path.Base(args[1])
+		if dest != nil {
+			if dest.children == nil {
+				fakeError(w, "directory already has entry by that name")
+				return
+			}
+			parent, name = dest, path.Base(args[0])
+		}
+		if parent == nil || parent.children == nil {
+			fakeError(w, "file does not exist")
+			return
+		}
+		delete(srcParent.children, path.Base(args[0]))
+		parent.children[name] = src
+	case "files/rm":
+		entry, parent := fk.lookup(args[0])
+		if entry == nil || parent == nil {
+			fakeError(w, "file does not exist")
+			return
+		}
+		if entry.children != nil && q.Get("force") != "true" && q.Get("recursive") != "true" {
+			fakeError(w, args[0]+" is a directory, use -r to remove directories")
+			return
+		}
+		delete(parent.children, path.Base(args[0]))
+	case "pin/add":
+		cid := strings.TrimPrefix(args[0], "/ipfs/")
+		if fk.blocks[cid] == nil {
+			fakeError(w, "failed to get block for "+cid+": blockstore: block not found")
+			return
+		}
+		fk.pins[cid] = true
+		enc.Encode(map[string][]string{"Pins": {cid}})
+	case "pin/rm":
+		if !fk.pins[args[0]] {
+			fakeError(w, "not pinned or pinned indirectly")
+			return
+		}
+		delete(fk.pins, args[0])
+		enc.Encode(map[string][]string{"Pins": {args[0]}})
+	case "pin/update":
+		if !fk.pins[args[0]] {
+			fakeError(w, "'from' cid was not recursively pinned already")
+			return
+		}
+		if fk.blocks[args[1]] == nil {
+			fakeError(w, "failed to get block for "+args[1]+": blockstore: block not found")
+			return
+		}
+		delete(fk.pins, args[0])
+		fk.pins[args[1]] = true
+		enc.Encode(map[string][]string{"Pins": {args[0], args[1]}})
+	case "refs":
+		seen := make(map[string]bool)
+		for _, ref := range fk.refs(args[0], seen) {
+			enc.Encode(&RefResp{Ref: ref})
+		}
+	case "block/rm":
+		if fk.blocks[args[0]] == nil {
+			fakeError(w, "blockstore: block not found")
+			return
+		}
+		switch pin := fk.pinnedBy(args[0]); pin {
+		case "":
+			delete(fk.blocks, args[0])
+			enc.Encode(map[string]string{"Hash": args[0]})
+		case args[0]:
+			fakeError(w, "pinned (recursive)")
+		default:
+			fakeError(w, "pinned via "+pin)
+		}
+	case "filestore/verify":
+		cids := make([]string, 0)
+		for cid, node := range fk.blocks {
+			if node.filePath != "" {
+				cids = append(cids, cid)
+			}
+		}
+		sort.Strings(cids)
+		for _, cid := range cids {
+			status := FileStoreStatus(1) // ok
+			if _, err := os.Stat(fk.blocks[cid].filePath); err != nil {
+				status = NoFile
+			}
+			enc.Encode(&FileStoreEntry{Status: status, Key: FileStoreKey{Slash: cid}})
+		}
+	case "key/list":
+		keys := &Keys{Keys: []Key{{Name: "self", Id: "k51self"}}}
+		for name, id := range fk.keys {
+			keys.Keys = append(keys.Keys, Key{Name: name, Id: id})
+		}
+		enc.Encode(keys)
+	case "key/gen":
+		if fk.keys[args[0]] != "" {
+			fakeError(w, "key with name '"+args[0]+"' already exists")
+			return
+		}
+		id := "k51" + fakeCID([]byte(args[0]))[4:]
+		fk.keys[args[0]] = id
+		enc.Encode(&Key{Name: args[0], Id: id})
+	case "name/publish":
+		id := fk.keys[q.Get("key")]
+		if id == "" {
+			fakeError(w, "no key by the given name was found")
+			return
+		}
+		if _, ok := fk.records[id]; ok {
+			fk.seqs[id]++
+		}
+		fk.records[id] = strings.TrimPrefix(args[0], "/ipfs/")
+		enc.Encode(map[string]string{"Name": id, "Value": "/ipfs/" + fk.records[id]})
+	case "ls":
+		node := fk.blocks[strings.TrimPrefix(args[0], "/ipfs/")]
+		if node == nil || !node.isDir() {
+			fakeError(w, "not a directory")
+			return
+		}
+		links := make([]*LsLink, 0, len(node.links))
+		for name, cid := range node.links {
+			link := &LsLink{Name: name, Hash: cid, Type: UnixFSFile}
+			if fk.blocks[cid] != nil && fk.blocks[cid].isDir() {
+				link.Type = UnixFSDir
+			} else if fk.blocks[cid] != nil && q.Get("size") == "true" {
+				link.Size = uint64(len(fk.blocks[cid].data))
+			}
+			links = append(links, link)
+		}
+		sort.Slice(links, func(i, j int) bool { return links[i].Name < links[j].Name })
+		enc.Encode(map[string][]*LsObject{"Objects": {{Hash: args[0], Links: links}}})
+	case "cat":
+		node := fk.blocks[strings.TrimPrefix(args[0], "/ipfs/")]
+		if node == nil || node.isDir() {
+			fakeError(w, "this dag node is a directory")
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(node.data)
+	case "dag/export":
+		if fk.blocks[args[0]] == nil {
+			fakeError(w, "block was not found locally (offline): ipld: could not find "+args[0])
+			return
+		}
+		// not a real CAR, just every block under the root
+		w.Header().Set("Content-Type", "application/vnd.ipld.car")
+		fmt.Fprintf(w, "car %s\n", args[0])
+		for _, ref := range fk.refs(args[0], make(map[string]bool)) {
+			fmt.Fprintf(w, "%s %d\n", ref, len(fk.blocks[ref].data))
+			w.Write(fk.blocks[ref].data)
+		}
+	case "routing/get":
+		id := strings.TrimPrefix(args[0], "/ipns/")
+		if fk.records[id] == "" {
+			fakeError(w, "routing: not found")
+			return
+		}
+		// not a real IPNS record, just what name/inspect needs
+		w.Header().Set("Content-Type", "application/octet-stream")
+		fmt.Fprintf(w, "/ipfs/%s %d", fk.records[id], fk.seqs[id])
+	case "name/resolve":
+		cid := fk.records[args[0]]
+		if cid == "" {
+			fakeError(w, "could not resolve name")
+			return
+		}
+		enc.Encode(map[string]string{"Path": "/ipfs/" + cid})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404 page not found"))
+	}
+}
+
+// add handles `add` and `name/inspect`, which take a file as multipart form data.
+func (fk *fakeKubo) add(w http.ResponseWriter, r *http.Request) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		fakeError(w, err.Error())
+		return
+	}
+	part, err := mr.NextPart()
+	if err != nil {
+		fakeError(w, err.Error())
+		return
+	}
+	data, err := ioutil.ReadAll(part)
+	if err != nil {
+		fakeError(w, err.Error())
+		return
+	}
+	q := r.URL.Query()
+	if r.URL.Path == API+"name/inspect" {
+		var entry IPNSEntry
+		if _, err := fmt.Sscanf(string(data), "%s %d", &entry.Value, &entry.Sequence); err != nil {
+			fakeError(w, "record data is not a valid IPNS record")
+			return
+		}
+		json.NewEncoder(w).Encode(&NameInspectResponse{Entry: entry})
+		return
+	}
+	cid := fakeCID(data)
+
+	fk.lock.Lock()
+	defer fk.lock.Unlock()
+	if q.Get("only-hash") != "true" {
+		node := &fakeNode{data: data}
+		if q.Get("nocopy") == "true" {
+			node.filePath = part.Header.Get("Abspath")
+		}
+		fk.blocks[cid] = node
+	}
+	json.NewEncoder(w).Encode(map[string]string{"Name": part.FileName(), "Hash": cid, "Size": fmt.Sprint(len(data))})
+}
@@ -0,0 +1,201 @@
+package ipfssync
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ConflictSuffix is added to the name of the remote copy of a file changed on both sides (before its extension),
+// followed by the time the conflict was found.
+const ConflictSuffix = ".conflict-"
+
+// mergeBaseKey returns the DB key the merge base of the dir with the given ID is stored under.
+func mergeBaseKey(id string) []byte {
+	return []byte("mergebase/" + id)
+}
+
+// mergeBase returns the root dk was last in sync with, the common ancestor of the local and remote trees.
+func (s *Syncer) mergeBase(dk *DirKey) string {
+	if s.DB == nil {
+		return ""
+	}
+	data, err := s.DB.Get(mergeBaseKey(dk.ID), nil)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// setMergeBase remembers cid as the root dk was last in sync with.
+func (s *Syncer) setMergeBase(dk *DirKey, cid string) {
+	if s.DB != nil {
+		s.DB.Put(mergeBaseKey(dk.ID), []byte(cid), nil)
+	}
+}
+
+// conflictPath returns the path the remote copy of the conflicting file at path is written to.
+func conflictPath(path string, t time.Time) string {
+	ext := filepath.Ext(path)
+	if ext == filepath.Base(path) { // like .bashrc
+		ext = ""
+	}
+	return path[:len(path)-len(ext)] + ConflictSuffix + t.UTC().Format("20060102-150405") + ext
+}
+
+// localChanged returns true if the file at path was changed, created or removed on disk since it was last added.
+// HashLock should be held by the caller.
+func (s *Syncer) localChanged(path string) bool {
+	fh := s.Hashes[path]
+	stamp := GetHashValue(path, true)
+	if fh == nil {
+		return stamp != nil
+	}
+	return string(stamp) != string(fh.FakeHash)
+}
+
+// takeRemote replaces the file at path, on disk and in the MFS, with the file cid. If cid is empty, it's removed.
+func (s *Syncer) takeRemote(dk *DirKey, path, cid string) error {
+	mfsPath := dk.mfsPath(path)
+	if cid == "" {
+		s.log.Println("Deleting", path, "...")
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		// the watcher may have beaten us to it
+		if err := s.RemoveFile(s.Context(), mfsPath); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		s.HashLock.Lock()
+		s.deleteHash(s.Hashes[path], path)
+		s.HashLock.Unlock()
+		dk.addChanges(0, 1, 0)
+		return nil
+	}
+	s.log.Println("Downloading", path, "...")
+	if err := s.download(cid, path); err != nil {
+		return err
+	}
+	if err := s.adopt(dk, path, cid); err != nil {
+		return err
+	}
+	dk.addChanges(1, 0, 0)
+	return nil
+}
+
+// adopt makes the file cid, which is already at path on disk, the MFS copy of path, and records its hash so it isn't
+// added again.
+func (s *Syncer) adopt(dk *DirKey, path, cid string) error {
+	mfsPath := dk.mfsPath(path)
+	mfsSplit := strings.Split(mfsPath, "/")
+	if err := s.MakeDir(s.Context(), strings.Join(mfsSplit[:len(mfsSplit)-1], "/")); err != nil {
+		return err
+	}
+	s.RemoveFile(s.Context(), mfsPath)
+	if err := s.CopyCID(s.Context(), cid, mfsPath); err != nil {
+		return err
+	}
+	s.HashLock.Lock()
+	if s.Hashes[path] == nil {
+		s.Hashes[path] = new(FileHash)
+	}
+	s.updateHash(s.Hashes[path].Recalculate(path, dk.DontHash))
+	s.HashLock.Unlock()
+	return nil
+}
+
+// MergeRemote merges whatever another instance sharing dk's IPNS key has published into dk, using the root dk was
+// last in sync with as the common ancestor. Files changed on only one side take that side's version, and if a file
+// was changed on both sides, the remote copy is kept next to the local one with ConflictSuffix in its name. Changes
+// still waiting to be added count as local changes. The result is published on the next PublishDir. If anything
+// couldn't be merged, an error is returned and the merge is tried again next time, so dk shouldn't be published until
+// it succeeds, or the remote changes would be lost.
+func (s *Syncer) MergeRemote(dk *DirKey) error {
+	if s.DB == nil {
+		return errors.New("two-way sync requires a DB")
+	}
+	dk.workLock.Lock()
+	defer dk.workLock.Unlock()
+
+	remoteCID, err := s.resolveIPNS(s.Context(), dk.GetKey(), true)
+	if err != nil {
+		return fmt.Errorf("error resolving %s: %w", dk.GetKey(), err)
+	}
+	baseCID := s.mergeBase(dk)
+	if remoteCID == baseCID {
+		return nil
+	}
+	localCID := s.GetFileCID(s.Context(), dk.workPath())
+	if localCID == "" { // nothing's been added yet
+		if err := s.MakeDir(s.Context(), dk.workPath()); err != nil {
+			return err
+		}
+		localCID = s.GetFileCID(s.Context(), dk.workPath())
+	}
+	if remoteCID == localCID {
+		s.setMergeBase(dk, remoteCID)
+		return nil
+	}
+	s.log.Println("Merging", remoteCID, "into", dk.ID, "...")
+
+	base, local, remote := make(map[string]string), make(map[string]string), make(map[string]string)
+	dirs := make(map[string]bool)
+	if baseCID != "" {
+		if err := s.walkRemote(dk, "/ipfs/"+baseCID, dk.Dir, base, dirs); err != nil {
+			return err
+		}
+	}
+	if err := s.walkRemote(dk, "/ipfs/"+localCID, dk.Dir, local, dirs); err != nil {
+		return err
+	}
+	if err := s.walkRemote(dk, "/ipfs/"+remoteCID, dk.Dir, remote, dirs); err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	var paths []string
+	for _, files := range []map[string]string{base, local, remote} {
+		for path := range files {
+			if !seen[path] {
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+	sort.Strings(paths)
+
+	now := time.Now()
+	failed := 0
+	for _, path := range paths {
+		b, l, r := base[path], local[path], remote[path]
+		if r == b || r == l {
+			continue // nothing to take
+		}
+		s.HashLock.RLock()
+		changed := s.localChanged(path)
+		s.HashLock.RUnlock()
+		switch {
+		case !changed && (l == b || l == ""):
+			err = s.takeRemote(dk, path, r)
+		case r == "":
+			continue // removed remotely, but changed locally
+		default:
+			cpath := conflictPath(path, now)
+			s.log.Println("Conflict in", path+", keeping the remote copy as", cpath, "...")
+			err = s.takeRemote(dk, cpath, r)
+		}
+		if err != nil {
+			s.error(dk, fmt.Errorf("error merging %s: %w", path, err))
+			failed++
+		}
+	}
+	if failed > 0 { // try again next time
+		return fmt.Errorf("failed to merge %d file(s) from %s", failed, remoteCID)
+	}
+	s.setMergeBase(dk, remoteCID)
+	s.log.Println(dk.ID, "merged", remoteCID)
+	return nil
+}
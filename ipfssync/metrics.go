@@ -0,0 +1,230 @@
+package ipfssync
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metric is anything which can be written out in the Prometheus text format.
+type metric interface {
+	write(w io.Writer)
+}
+
+// metricSet holds the metrics of a Syncer.
+type metricSet struct {
+	all []metric // every metric, in the order they're written
+
+	FilesAdded      *MetricVec
+	AddFailures     *MetricVec
+	BytesAdded      *MetricVec
+	AddLatency      *Histogram
+	Publishes       *MetricVec
+	PublishFailures *MetricVec
+	PublishLatency  *Histogram
+	LastPublish     *MetricVec
+	PinUpdates      *MetricVec
+	PinFailures     *MetricVec
+	PinLatency      *Histogram
+	WatcherEvents   *MetricVec
+}
+
+// MetricVec is a counter or gauge, optionally partitioned by a single label.
+type MetricVec struct {
+	name   string
+	help   string
+	kind   string // "counter" or "gauge"
+	label  string // empty if unlabelled
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+func (ms *metricSet) newMetricVec(kind, name, help, label string) *MetricVec {
+	mv := &MetricVec{name: name, help: help, kind: kind, label: label, values: make(map[string]float64)}
+	ms.all = append(ms.all, mv)
+	return mv
+}
+
+// Add adds v to the value for label.
+func (mv *MetricVec) Add(label string, v float64) {
+	mv.lock.Lock()
+	mv.values[label] += v
+	mv.lock.Unlock()
+}
+
+// Inc increments the value for label.
+func (mv *MetricVec) Inc(label string) {
+	mv.Add(label, 1)
+}
+
+// Set sets the value for label, for gauges.
+func (mv *MetricVec) Set(label string, v float64) {
+	mv.lock.Lock()
+	mv.values[label] = v
+	mv.lock.Unlock()
+}
+
+func (mv *MetricVec) write(w io.Writer) {
+	mv.lock.Lock()
+	defer mv.lock.Unlock()
+	writeHeader(w, mv.name, mv.help, mv.kind)
+	if mv.label == "" {
+		fmt.Fprintf(w, "%s %s\n", mv.name, formatFloat(mv.values[""]))
+		return
+	}
+	labels := make([]string, 0, len(mv.values))
+	for label := range mv.values {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		fmt.Fprintf(w, "%s{%s=%s} %s\n", mv.name, mv.label, strconv.Quote(label), formatFloat(mv.values[label]))
+	}
+}
+
+// GaugeFunc is a gauge partitioned by a single label, with values computed when it's written.
+type GaugeFunc struct {
+	name  string
+	help  string
+	label string
+	fn    func() map[string]float64
+}
+
+func (ms *metricSet) newGaugeFunc(name, help, label string, fn func() map[string]float64) *GaugeFunc {
+	gf := &GaugeFunc{name: name, help: help, label: label, fn: fn}
+	ms.all = append(ms.all, gf)
+	return gf
+}
+
+func (gf *GaugeFunc) write(w io.Writer) {
+	values := gf.fn()
+	writeHeader(w, gf.name, gf.help, "gauge")
+	labels := make([]string, 0, len(values))
+	for label := range values {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		fmt.Fprintf(w, "%s{%s=%s} %s\n", gf.name, gf.label, strconv.Quote(label), formatFloat(values[label]))
+	}
+}
+
+// Histogram counts observations into buckets.
+type Histogram struct {
+	name    string
+	help    string
+	buckets []float64 // upper bounds, sorted
+	lock    sync.Mutex
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func (ms *metricSet) newHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	ms.all = append(ms.all, h)
+	return h
+}
+
+// Observe adds v to the histogram.
+func (h *Histogram) Observe(v float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// Since observes the seconds passed since start.
+func (h *Histogram) Since(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatFloat(bound), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, strings.ReplaceAll(help, "\n", " "), name, kind)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// latencyBuckets are used for every latency histogram, in seconds.
+var latencyBuckets = []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// newMetricSet returns the metrics for s.
+func newMetricSet(s *Syncer) *metricSet {
+	ms := new(metricSet)
+	ms.FilesAdded = ms.newMetricVec("counter", "ipfs_sync_files_added_total", "Files added to the MFS.", "")
+	ms.AddFailures = ms.newMetricVec("counter", "ipfs_sync_add_failures_total", "Files which failed to be added to the MFS.", "")
+	ms.BytesAdded = ms.newMetricVec("counter", "ipfs_sync_added_bytes_total", "Bytes streamed to the IPFS node by add requests.", "")
+	ms.AddLatency = ms.newHistogram("ipfs_sync_add_duration_seconds", "Time taken to add a file and copy it into the MFS.", latencyBuckets)
+	ms.Publishes = ms.newMetricVec("counter", "ipfs_sync_publishes_total", "IPNS publishes, by dir ID.", "id")
+	ms.PublishFailures = ms.newMetricVec("counter", "ipfs_sync_publish_failures_total", "Failed IPNS publishes, by dir ID.", "id")
+	ms.PublishLatency = ms.newHistogram("ipfs_sync_publish_duration_seconds", "Time taken to publish to IPNS.", latencyBuckets)
+	ms.LastPublish = ms.newMetricVec("gauge", "ipfs_sync_last_publish_timestamp_seconds", "Unix time of the last successful publish, by dir ID.", "id")
+	ms.PinUpdates = ms.newMetricVec("counter", "ipfs_sync_pin_updates_total", "Pin updates, by dir ID.", "id")
+	ms.PinFailures = ms.newMetricVec("counter", "ipfs_sync_pin_update_failures_total", "Failed pin updates, by dir ID.", "id")
+	ms.PinLatency = ms.newHistogram("ipfs_sync_pin_update_duration_seconds", "Time taken to update the local pin.", latencyBuckets)
+	ms.WatcherEvents = ms.newMetricVec("counter", "ipfs_sync_fsnotify_events_total", "Filesystem events received, by operation.", "op")
+
+	ms.newGaugeFunc("ipfs_sync_queue_depth", "Files waiting to be added, by dir ID.", "id", func() map[string]float64 {
+		values := make(map[string]float64)
+		for _, dk := range s.Dirs() {
+			if queue := dk.Queue(); queue != nil {
+				values[dk.ID] = float64(queue.Len())
+			}
+		}
+		return values
+	})
+	ms.newGaugeFunc("ipfs_sync_watched_directories", "Directories being watched for changes, by dir ID.", "id", func() map[string]float64 {
+		values := make(map[string]float64)
+		for _, dk := range s.Dirs() {
+			values[dk.ID] = float64(dk.Watched())
+		}
+		return values
+	})
+	return ms
+}
+
+// WriteMetrics writes every metric in the Prometheus text format.
+func (s *Syncer) WriteMetrics(w io.Writer) {
+	for _, m := range s.metrics.all {
+		m.write(w)
+	}
+}
+
+// MetricsHandler returns a handler serving every metric in the Prometheus text format.
+func (s *Syncer) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		s.WriteMetrics(w)
+	})
+}
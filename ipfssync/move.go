@@ -0,0 +1,108 @@
+package ipfssync
+
+import (
+	"bytes"
+	"os"
+	"sync"
+	"time"
+)
+
+// MoveWindow is how long a renamed path waits for a matching create event before it's treated as removed.
+const MoveWindow = time.Second
+
+// fileID identifies a file or directory on disk, so it can be recognized after it's been renamed.
+type fileID struct {
+	inode uint64
+	isDir bool
+}
+
+// pendingMove is a path that was renamed away, waiting to see if it reappears elsewhere.
+type pendingMove struct {
+	diskPath string
+	mfsPath  string
+	id       fileID
+	hash     *FileHash // copy of the FileHash at the time of the rename, nil for directories
+	queued   []string  // paths with changes that hadn't been added yet at the time of the rename
+
+	owner   chan *pendingMove // watcher that saw the rename, notified once the move is resolved
+	claimed bool              // true if the path was moved in MFS, false if it should be removed
+	timer   *time.Timer
+}
+
+// moveTracker holds pending moves, shared by every watcher so paths can be moved between dirs.
+type moveTracker struct {
+	lock    sync.Mutex
+	pending []*pendingMove
+}
+
+// stash holds onto pm for MoveWindow, after which it's sent back to pm.owner unclaimed. Does nothing, returning false,
+// if pm.diskPath is already pending.
+func (mt *moveTracker) stash(pm *pendingMove) bool {
+	mt.lock.Lock()
+	defer mt.lock.Unlock()
+	for _, p := range mt.pending {
+		if p.diskPath == pm.diskPath {
+			return false
+		}
+	}
+	pm.timer = time.AfterFunc(MoveWindow, func() {
+		if mt.unstash(pm) {
+			pm.owner <- pm
+		}
+	})
+	mt.pending = append(mt.pending, pm)
+	return true
+}
+
+// unstash removes pm from the pending list, returning false if it was already gone.
+func (mt *moveTracker) unstash(pm *pendingMove) bool {
+	mt.lock.Lock()
+	defer mt.lock.Unlock()
+	for i, p := range mt.pending {
+		if p == pm {
+			mt.pending = append(mt.pending[:i], mt.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// claim looks for a pending move matching the file at fpath, removing it from the pending list and returning it if
+// found. Matches are made by inode, or if that's unavailable, by the hash stored in the DB.
+func (mt *moveTracker) claim(fpath string, fi os.FileInfo, dontHash bool) *pendingMove {
+	id := fileID{inode: getInode(fi), isDir: fi.IsDir()}
+	var fakeHash, hash []byte
+	mt.lock.Lock()
+	defer mt.lock.Unlock()
+	for i, pm := range mt.pending {
+		if pm.id.isDir != id.isDir {
+			continue
+		}
+		if id.inode == 0 || pm.id.inode == 0 {
+			// fall back on comparing hashes, only possible for files we've seen before
+			if pm.hash == nil || id.isDir {
+				continue
+			}
+			if fakeHash == nil {
+				fakeHash = GetHashValue(fpath, true)
+			}
+			if !bytes.Equal(fakeHash, pm.hash.FakeHash) {
+				continue
+			}
+			if pm.hash.Hash != nil && !dontHash {
+				if hash == nil {
+					hash = GetHashValue(fpath, false)
+				}
+				if !bytes.Equal(hash, pm.hash.Hash) {
+					continue
+				}
+			}
+		} else if pm.id.inode != id.inode {
+			continue
+		}
+		pm.timer.Stop()
+		mt.pending = append(mt.pending[:i], mt.pending[i+1:]...)
+		return pm
+	}
+	return nil
+}
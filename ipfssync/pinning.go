@@ -0,0 +1,315 @@
+package ipfssync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// EstuaryEndPoint is the Pinning Services API end point used for the legacy EstuaryAPIKey setting.
+const EstuaryEndPoint = "https://api.estuary.tech/pinning"
+
+// Pin statuses, as defined by the Pinning Services API spec.
+const (
+	PinQueued  = "queued"
+	PinPinning = "pinning"
+	PinPinned  = "pinned"
+	PinFailed  = "failed"
+)
+
+var (
+	// PinStatusPoll is how often to check a pin's status while waiting for it to finish.
+	PinStatusPoll = time.Second * 10
+	// PinStatusTimeout is how long to keep polling a pin's status before giving up.
+	PinStatusTimeout = time.Hour
+)
+
+// PinningService is a remote pinning service implementing the IPFS Pinning Services API
+// (https://ipfs.github.io/pinning-services-api-spec/), it's used in the `PinningServices` config parameter.
+type PinningService struct {
+	Name     string `yaml:"Name"`
+	EndPoint string `yaml:"EndPoint"`
+	Token    string `yaml:"Token"`
+
+	timeout time.Duration // longest time to wait for a request, set by the Syncer
+}
+
+// RemotePin is an object the pinning service should pin.
+type RemotePin struct {
+	Cid     string            `json:"cid"`
+	Name    string            `json:"name,omitempty"`
+	Origins []string          `json:"origins,omitempty"`
+	Meta    map[string]string `json:"meta,omitempty"`
+}
+
+// RemotePinStatus is the status of a pin request.
+type RemotePinStatus struct {
+	RequestID string     `json:"requestid"`
+	Status    string     `json:"status"`
+	Created   time.Time  `json:"created"`
+	Pin       *RemotePin `json:"pin"`
+	Delegates []string   `json:"delegates"`
+}
+
+// RemotePinResults is returned when listing pins.
+type RemotePinResults struct {
+	Count   int                `json:"count"`
+	Results []*RemotePinStatus `json:"results"`
+}
+
+// PinningError is an error returned by a pinning service.
+type PinningError struct {
+	Status int `json:"-"` // HTTP status code
+	Err    struct {
+		Reason  string `json:"reason"`
+		Details string `json:"details"`
+	} `json:"error"`
+}
+
+// Error outputs the reason and details of the error, satisfies error interface.
+func (pe *PinningError) Error() string {
+	txt := pe.Err.Reason
+	if txt == "" {
+		txt = http.StatusText(pe.Status)
+	}
+	if pe.Err.Details != "" {
+		txt += ": " + pe.Err.Details
+	}
+	return txt
+}
+
+// doRequest does an API request to the pinning service, decoding the response into out if it isn't nil. It gives up
+// when ctx is done.
+func (ps *PinningService) doRequest(ctx context.Context, method, cmd string, in, out interface{}) error {
+	if ps.Token == "" {
+		return errors.New("pinning service token is blank")
+	}
+	if ps.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ps.timeout)
+		defer cancel()
+	}
+
+	var body *bytes.Buffer
+	if in != nil {
+		jsonData, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewBuffer(jsonData)
+	} else {
+		body = new(bytes.Buffer)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(ps.EndPoint, "/")+"/"+cmd, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Authorization", "Bearer "+ps.Token)
+	req.Header.Add("Content-Type", "application/json")
+
+	c := &http.Client{}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		pinErr := &PinningError{Status: resp.StatusCode}
+		json.Unmarshal(respBody, pinErr)
+		return pinErr
+	}
+	if out != nil {
+		return json.Unmarshal(respBody, out)
+	}
+	return nil
+}
+
+// ListPins lists pins matching the given CIDs and name, either of which may be empty. If no statuses are given, only
+// pinned objects are listed.
+func (ps *PinningService) ListPins(ctx context.Context, cids []string, name string, statuses ...string) (*RemotePinResults, error) {
+	query := url.Values{}
+	if len(cids) > 0 {
+		query.Set("cid", strings.Join(cids, ","))
+	}
+	if name != "" {
+		query.Set("name", name)
+	}
+	if len(statuses) > 0 {
+		query.Set("status", strings.Join(statuses, ","))
+	}
+	results := new(RemotePinResults)
+	err := ps.doRequest(ctx, "GET", "pins?"+query.Encode(), nil, results)
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// AddPin asks the service to pin cid.
+func (ps *PinningService) AddPin(ctx context.Context, cid, name string) (*RemotePinStatus, error) {
+	status := new(RemotePinStatus)
+	err := ps.doRequest(ctx, "POST", "pins", &RemotePin{Cid: cid, Name: name}, status)
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// GetPin gets the status of the pin request requestID.
+func (ps *PinningService) GetPin(ctx context.Context, requestID string) (*RemotePinStatus, error) {
+	status := new(RemotePinStatus)
+	err := ps.doRequest(ctx, "GET", "pins/"+url.PathEscape(requestID), nil, status)
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// ReplacePin replaces the object pinned by requestID with cid.
+func (ps *PinningService) ReplacePin(ctx context.Context, requestID, cid, name string) (*RemotePinStatus, error) {
+	status := new(RemotePinStatus)
+	err := ps.doRequest(ctx, "POST", "pins/"+url.PathEscape(requestID), &RemotePin{Cid: cid, Name: name}, status)
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// RemovePin removes the pin request requestID.
+func (ps *PinningService) RemovePin(ctx context.Context, requestID string) error {
+	return ps.doRequest(ctx, "DELETE", "pins/"+url.PathEscape(requestID), nil, nil)
+}
+
+// WaitForPin polls the status of the pin request requestID until it's pinned, failed, PinStatusTimeout has passed,
+// or ctx is done.
+func (ps *PinningService) WaitForPin(ctx context.Context, requestID string) (*RemotePinStatus, error) {
+	deadline := time.Now().Add(PinStatusTimeout)
+	for {
+		status, err := ps.GetPin(ctx, requestID)
+		if err != nil {
+			return nil, err
+		}
+		if status.Status == PinPinned || status.Status == PinFailed {
+			return status, nil
+		}
+		if time.Now().After(deadline) {
+			return status, fmt.Errorf("timed out waiting for pin, status is '%s'", status.Status)
+		}
+		select {
+		case <-ctx.Done():
+			return status, ctx.Err()
+		case <-time.After(PinStatusPoll):
+		}
+	}
+}
+
+// UpdatePin replaces the pin of oldcid with newcid, pinning newcid if oldcid is empty or isn't pinned.
+func (ps *PinningService) UpdatePin(ctx context.Context, oldcid, newcid, name string) (*RemotePinStatus, error) {
+	if oldcid == "" {
+		return ps.AddPin(ctx, newcid, name)
+	}
+	results, err := ps.ListPins(ctx, []string{oldcid}, "", PinQueued, PinPinning, PinPinned, PinFailed)
+	if err != nil {
+		return nil, err
+	}
+	for _, result := range results.Results {
+		if result.Pin != nil && result.Pin.Cid == oldcid {
+			return ps.ReplacePin(ctx, result.RequestID, newcid, name)
+		}
+	}
+	return ps.AddPin(ctx, newcid, name)
+}
+
+// pinWatch is a watchPin running in the background.
+type pinWatch struct {
+	cancel context.CancelFunc
+}
+
+// watchPin logs the outcome of the pin request for cid on ps in the background, until Stop is called. Any earlier
+// watch for dk on ps is cancelled, as its root has been replaced.
+func (s *Syncer) watchPin(dk *DirKey, ps *PinningService, status *RemotePinStatus, cid string) {
+	ctx, cancel := context.WithCancel(s.Context())
+	watch := &pinWatch{cancel: cancel}
+	dk.lock.Lock()
+	if dk.pinWatches == nil {
+		dk.pinWatches = make(map[string]*pinWatch)
+	}
+	if old := dk.pinWatches[ps.Name]; old != nil {
+		old.cancel()
+	}
+	dk.pinWatches[ps.Name] = watch
+	dk.lock.Unlock()
+	go func() {
+		defer func() {
+			cancel()
+			dk.lock.Lock()
+			if dk.pinWatches[ps.Name] == watch {
+				delete(dk.pinWatches, ps.Name)
+			}
+			dk.lock.Unlock()
+		}()
+		status, err := ps.WaitForPin(ctx, status.RequestID)
+		if errors.Is(err, context.Canceled) { // replaced by a newer root, or stopped
+			return
+		} else if err != nil {
+			s.error(dk, fmt.Errorf("error checking status of %s on %s: %w", cid, ps.Name, err))
+			return
+		}
+		if status.Status == PinFailed {
+			s.error(dk, fmt.Errorf("%s failed to pin %s", ps.Name, cid))
+		} else if s.opt().Verbose {
+			s.log.Printf("%s pinned %s\n", ps.Name, cid)
+		}
+	}()
+}
+
+// dirServices returns the pinning services dk should be pinned to.
+func (s *Syncer) dirServices(dk *DirKey) []*PinningService {
+	all := s.services.Load().(map[string]*PinningService)
+	services := make([]*PinningService, 0, len(dk.PinningServices))
+	for _, name := range dk.PinningServices {
+		ps := all[name]
+		if ps == nil {
+			s.error(dk, fmt.Errorf("pinning service '%s' isn't configured", name))
+			continue
+		}
+		services = append(services, ps)
+	}
+	return services
+}
+
+// pinRemote pins cid to every pinning service used by dk.
+func (s *Syncer) pinRemote(dk *DirKey, cid, name string) {
+	for _, ps := range s.dirServices(dk) {
+		status, err := ps.AddPin(s.Context(), cid, name)
+		if err != nil {
+			s.error(dk, fmt.Errorf("error pinning to %s: %w", ps.Name, err))
+			continue
+		}
+		s.watchPin(dk, ps, status, cid)
+	}
+}
+
+// updatePinRemote replaces the pin of oldcid with newcid on every pinning service used by dk.
+func (s *Syncer) updatePinRemote(dk *DirKey, oldcid, newcid, name string) {
+	for _, ps := range s.dirServices(dk) {
+		status, err := ps.UpdatePin(s.Context(), oldcid, newcid, name)
+		if err != nil {
+			s.error(dk, fmt.Errorf("error updating pin on %s: %w", ps.Name, err))
+			continue
+		}
+		s.watchPin(dk, ps, status, newcid)
+	}
+}
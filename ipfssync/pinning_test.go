@@ -0,0 +1,55 @@
+package ipfssync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPinningService(t *testing.T) {
+	var lock sync.Mutex
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests = append(requests, r.Method+" "+r.URL.String())
+		lock.Unlock()
+		status := &RemotePinStatus{RequestID: "1", Status: PinQueued}
+		if r.Method == http.MethodPost {
+			status.Pin = new(RemotePin)
+			json.NewDecoder(r.Body).Decode(status.Pin)
+		}
+		json.NewEncoder(w).Encode(status)
+	}))
+	defer srv.Close()
+	ps := &PinningService{Name: "test", EndPoint: srv.URL, Token: "token"}
+
+	// with nothing to replace, the new root is pinned without looking for the old one
+	status, err := ps.UpdatePin(context.Background(), "", "bafynew", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Pin == nil || status.Pin.Cid != "bafynew" {
+		t.Error("Pinned", status.Pin, "instead of bafynew")
+	}
+	lock.Lock()
+	if len(requests) != 1 || requests[0] != "POST /pins" {
+		t.Error("Unexpected requests:", requests)
+	}
+	lock.Unlock()
+
+	// waiting for a pin stops as soon as ctx is done
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	start := time.Now()
+	if _, err := ps.WaitForPin(ctx, "1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("Waiting for a pin returned", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Waiting for a pin didn't stop when ctx was done")
+	}
+}
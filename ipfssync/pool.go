@@ -0,0 +1,90 @@
+package ipfssync
+
+import (
+	"fmt"
+	"time"
+)
+
+// AddJob is a file waiting to be added by AddFiles, the fields match the arguments of AddFile.
+type AddJob struct {
+	From      string
+	To        string
+	MakeDir   bool
+	Overwrite bool
+}
+
+type addTask struct {
+	job  *AddJob
+	hash *HashStruct
+	err  error
+	took time.Duration
+	done chan bool
+}
+
+// AddFiles adds every job to the MFS for dk, streaming up to dk.Concurrency files to IPFS at once (and no more than
+// Options.Concurrency across all directories). Files are copied into the MFS one at a time in the same order as jobs,
+// so the resulting tree is identical to adding them sequentially. If done isn't nil, it's called in order after each
+// job.
+func (s *Syncer) AddFiles(dk *DirKey, jobs []*AddJob, done func(job *AddJob, err error)) {
+	if s.opt().Guard {
+		jobs = s.guardJobs(dk, jobs)
+	}
+	dk.beginAdd()
+	defer dk.endAdd()
+	ctx := s.Context()
+	nocopy := dk.Nocopy
+	workers := dk.Concurrency
+	if workers < 1 || workers > cap(s.addSlots) {
+		workers = cap(s.addSlots)
+	}
+
+	// order is buffered so adds can get ahead of the MFS copies, but not unboundedly so.
+	order := make(chan *addTask, workers*2)
+	tasks := make(chan *addTask)
+	go func() {
+		for _, job := range jobs {
+			task := &addTask{job: job, done: make(chan bool, 1)}
+			order <- task
+			tasks <- task
+		}
+		close(order)
+		close(tasks)
+	}()
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for task := range tasks {
+				s.addSlots <- struct{}{}
+				s.log.Println("Adding file from", task.job.From, "to", s.basePath+task.job.To, "...")
+				start := time.Now()
+				task.hash, task.err = s.ipfsAdd(ctx, task.job.From, nocopy, false, dk.crypt)
+				task.took = time.Since(start)
+				<-s.addSlots
+				task.done <- true
+			}
+		}()
+	}
+
+	for task := range order {
+		<-task.done
+		start := time.Now()
+		err := task.err
+		if err == nil {
+			err = s.CopyFile(ctx, task.hash.Hash, task.job.From, task.job.To, nocopy, task.job.MakeDir, task.job.Overwrite)
+		}
+		s.metrics.AddLatency.Observe((task.took + time.Since(start)).Seconds())
+		if err != nil {
+			s.metrics.AddFailures.Inc("")
+			s.error(dk, fmt.Errorf("error adding file: %w", err))
+		} else {
+			s.metrics.FilesAdded.Inc("")
+			dk.addChanges(1, 0, 0)
+			if onFileAdded := s.opt().OnFileAdded; onFileAdded != nil {
+				onFileAdded(dk, task.job.From, task.hash.Hash)
+			}
+		}
+		if done != nil {
+			done(task.job, err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package ipfssync
+
+import (
+	"bytes"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventQueue coalesces file events per path, holding onto each path until it's been quiet for a while, and its size
+// and modification time have settled.
+type EventQueue struct {
+	lock  sync.Mutex
+	items map[string]*queuedPath
+}
+
+type queuedPath struct {
+	overwrite bool
+	lastEvent time.Time
+	stat      []byte // size and modification time, as returned by GetHashValue
+	statSince time.Time
+}
+
+// QueuedPath is a path which is ready to be added.
+type QueuedPath struct {
+	Path      string
+	Overwrite bool
+}
+
+// NewEventQueue returns an empty EventQueue.
+func NewEventQueue() *EventQueue {
+	return &EventQueue{items: make(map[string]*queuedPath)}
+}
+
+// Push queues path to be added, or resets its quiet period if it's already queued.
+func (q *EventQueue) Push(path string, overwrite bool) {
+	now := time.Now()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	item := q.items[path]
+	if item == nil {
+		item = &queuedPath{stat: GetHashValue(path, true), statSince: now}
+		q.items[path] = item
+	}
+	item.overwrite = item.overwrite || overwrite
+	item.lastEvent = now
+}
+
+// Take removes path, and anything queued under it, from the queue, returning the paths removed.
+func (q *EventQueue) Take(path string) []string {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	var taken []string
+	for p := range q.items {
+		if p == path || strings.HasPrefix(p, path+string(os.PathSeparator)) {
+			delete(q.items, p)
+			taken = append(taken, p)
+		}
+	}
+	return taken
+}
+
+// Ready removes and returns every path which has gone without events for quiet, and whose size and modification time
+// haven't changed for settle, sorted by path. Paths which no longer exist are dropped.
+func (q *EventQueue) Ready(quiet, settle time.Duration) []*QueuedPath {
+	now := time.Now()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	var ready []*QueuedPath
+	for path, item := range q.items {
+		if now.Sub(item.lastEvent) < quiet {
+			continue
+		}
+		stat := GetHashValue(path, true)
+		if stat == nil {
+			delete(q.items, path)
+			continue
+		}
+		if !bytes.Equal(stat, item.stat) {
+			item.stat = stat
+			item.statSince = now
+		}
+		if now.Sub(item.statSince) < settle {
+			continue
+		}
+		delete(q.items, path)
+		ready = append(ready, &QueuedPath{Path: path, Overwrite: item.overwrite})
+	}
+	sort.Slice(ready, func(i, j int) bool { return ready[i].Path < ready[j].Path })
+	return ready
+}
+
+// Paths returns every path waiting in the queue, sorted.
+func (q *EventQueue) Paths() []string {
+	q.lock.Lock()
+	paths := make([]string, 0, len(q.items))
+	for path := range q.items {
+		paths = append(paths, path)
+	}
+	q.lock.Unlock()
+	sort.Strings(paths)
+	return paths
+}
+
+// Len returns the amount of paths waiting in the queue.
+func (q *EventQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.items)
+}
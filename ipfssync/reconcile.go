@@ -0,0 +1,84 @@
+package ipfssync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// reconcileDir removes anything from the DB and MFS that no longer exists in dk.Dir, so files deleted while ipfs-sync
+// wasn't running don't keep getting published. onDisk should contain the full path of every file being synced in dk.Dir.
+func (s *Syncer) reconcileDir(dk *DirKey, onDisk map[string]bool) {
+	if s.opt().Verbose {
+		s.log.Println("Reconciling", dk.Dir, "...")
+	}
+	s.reconcileMFS(dk, dk.workPath(), dk.Dir, onDisk)
+	s.reconcileDB(dk, onDisk)
+	for path := range dk.Quarantined() {
+		if !onDisk[path] {
+			dk.unquarantine(path)
+		}
+	}
+}
+
+// reconcileMFS recursively walks mfsPath, removing every entry which doesn't have a counterpart in diskDir (or can't be
+// decrypted, if dk is encrypted). Directories which are now ignored are removed whole.
+func (s *Syncer) reconcileMFS(dk *DirKey, mfsPath, diskDir string, onDisk map[string]bool) {
+	entries, err := s.ListDir(s.Context(), mfsPath)
+	if err != nil {
+		if s.opt().Verbose {
+			s.log.Println("Error listing", s.basePath+mfsPath, ":", err)
+		}
+		return
+	}
+	for _, entry := range entries {
+		entryPath := mfsPath + "/" + entry.Name
+		name := entry.Name
+		if dk.crypt != nil {
+			name, _ = dk.crypt.DecryptName(name)
+		}
+		diskPath := filepath.Join(diskDir, name)
+		switch {
+		case dk.crypt != nil && entry.Name == EncryptionHeader && mfsPath == dk.workPath():
+			continue
+		case name == "": // couldn't be decrypted, so it's not from dk.Dir
+		case entry.Type == MFSDirType:
+			if fi, err := os.Stat(diskPath); err == nil && fi.IsDir() && !s.Ignored(dk, diskPath, true) {
+				s.reconcileMFS(dk, entryPath, diskPath, onDisk)
+				continue
+			}
+		case onDisk[diskPath]:
+			continue
+		}
+		s.log.Println("Removing", entryPath, "(no longer on disk, or ignored) ...")
+		if err := s.RemoveFile(s.Context(), entryPath); err != nil {
+			s.error(dk, fmt.Errorf("error removing %s: %w", entryPath, err))
+		} else {
+			dk.addChanges(0, 1, 0)
+		}
+	}
+}
+
+// reconcileDB deletes every record under dk.Dir that isn't in onDisk.
+func (s *Syncer) reconcileDB(dk *DirKey, onDisk map[string]bool) {
+	DB := s.DB
+	if DB == nil {
+		return
+	}
+	for _, prefix := range []string{"", "ts_"} {
+		iter := DB.NewIterator(util.BytesPrefix([]byte(prefix+dk.Dir)), nil)
+		for iter.Next() {
+			path := string(iter.Key()[len(prefix):])
+			if onDisk[path] {
+				continue
+			}
+			if s.opt().Verbose {
+				s.log.Println("Deleting", path, "from DB ...")
+			}
+			DB.Delete(iter.Key(), nil)
+		}
+		iter.Release()
+	}
+}
@@ -0,0 +1,129 @@
+package ipfssync
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// verifyFile returns an error if the file at fpath doesn't add as cid, with or without Nocopy (which changes how files
+// are laid out).
+func (s *Syncer) verifyFile(fpath, cid string) error {
+	var err error
+	for _, nocopy := range []bool{false, true} {
+		var hash *HashStruct
+		if hash, err = s.IPFSAddFile(s.Context(), fpath, nocopy, true); err == nil && hash.Hash == cid {
+			return nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error verifying %s: %w", cid, err)
+	}
+	return fmt.Errorf("contents don't match %s", cid)
+}
+
+// Restore writes the directory cid to target, or only the file or directory at subpath in it if subpath isn't empty,
+// verifying every file against its CID before it replaces anything. Returns how many files were restored. Files that
+// fail are reported with OnError and skipped.
+//
+// dk may be nil. If it isn't, cid should be a root of dk, and with a DB, every file restored to where it belongs in
+// dk.Dir becomes the MFS copy of it and has its hash recorded, so dk can be synced right away without adding
+// everything again.
+func (s *Syncer) Restore(dk *DirKey, cid, subpath, target string) (int, error) {
+	if dk != nil && dk.crypt != nil {
+		return 0, fmt.Errorf("'%s' is encrypted, use decrypt instead", dk.ID)
+	}
+	link := &LsLink{Hash: cid, Type: UnixFSDir}
+	var rel string
+	for _, name := range strings.Split(filepath.ToSlash(subpath), "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		links, err := s.Ls(s.Context(), "/ipfs/"+link.Hash)
+		if err != nil {
+			return 0, fmt.Errorf("error listing %s: %w", path.Join(cid, rel), err)
+		}
+		link = nil
+		for _, l := range links {
+			if l.Name == name {
+				link = l
+				break
+			}
+		}
+		if link == nil {
+			return 0, fmt.Errorf("%s isn't in %s", subpath, cid)
+		}
+		rel = path.Join(rel, name)
+	}
+	if dk != nil {
+		dk.workLock.Lock()
+		defer dk.workLock.Unlock()
+	}
+
+	r := &restore{dk: dk}
+	if link.Type == UnixFSDir {
+		if err := s.restoreDir(r, link.Hash, rel, target); err != nil {
+			return r.restored, err
+		}
+	} else {
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return 0, err
+		}
+		s.restoreFile(r, link.Hash, rel, filepath.Join(target, link.Name))
+	}
+	if r.failed > 0 {
+		return r.restored, fmt.Errorf("%d file(s) couldn't be restored", r.failed)
+	}
+	return r.restored, nil
+}
+
+// restore is the progress of a Restore.
+type restore struct {
+	dk       *DirKey
+	restored int
+	failed   int
+}
+
+// restoreDir writes the directory cid, at rel in the root being restored, to dir.
+func (s *Syncer) restoreDir(r *restore, cid, rel, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	links, err := s.Ls(s.Context(), "/ipfs/"+cid)
+	if err != nil {
+		return fmt.Errorf("error listing %s: %w", cid, err)
+	}
+	for _, link := range links {
+		if link.Name == "" || link.Name == "." || link.Name == ".." || strings.ContainsAny(link.Name, "/"+string(os.PathSeparator)) {
+			s.error(r.dk, fmt.Errorf("skipping '%s' in %s, it isn't a valid file name", link.Name, cid))
+			continue
+		}
+		diskPath := filepath.Join(dir, link.Name)
+		switch link.Type {
+		case UnixFSDir:
+			if err := s.restoreDir(r, link.Hash, path.Join(rel, link.Name), diskPath); err != nil {
+				return err
+			}
+		case UnixFSFile, UnixFSRaw:
+			s.restoreFile(r, link.Hash, path.Join(rel, link.Name), diskPath)
+		}
+	}
+	return nil
+}
+
+// restoreFile writes the file cid, at rel in the root being restored, to diskPath.
+func (s *Syncer) restoreFile(r *restore, cid, rel, diskPath string) {
+	s.log.Println("Restoring", diskPath, "...")
+	err := s.fetch(cid, diskPath, true)
+	if err == nil && r.dk != nil && s.DB != nil && diskPath == filepath.Join(r.dk.Dir, filepath.FromSlash(rel)) {
+		err = s.adopt(r.dk, diskPath, cid)
+	}
+	if err != nil {
+		s.error(r.dk, fmt.Errorf("error restoring %s: %w", diskPath, err))
+		r.failed++
+		return
+	}
+	r.restored++
+}
@@ -0,0 +1,200 @@
+package ipfssync
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"strings"
+	"time"
+)
+
+// DNS constants used by RFC2136Provider.
+const (
+	dnsOpUpdate = 5
+	dnsTypeSOA  = 6
+	dnsTypeTXT  = 16
+	dnsTypeTSIG = 250
+	dnsClassIN  = 1
+	dnsClassANY = 255
+)
+
+// dnsRcodes are the names of the response codes an update can fail with.
+var dnsRcodes = map[int]string{
+	1: "FORMERR", 2: "SERVFAIL", 3: "NXDOMAIN", 4: "NOTIMP", 5: "REFUSED",
+	6: "YXDOMAIN", 7: "YXRRSET", 8: "NXRRSET", 9: "NOTAUTH", 10: "NOTZONE",
+}
+
+// RFC2136Provider is a DNSLinkProvider which sends DNS UPDATE messages (RFC 2136) to a DNS server, optionally signed
+// with TSIG (RFC 8945). Responses aren't verified.
+type RFC2136Provider struct {
+	Server        string // host:port, the port defaults to 53
+	Zone          string
+	TTL           int
+	TSIGKey       string
+	TSIGSecret    string // base64
+	TSIGAlgorithm string // default hmac-sha256
+	Timeout       time.Duration
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// appendName appends name to msg in DNS wire format.
+func appendName(msg []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	return append(msg, 0)
+}
+
+// appendRR appends a resource record to msg.
+func appendRR(msg []byte, name string, rrtype, class uint16, ttl uint32, rdata []byte) []byte {
+	msg = appendName(msg, name)
+	msg = appendUint16(msg, rrtype)
+	msg = appendUint16(msg, class)
+	msg = appendUint32(msg, ttl)
+	msg = appendUint16(msg, uint16(len(rdata)))
+	return append(msg, rdata...)
+}
+
+// txtData returns the RDATA of a TXT record containing txt, split into strings of up to 255 bytes.
+func txtData(txt string) []byte {
+	var rdata []byte
+	for len(txt) > 255 {
+		rdata = append(append(rdata, 255), txt[:255]...)
+		txt = txt[255:]
+	}
+	return append(append(rdata, byte(len(txt))), txt...)
+}
+
+// updateMsg builds an update replacing every TXT record at the DNSLink name of domain with one pointing to path.
+func (rp *RFC2136Provider) updateMsg(id uint16, domain, path string) []byte {
+	name := dnslinkName(domain)
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], dnsOpUpdate<<11)
+	binary.BigEndian.PutUint16(msg[4:], 1) // zone
+	binary.BigEndian.PutUint16(msg[8:], 2) // updates
+	msg = appendName(msg, rp.Zone)
+	msg = appendUint16(msg, dnsTypeSOA)
+	msg = appendUint16(msg, dnsClassIN)
+	msg = appendRR(msg, name, dnsTypeTXT, dnsClassANY, 0, nil) // delete the RRset
+	msg = appendRR(msg, name, dnsTypeTXT, dnsClassIN, uint32(rp.TTL), txtData("dnslink="+path))
+	return msg
+}
+
+// sign appends a TSIG record to msg.
+func (rp *RFC2136Provider) sign(msg []byte, now time.Time) ([]byte, error) {
+	secret, err := base64.StdEncoding.DecodeString(rp.TSIGSecret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TSIG secret: %w", err)
+	}
+	algorithm := strings.ToLower(strings.TrimSuffix(rp.TSIGAlgorithm, "."))
+	var h func() hash.Hash
+	switch algorithm {
+	case "", "hmac-sha256":
+		algorithm, h = "hmac-sha256", sha256.New
+	case "hmac-sha512":
+		h = sha512.New
+	case "hmac-sha1":
+		h = sha1.New
+	default:
+		return nil, fmt.Errorf("unsupported TSIG algorithm '%s'", rp.TSIGAlgorithm)
+	}
+	keyName := strings.ToLower(rp.TSIGKey)
+
+	// time signed (48 bits) and fudge
+	timers := make([]byte, 8)
+	binary.BigEndian.PutUint16(timers[0:], uint16(now.Unix()>>32))
+	binary.BigEndian.PutUint32(timers[2:], uint32(now.Unix()))
+	binary.BigEndian.PutUint16(timers[6:], 300)
+
+	mac := hmac.New(h, secret)
+	mac.Write(msg)
+	vars := appendName(nil, keyName)
+	vars = appendUint16(vars, dnsClassANY)
+	vars = appendUint32(vars, 0)
+	vars = appendName(vars, algorithm)
+	vars = append(vars, timers...)
+	vars = append(vars, 0, 0, 0, 0) // error, other len
+	mac.Write(vars)
+	sum := mac.Sum(nil)
+
+	rdata := appendName(nil, algorithm)
+	rdata = append(rdata, timers...)
+	rdata = appendUint16(rdata, uint16(len(sum)))
+	rdata = append(rdata, sum...)
+	rdata = append(rdata, msg[0], msg[1]) // original ID
+	rdata = append(rdata, 0, 0, 0, 0)     // error, other len
+
+	binary.BigEndian.PutUint16(msg[10:], binary.BigEndian.Uint16(msg[10:])+1)
+	return appendRR(msg, keyName, dnsTypeTSIG, dnsClassANY, 0, rdata), nil
+}
+
+// SetDNSLink sends an update to the server, replacing the TXT records at _dnslink.<domain>.
+func (rp *RFC2136Provider) SetDNSLink(domain, path string) error {
+	var idBytes [2]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+	msg := rp.updateMsg(id, domain, path)
+	if rp.TSIGKey != "" {
+		var err error
+		if msg, err = rp.sign(msg, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	server := rp.Server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	timeout := rp.Timeout
+	if timeout <= 0 {
+		timeout = time.Second * 10
+	}
+	conn, err := net.DialTimeout("udp", server, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+	resp := make([]byte, 512)
+	for {
+		n, err := conn.Read(resp)
+		if err != nil {
+			return err
+		}
+		if n < 12 || binary.BigEndian.Uint16(resp) != id {
+			continue // not ours
+		}
+		if rcode := int(resp[3] & 0xf); rcode != 0 {
+			if name, ok := dnsRcodes[rcode]; ok {
+				return errors.New("DNS update failed: " + name)
+			}
+			return fmt.Errorf("DNS update failed: rcode %d", rcode)
+		}
+		return nil
+	}
+}
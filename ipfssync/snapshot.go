@@ -0,0 +1,179 @@
+package ipfssync
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// SnapshotDir is the MFS directory, relative to BasePath, snapshots are exposed under when RetentionPolicy.Expose is
+// true. Each snapshot is at SnapshotDir/<ID>/<timestamp>.
+const SnapshotDir = ".snapshots"
+
+// RetentionPolicy decides which roots of a dir are kept pinned as snapshots, instead of being unpinned when the dir is
+// published again. A root is kept if any of the rules keep it, the current root counts too. Requires a DB.
+type RetentionPolicy struct {
+	Last   int  `yaml:"Last"`   // keep the last N roots
+	Hourly int  `yaml:"Hourly"` // keep the last root of each of the last N hours anything was published in
+	Daily  int  `yaml:"Daily"`  // same for days
+	Weekly int  `yaml:"Weekly"` // same for weeks
+	Expose bool `yaml:"Expose"` // copy snapshots into the MFS under SnapshotDir
+}
+
+// Snapshot is a root of a dir which is being kept pinned.
+type Snapshot struct {
+	Time time.Time
+	CID  string
+}
+
+// Name returns the name of the snapshot under SnapshotDir/<ID>.
+func (snap *Snapshot) Name() string {
+	return snap.Time.UTC().Format("2006-01-02T150405.000Z")
+}
+
+// keep returns the records rp keeps, newest first. records should be oldest first, like History returns them.
+func (rp *RetentionPolicy) keep(records []*PublishRecord) []*PublishRecord {
+	buckets := []struct {
+		n   int
+		key func(t time.Time) string
+	}{
+		{rp.Last, func(t time.Time) string { return t.String() }},
+		{rp.Hourly, func(t time.Time) string { return t.Format("2006-01-02 15") }},
+		{rp.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{rp.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%d", year, week)
+		}},
+	}
+	kept := make(map[*PublishRecord]bool)
+	for _, bucket := range buckets {
+		seen := make(map[string]bool)
+		for i := len(records) - 1; i >= 0 && len(seen) < bucket.n; i-- {
+			key := bucket.key(records[i].Time)
+			if !seen[key] {
+				seen[key] = true
+				kept[records[i]] = true
+			}
+		}
+	}
+	keep := make([]*PublishRecord, 0, len(kept))
+	for i := len(records) - 1; i >= 0; i-- {
+		if kept[records[i]] {
+			keep = append(keep, records[i])
+		}
+	}
+	return keep
+}
+
+// snapshotsKey returns the DB key the snapshots of id are stored under.
+func snapshotsKey(id string) []byte {
+	return []byte("snapshots/" + id)
+}
+
+// Snapshots returns the roots of the dir with the given ID that are being kept pinned, newest first.
+func (s *Syncer) Snapshots(id string) ([]*Snapshot, error) {
+	if s.DB == nil {
+		return nil, nil
+	}
+	data, err := s.DB.Get(snapshotsKey(id), nil)
+	if err != nil {
+		return nil, nil // none yet
+	}
+	var snaps []*Snapshot
+	err = json.Unmarshal(data, &snaps)
+	return snaps, err
+}
+
+// pinRoot pins cid as the new root of dk, unpinning oldCID unless the retention policy of dk might keep it.
+func (s *Syncer) pinRoot(dk *DirKey, oldCID, cid string) error {
+	if oldCID == "" || dk.Retain != nil {
+		return s.Pin(s.Context(), cid)
+	}
+	return s.UpdatePin(s.Context(), oldCID, cid, dk.Nocopy)
+}
+
+// applyRetention pins every root the retention policy of dk keeps, and unpins (and removes from the MFS) any snapshot
+// it no longer keeps. oldCID is the root dk was published as before, which pinRoot left pinned.
+func (s *Syncer) applyRetention(dk *DirKey, oldCID string) {
+	if dk.Retain == nil || s.DB == nil {
+		return
+	}
+	records, err := s.History(dk.ID)
+	if err != nil {
+		s.error(dk, fmt.Errorf("error loading publish history: %w", err))
+		return
+	}
+	current := dk.GetCID()
+	old, err := s.Snapshots(dk.ID)
+	if err != nil {
+		s.error(dk, fmt.Errorf("error loading snapshots: %w", err))
+	}
+	pinned := make(map[string]bool, len(old))
+	for _, snap := range old {
+		pinned[snap.CID] = true
+	}
+
+	snaps := make([]*Snapshot, 0)
+	keep := make(map[string]bool)
+	for _, record := range dk.Retain.keep(records) {
+		if keep[record.CID] { // republished, or rolled back to
+			continue
+		}
+		keep[record.CID] = true
+		snap := &Snapshot{Time: record.Time, CID: record.CID}
+		snaps = append(snaps, snap)
+		if !pinned[snap.CID] {
+			if s.opt().Verbose {
+				s.log.Println("Pinning snapshot", snap.CID, "of", dk.ID, "...")
+			}
+			if err := s.Pin(s.Context(), snap.CID); err != nil {
+				s.error(dk, fmt.Errorf("error pinning snapshot %s: %w", snap.CID, err))
+			}
+			pinned[snap.CID] = true
+		}
+		if dk.Retain.Expose {
+			dir := SnapshotDir + "/" + dk.ID
+			if s.GetFileCID(s.Context(), dir+"/"+snap.Name()) != snap.CID {
+				s.RemoveFile(s.Context(), dir+"/"+snap.Name())
+				if err := s.MakeDir(s.Context(), dir); err == nil {
+					err = s.CopyCID(s.Context(), snap.CID, dir+"/"+snap.Name())
+				}
+				if err != nil {
+					s.error(dk, fmt.Errorf("error exposing snapshot %s: %w", snap.CID, err))
+				}
+			}
+		}
+	}
+	for _, snap := range old {
+		if dk.Retain.Expose && !containsSnapshot(snaps, snap) {
+			s.RemoveFile(s.Context(), SnapshotDir+"/"+dk.ID+"/"+snap.Name())
+		}
+		if keep[snap.CID] || (snap.CID == current && dk.Pin) {
+			continue
+		}
+		keep[snap.CID] = true // only unpin once
+		s.log.Println("Pruning snapshot", snap.CID, "of", dk.ID, "...")
+		if err := s.Unpin(s.Context(), snap.CID); err != nil {
+			s.error(dk, fmt.Errorf("error unpinning snapshot %s: %w", snap.CID, err))
+		}
+	}
+	if dk.Pin && oldCID != "" && !keep[oldCID] && oldCID != current {
+		if err := s.Unpin(s.Context(), oldCID); err != nil {
+			s.error(dk, fmt.Errorf("error unpinning %s: %w", oldCID, err))
+		}
+	}
+
+	jsonData, _ := json.Marshal(snaps)
+	if err := s.DB.Put(snapshotsKey(dk.ID), jsonData, nil); err != nil {
+		s.error(dk, fmt.Errorf("error saving snapshots: %w", err))
+	}
+}
+
+func containsSnapshot(snaps []*Snapshot, snap *Snapshot) bool {
+	for _, s := range snaps {
+		if s.CID == snap.CID && s.Time.Equal(snap.Time) {
+			return true
+		}
+	}
+	return false
+}
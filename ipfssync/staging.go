@@ -0,0 +1,110 @@
+package ipfssync
+
+import (
+	"errors"
+	"fmt"
+)
+
+// StagingDir is the MFS directory, relative to BasePath, changes to dirs with Atomic set are made under. Each dir is
+// staged at StagingDir/<MFSPath>, and copied to MFSPath once it's settled.
+const StagingDir = ".staging"
+
+// workPath returns the MFS path changes to dk are made in, which is its staging copy if dk is Atomic.
+func (dk *DirKey) workPath() string {
+	if dk.Atomic {
+		return StagingDir + "/" + dk.MFSPath
+	}
+	return dk.MFSPath
+}
+
+// beginAdd records that a batch of files is being added to dk.
+func (dk *DirKey) beginAdd() {
+	dk.lock.Lock()
+	dk.adding++
+	dk.addGen++
+	dk.lock.Unlock()
+}
+
+// endAdd records that a batch of files started with beginAdd is done.
+func (dk *DirKey) endAdd() {
+	dk.lock.Lock()
+	dk.adding--
+	dk.addGen++
+	dk.lock.Unlock()
+}
+
+// addMoving records that a rename in dk started (delta 1), or that it's been moved or removed in the MFS (delta -1).
+func (dk *DirKey) addMoving(delta int) {
+	dk.lock.Lock()
+	dk.moving += delta
+	dk.addGen++
+	dk.lock.Unlock()
+}
+
+// settled returns true if nothing is waiting to be added to dk, being added, or being moved, along with a counter which
+// changes whenever a batch or a move starts or finishes.
+func (dk *DirKey) settled() (uint64, bool) {
+	dk.lock.Lock()
+	defer dk.lock.Unlock()
+	return dk.addGen, dk.adding == 0 && dk.moving == 0 && (dk.queue == nil || dk.queue.Len() == 0)
+}
+
+// prepareStaging starts the staging copy of dk from MFSPath if dk is Atomic and it doesn't have one yet. If dk isn't
+// Atomic (anymore), any staging copy left over is moved back into MFSPath, so nothing staged is lost.
+func (s *Syncer) prepareStaging(dk *DirKey) error {
+	staging := StagingDir + "/" + dk.MFSPath
+	stagingCID := s.GetFileCID(s.Context(), staging)
+	if dk.Atomic {
+		cid := s.GetFileCID(s.Context(), dk.MFSPath)
+		if stagingCID != "" || cid == "" { // already staging, or everything's about to be added to it
+			return nil
+		}
+		if err := s.MakeDir(s.Context(), StagingDir); err != nil {
+			return err
+		}
+		return s.CopyCID(s.Context(), cid, staging)
+	}
+	if stagingCID == "" {
+		return nil
+	}
+	s.log.Println("Moving staged changes of", dk.ID, "back into", dk.MFSPath, "...")
+	s.RemoveFile(s.Context(), dk.MFSPath)
+	if err := s.CopyCID(s.Context(), stagingCID, dk.MFSPath); err != nil {
+		return err
+	}
+	return s.RemoveFile(s.Context(), staging)
+}
+
+// commitStaging copies the staging copy of dk into MFSPath, as long as every change queued for dk has been applied
+// to it, so MFSPath only ever holds a consistent point-in-time state. Returns the root committed, which is what should
+// be published, or ErrNotSettled if dk hasn't settled yet.
+func (s *Syncer) commitStaging(dk *DirKey) (string, error) {
+	gen, ok := dk.settled()
+	if !ok {
+		return "", ErrNotSettled
+	}
+	cid := s.GetFileCID(s.Context(), dk.workPath())
+	// a batch may have started while we were reading the root
+	if after, ok := dk.settled(); !ok || after != gen || cid == "" {
+		return "", ErrNotSettled
+	}
+	if cid == s.GetFileCID(s.Context(), dk.MFSPath) {
+		return cid, nil
+	}
+	if s.opt().Verbose {
+		s.log.Println("Committing", cid, "to", dk.MFSPath, "...")
+	}
+	// copied next to the staging copy first, so MFSPath is only ever missing for a single move
+	tmp := StagingDir + "/.commit-" + dk.MFSPath
+	s.RemoveFile(s.Context(), tmp)
+	if err := s.CopyCID(s.Context(), cid, tmp); err != nil {
+		return "", fmt.Errorf("error committing staged changes: %w", err)
+	}
+	if err := s.RemoveFile(s.Context(), dk.MFSPath); err != nil && !errors.Is(err, ErrNotFound) {
+		return "", fmt.Errorf("error committing staged changes: %w", err)
+	}
+	if err := s.MoveFile(s.Context(), tmp, dk.MFSPath); err != nil {
+		return "", fmt.Errorf("error committing staged changes: %w", err)
+	}
+	return cid, nil
+}
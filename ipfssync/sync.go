@@ -0,0 +1,322 @@
+package ipfssync
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// filePathWalkDir returns every file under dk.Dir which isn't ignored.
+func (s *Syncer) filePathWalkDir(dk *DirKey) ([]string, error) {
+	var files []string
+	dk.ForgetIgnoreFiles() // in case they changed while we weren't watching
+	err := filepath.WalkDir(dk.Dir, func(path string, info fs.DirEntry, err error) error {
+		if info == nil {
+			return errors.New(fmt.Sprintf("cannot access '%s' for crawling", path))
+		}
+		if s.Ignored(dk, path, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// addAll adds the directory of dk, and returns CID.
+func (s *Syncer) addAll(dk *DirKey) (string, error) {
+	files, err := s.filePathWalkDir(dk)
+	if err != nil {
+		return "", err
+	}
+	localDirs := make(map[string]bool)
+	jobs := make([]*AddJob, 0, len(files))
+	for _, file := range files {
+		filePathSplit := strings.Split(file, string(os.PathSeparator))
+		parentDir := strings.Join(filePathSplit[:len(filePathSplit)-1], string(os.PathSeparator))
+		makeDir := !localDirs[parentDir]
+		if makeDir {
+			localDirs[parentDir] = true
+		}
+		jobs = append(jobs, &AddJob{From: file, To: dk.mfsPath(file), MakeDir: makeDir})
+	}
+	s.AddFiles(dk, jobs, nil)
+	cid := s.GetFileCID(s.Context(), dk.workPath())
+	if dk.Pin {
+		if err := s.Pin(s.Context(), cid); err != nil {
+			s.error(dk, fmt.Errorf("error pinning %s: %w", dk.MFSPath, err))
+		}
+	}
+	s.pinRemote(dk, cid, dk.MFSPath)
+	return cid, err
+}
+
+// SyncDir brings the MFS copy of dk up to date with what's on disk, adding anything that's changed (if we're using a DB),
+// and removing anything that's no longer there. If dk is following a name, dk.Dir is brought up to date with it instead.
+func (s *Syncer) SyncDir(dk *DirKey) error {
+	if dk.Follow != "" {
+		return s.FollowDir(dk, true)
+	}
+	dk.workLock.Lock()
+	defer dk.workLock.Unlock()
+	if err := s.prepareStaging(dk); err != nil {
+		return fmt.Errorf("error preparing staging copy: %w", err)
+	}
+	if err := s.prepareEncryption(dk); err != nil {
+		return fmt.Errorf("error preparing encryption: %w", err)
+	}
+	if s.DB != nil {
+		s.checkEncryption(dk)
+	}
+	if err := s.writeHeader(dk); err != nil {
+		return fmt.Errorf("error writing %s: %w", EncryptionHeader, err)
+	}
+
+	// Hash directory if we're using a DB.
+	if s.DB != nil {
+		if s.opt().Verbose {
+			s.log.Println("Hashing", dk.Dir, "...")
+		}
+
+		hashmap, err := s.hashDir(dk)
+		if err != nil {
+			return err
+		}
+		onDisk := make(map[string]bool, len(hashmap))
+		files := make([]string, 0, len(hashmap))
+		for file := range hashmap {
+			onDisk[file] = true
+			files = append(files, file)
+		}
+		s.reconcileDir(dk, onDisk)
+
+		// sorted so files are added in the same order every time
+		sort.Strings(files)
+		localDirs := make(map[string]bool)
+		var jobs []*AddJob
+		s.HashLock.Lock()
+		for _, file := range files {
+			hash := hashmap[file]
+			if s.updateHash(hash) {
+				if s.opt().Verbose {
+					s.log.Println("File updated:", hash.PathOnDisk)
+				}
+
+				// grab parent dir, check if we've already created it
+				splitName := strings.Split(hash.PathOnDisk, string(os.PathSeparator))
+				parentDir := strings.Join(splitName[:len(splitName)-1], string(os.PathSeparator))
+				makeDir := !localDirs[parentDir]
+				if makeDir {
+					localDirs[parentDir] = true
+				}
+				jobs = append(jobs, &AddJob{From: hash.PathOnDisk, To: dk.mfsPath(hash.PathOnDisk), MakeDir: makeDir})
+			}
+			s.Hashes[hash.PathOnDisk] = hash
+		}
+		s.HashLock.Unlock()
+		s.AddFiles(dk, jobs, nil)
+	} else {
+		files, err := s.filePathWalkDir(dk)
+		if err != nil {
+			return err
+		}
+		onDisk := make(map[string]bool, len(files))
+		for _, file := range files {
+			onDisk[file] = true
+		}
+		s.reconcileDir(dk, onDisk)
+	}
+	return nil
+}
+
+// resyncDir syncs dk after its ignore rules changed, so newly ignored files are removed and newly unignored ones are
+// added.
+func (s *Syncer) resyncDir(dk *DirKey) {
+	s.log.Println("Ignore rules changed, resyncing", dk.ID, "...")
+	if err := s.SyncDir(dk); err != nil {
+		s.error(dk, fmt.Errorf("error syncing directory: %w", err))
+	}
+}
+
+// PublishDir publishes the MFS root of dk to IPNS and updates its pins, if it's changed since it was last published
+// or force is true. Returns true if it was published. If dk is Atomic, its staged changes are committed first, and
+// nothing is published while changes are still waiting to be applied.
+func (s *Syncer) PublishDir(dk *DirKey, force bool) bool {
+	ok, _ := s.publishDir(dk, force, "")
+	return ok
+}
+
+// publishDir is PublishDir, returning ErrRootChanged instead of publishing if expect isn't empty and the MFS root of dk
+// doesn't match it. Whatever else kept dk from being published is returned too, apart from it not having changed.
+func (s *Syncer) publishDir(dk *DirKey, force bool, expect string) (bool, error) {
+	if dk.Follow != "" {
+		return false, nil
+	}
+	dk.workLock.Lock()
+	defer dk.workLock.Unlock()
+
+	if s.heldBack(dk) {
+		return false, fmt.Errorf("%w: %d quarantined file(s)", ErrHeldBack, len(dk.Quarantined()))
+	}
+	oldCID := dk.GetCID()
+	var fCID string
+	if dk.Atomic {
+		var err error
+		if fCID, err = s.commitStaging(dk); errors.Is(err, ErrNotSettled) {
+			if s.opt().Verbose {
+				s.log.Println("Not publishing", dk.ID, "until its changes have been applied")
+			}
+			return false, err
+		} else if err != nil {
+			s.error(dk, err)
+			return false, err
+		}
+	} else {
+		fCID = s.GetFileCID(s.Context(), dk.MFSPath)
+	}
+	if expect != "" && fCID != expect {
+		return false, fmt.Errorf("%w, its root is now %s", ErrRootChanged, fCID)
+	}
+	if len(fCID) == 0 {
+		return false, fmt.Errorf("%s isn't in the MFS", dk.MFSPath)
+	}
+	if fCID == oldCID && !force {
+		return false, nil
+	}
+	// log.Printf("[DEBUG] '%s' != '%s'", fCID, oldCID)
+	if fCID != oldCID {
+		if dk.Pin {
+			start := time.Now()
+			if err := s.pinRoot(dk, oldCID, fCID); err != nil {
+				s.metrics.PinFailures.Inc(dk.ID)
+				s.error(dk, fmt.Errorf("error pinning %s: %w", fCID, err))
+			} else {
+				s.metrics.PinUpdates.Inc(dk.ID)
+			}
+			s.metrics.PinLatency.Since(start)
+		}
+		s.updatePinRemote(dk, oldCID, fCID, strings.Split(dk.MFSPath, "/")[0])
+	}
+	start := time.Now()
+	err := s.Publish(s.Context(), fCID, dk.ID)
+	s.metrics.PublishLatency.Since(start)
+	if err != nil {
+		s.metrics.PublishFailures.Inc(dk.ID)
+		err = fmt.Errorf("error publishing: %w", err)
+		s.error(dk, err)
+		return false, err
+	}
+	diff := s.published(dk, fCID)
+	s.applyRetention(dk, oldCID)
+	if diff != nil {
+		s.log.Println(dk.MFSPath, "updated:", diff)
+	} else {
+		s.log.Println(dk.MFSPath, "updated...")
+	}
+	return true, nil
+}
+
+// published records that dk was published as cid, returning what changed since it was last published (if that could
+// be worked out).
+func (s *Syncer) published(dk *DirKey, cid string) *DiffSummary {
+	s.metrics.Publishes.Inc(dk.ID)
+	s.metrics.LastPublish.Set(dk.ID, float64(time.Now().Unix()))
+	diff := s.summarize(dk, dk.GetCID(), cid)
+	dk.SetCID(cid)
+	s.recordPublish(dk, &PublishRecord{CID: cid, Changes: dk.takeChanges(), Diff: diff})
+	if dk.TwoWay {
+		s.setMergeBase(dk, cid)
+	}
+	s.exportRoot(dk, cid)
+	s.updateDNSLink(dk, cid)
+	if onPublish := s.opt().OnPublish; onPublish != nil {
+		onPublish(dk, cid)
+	}
+	return diff
+}
+
+// startDir syncs dk, loading its IPNS key (or generating it and adding dk for the first time), and starts watching it
+// for changes. keys should be the keys currently in the IPFS daemon.
+func (s *Syncer) startDir(dk *DirKey, keys *Keys) error {
+	if dk.Follow != "" {
+		s.log.Println(dk.ID, "following", dk.Follow, "...")
+		if err := s.FollowDir(dk, true); err != nil {
+			s.error(dk, err) // the name might not be resolvable yet, try again later
+		}
+		return nil
+	}
+	if dk.TwoWay && s.DB == nil {
+		return errors.New("two-way sync requires a DB")
+	}
+	if err := s.SyncDir(dk); err != nil {
+		return fmt.Errorf("error syncing directory: %w", err)
+	}
+
+	// Check if we recognize any keys, and load them if so.
+	for _, ik := range keys.Keys {
+		if ik.Name == KeySpace+dk.ID {
+			dk.SetKey(ik.Id)
+			if cid, err := s.ResolveIPNS(s.Context(), ik.Id); err == nil {
+				dk.SetCID(cid)
+			} else {
+				s.log.Println("Error resolving IPNS:", err)
+				if dk.Manual {
+					s.log.Println(dk.ID, "is published by hand, not republishing")
+				} else {
+					s.log.Println("Republishing key...")
+					s.PublishDir(dk, true)
+				}
+			}
+			s.log.Println(dk.ID, "loaded:", ik.Id)
+			dk.done = s.watchDir(dk)
+			return nil
+		}
+	}
+
+	s.log.Println(dk.ID, "not found, generating...")
+	ik, err := s.GenerateKey(s.Context(), dk.ID)
+	if err != nil {
+		return err
+	}
+	cid, err := s.addAll(dk)
+	if err != nil {
+		return fmt.Errorf("failed to add directory: %w", err)
+	}
+	if dk.Atomic {
+		if cid, err = s.commitStaging(dk); err != nil {
+			return fmt.Errorf("failed to commit %s: %w", dk.MFSPath, err)
+		}
+	}
+	dk.SetKey(ik.Id)
+	if dk.Manual {
+		s.log.Println(dk.ID, "is published by hand, not publishing")
+	} else if s.heldBack(dk) {
+		// published once everything's allowed or removed
+	} else if err := s.Publish(s.Context(), cid, dk.ID); err != nil {
+		s.error(dk, fmt.Errorf("error publishing: %w", err))
+	} else {
+		s.published(dk, cid)
+		s.applyRetention(dk, "")
+	}
+	s.log.Println(dk.ID, "loaded:", ik.Id)
+	dk.done = s.watchDir(dk)
+	return nil
+}
+
+// stopDir stops watching dk for changes.
+func (s *Syncer) stopDir(dk *DirKey) {
+	if dk.done != nil {
+		dk.done <- true
+		dk.done = nil
+	}
+}
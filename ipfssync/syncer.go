@@ -0,0 +1,449 @@
+// Package ipfssync keeps directories synced to the MFS of an IPFS node, publishing each of them to IPNS whenever they
+// change.
+package ipfssync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// Options configures a Syncer. Zero values are replaced by the defaults listed.
+type Options struct {
+	EndPoint         string            // node to connect to over HTTP (default "http://127.0.0.1:5001")
+	BasePath         string            // MFS directory every dir is synced under (default "/ipfs-sync/")
+	DB               string            // path to the DB, which enables hashing and publish history (default none)
+	Dirs             []*DirKey         // dirs to sync
+	Sync             time.Duration     // time to sleep between IPNS syncs (default 10s)
+	Timeout          time.Duration     // longest time to wait for simple API calls like `files/mkdir` (default 30s)
+	Quiet            time.Duration     // time a file must go without changes before it's added (default 1s)
+	Settle           time.Duration     // time a file's size must stay the same before it's added (default 0)
+	Concurrency      int               // maximum amount of files to add at once, across all dirs (default 4)
+	Ignore           []string          // gitignore-style patterns to ignore in every dir
+	IgnoreHidden     bool              // ignore anything prefixed with "."
+	Guard            bool              // scan files for secrets before adding them, and hold back anything sensitive
+	Sensitive        []string          // gitignore-style patterns Guard always holds back (default DefaultSensitive)
+	PinningServices  []*PinningService // remote pinning services dirs can use by name
+	DNSLinkProviders []*DNSLinkConfig  // DNSLink providers dirs can use by name
+	VerifyFilestore  bool              // verify the filestore on Start, if any dirs use nocopy
+	Verbose          bool              // log a lot more
+	Logger           *log.Logger       // where to log to (default the standard logger)
+
+	// Callbacks, any of which may be nil. They're called synchronously, so they should return quickly.
+	OnFileAdded func(dk *DirKey, path, cid string) // a file on disk was added to the MFS
+	OnPublish   func(dk *DirKey, cid string)       // dk was published to IPNS
+	OnError     func(dk *DirKey, err error)        // something went wrong, dk may be nil
+}
+
+// withDefaults returns a copy of opts with defaults filled in.
+func (opts *Options) withDefaults() *Options {
+	o := *opts
+	if o.EndPoint == "" {
+		o.EndPoint = "http://127.0.0.1:5001"
+	}
+	if o.BasePath == "" {
+		o.BasePath = "/ipfs-sync/"
+	}
+	if o.Sync == 0 {
+		o.Sync = time.Second * 10
+	}
+	if o.Timeout == 0 {
+		o.Timeout = time.Second * 30
+	}
+	if o.Quiet == 0 {
+		o.Quiet = time.Second
+	}
+	if o.Concurrency < 1 {
+		o.Concurrency = 4
+	}
+	if o.Logger == nil {
+		o.Logger = log.Default()
+	}
+	return &o
+}
+
+// Syncer syncs directories to an IPFS node.
+type Syncer struct {
+	// set once by NewSyncer
+	client   *Client
+	basePath string
+	log      *log.Logger
+	metrics  *metricSet
+	addSlots chan struct{} // limits IPFS adds across every directory to Concurrency
+	moves    *moveTracker
+
+	opts        atomic.Value // *Options, replaced by Reload
+	ignoreRules atomic.Value // []*ignoreRule compiled from Options.Ignore
+	sensitive   atomic.Value // []*ignoreRule compiled from Options.Sensitive
+	services    atomic.Value // map[string]*PinningService built from Options.PinningServices
+	dnslinks    atomic.Value // map[string]DNSLinkProvider built from Options.DNSLinkProviders
+
+	lock    sync.RWMutex // guards dirs, started and stop
+	dirs    []*DirKey
+	started bool
+	stop    chan bool
+
+	rootLock   sync.Mutex // guards root and cancelRoot
+	root       context.Context
+	cancelRoot context.CancelFunc
+
+	reloadLock  sync.Mutex // held while reloading
+	cleanupLock chan int   // held while cleaning the filestore
+
+	DB       *leveldb.DB
+	HashLock sync.RWMutex // guards Hashes
+	Hashes   map[string]*FileHash
+}
+
+// NewSyncer returns a Syncer for opts. Nothing is done until Open or Start are called.
+func NewSyncer(opts *Options) (*Syncer, error) {
+	o := opts.withDefaults()
+	s := &Syncer{
+		client:      &Client{EndPoint: o.EndPoint},
+		basePath:    o.BasePath,
+		log:         o.Logger,
+		addSlots:    make(chan struct{}, o.Concurrency),
+		moves:       new(moveTracker),
+		cleanupLock: make(chan int, 1),
+	}
+	s.root, s.cancelRoot = context.WithCancel(context.Background())
+	s.metrics = newMetricSet(s)
+	s.setOptions(o)
+	for _, dk := range o.Dirs {
+		if err := s.addDir(dk); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// opt returns the current options.
+func (s *Syncer) opt() *Options {
+	return s.opts.Load().(*Options)
+}
+
+// setOptions replaces the current options, and everything derived from them.
+func (s *Syncer) setOptions(o *Options) {
+	services := make(map[string]*PinningService, len(o.PinningServices))
+	for _, ps := range o.PinningServices {
+		if ps.Name == "" || ps.EndPoint == "" {
+			o.Logger.Println("[ERROR] Pinning services require a Name and EndPoint, skipping...")
+			continue
+		}
+		ps.timeout = o.Timeout
+		services[ps.Name] = ps
+	}
+	dnslinks := make(map[string]DNSLinkProvider, len(o.DNSLinkProviders))
+	for _, dc := range o.DNSLinkProviders {
+		provider, err := dc.provider(o.Timeout)
+		if err != nil {
+			o.Logger.Println("[ERROR]", err, "skipping...")
+			continue
+		}
+		dnslinks[dc.Name] = provider
+	}
+	for _, line := range o.Ignore {
+		if bareWord(line) && !legacyExtensions[line] {
+			o.Logger.Printf("[WARNING] Ignore entry '%s' ignores anything named '%s', not files ending in '.%s' like it "+
+				"used to, use '*.%s' for that\n", line, line, line, line)
+		}
+	}
+	s.opts.Store(o)
+	s.ignoreRules.Store(parseIgnore(o.Ignore, 0, true))
+	sensitive := o.Sensitive
+	if sensitive == nil {
+		sensitive = DefaultSensitive
+	}
+	s.sensitive.Store(parseIgnore(sensitive, 0, false))
+	s.services.Store(services)
+	s.dnslinks.Store(dnslinks)
+}
+
+// Open opens the DB, if there is one, and makes sure the node is reachable. It's called by Start, and only needs to
+// be called directly to use a Syncer without starting it.
+func (s *Syncer) Open() error {
+	if path := s.opt().DB; path != "" && s.DB == nil {
+		db, err := leveldb.OpenFile(path, nil)
+		if err != nil {
+			return err
+		}
+		s.DB = db
+		s.Hashes = make(map[string]*FileHash)
+	}
+	ctx, cancel := s.reqContext(s.Context(), s.opt().Timeout)
+	defer cancel()
+	if _, err := s.client.Version(ctx); err != nil {
+		return fmt.Errorf("failed to connect to end point: %w", err)
+	}
+	return nil
+}
+
+// Start opens the Syncer, syncs every dir, and starts watching them for changes and publishing them.
+func (s *Syncer) Start() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.started {
+		return errors.New("already started")
+	}
+	if err := s.Open(); err != nil {
+		return err
+	}
+
+	if s.opt().VerifyFilestore {
+		for _, dk := range s.dirs {
+			if dk.Nocopy {
+				// Cleanup filestore first.
+				s.CleanFilestore(s.Context())
+				break
+			}
+		}
+	}
+
+	keys, err := s.ListKeys(s.Context())
+	if err != nil {
+		return fmt.Errorf("failed to retrieve keys: %w", err)
+	}
+	for i, dk := range s.dirs {
+		if err := s.startDir(dk, keys); err != nil {
+			for _, dk := range s.dirs[:i] {
+				s.stopDir(dk)
+			}
+			return fmt.Errorf("%s failed to start: %w", dk.ID, err)
+		}
+	}
+	s.started = true
+	s.stop = make(chan bool)
+	go s.publishLoop(s.stop)
+	return nil
+}
+
+// Stop stops watching and publishing every dir, and closes the DB. Requests still waiting on the node are cancelled,
+// and whatever else is in progress is finished first. The Syncer can be opened or started again afterwards.
+func (s *Syncer) Stop() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.rootLock.Lock()
+	s.cancelRoot()
+	s.rootLock.Unlock()
+	defer func() {
+		s.rootLock.Lock()
+		s.root, s.cancelRoot = context.WithCancel(context.Background())
+		s.rootLock.Unlock()
+	}()
+	if s.started {
+		close(s.stop)
+		for _, dk := range s.dirs {
+			dk.workLock.Lock()
+			s.stopDir(dk)
+			dk.workLock.Unlock()
+		}
+		s.started = false
+	}
+	if s.DB != nil {
+		s.HashLock.Lock()
+		defer s.HashLock.Unlock()
+		err := s.DB.Close()
+		s.DB = nil
+		s.Hashes = nil
+		return err
+	}
+	return nil
+}
+
+// publishLoop periodically updates IPNS records and recursive pins (apart from dirs published by hand), merges in
+// remote changes to two-way dirs, and follows any dirs following a name, until stop is closed.
+func (s *Syncer) publishLoop(stop chan bool) {
+	for {
+		select {
+		case <-time.After(s.opt().Sync):
+		case <-stop:
+			return
+		}
+		for _, dk := range s.Dirs() {
+			switch {
+			case dk.Paused(), dk.Manual:
+			case dk.Follow != "":
+				if err := s.FollowDir(dk, false); err != nil {
+					s.error(dk, err)
+				}
+			case dk.TwoWay:
+				if err := s.MergeRemote(dk); err != nil {
+					s.error(dk, err)
+					continue // don't clobber what we couldn't merge
+				}
+				s.PublishDir(dk, false)
+			default:
+				s.PublishDir(dk, false)
+			}
+		}
+	}
+}
+
+// Dirs returns every dir being synced.
+func (s *Syncer) Dirs() []*DirKey {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return append([]*DirKey(nil), s.dirs...)
+}
+
+// Dir returns the dir with the given ID, or nil if there isn't one.
+func (s *Syncer) Dir(id string) *DirKey {
+	for _, dk := range s.Dirs() {
+		if dk.ID == id {
+			return dk
+		}
+	}
+	return nil
+}
+
+// addDir prepares dk and adds it to the list of dirs, s.lock must be held if s could be running.
+func (s *Syncer) addDir(dk *DirKey) error {
+	if err := dk.Prepare(); err != nil {
+		return err
+	}
+	for _, d := range s.dirs {
+		if d.ID == dk.ID {
+			return fmt.Errorf("there's already a dir with ID '%s'", dk.ID)
+		}
+	}
+	s.dirs = append(s.dirs, dk)
+	return nil
+}
+
+// AddDir starts syncing dk, right away if s has been started.
+func (s *Syncer) AddDir(dk *DirKey) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.addDir(dk); err != nil {
+		return err
+	}
+	if !s.started {
+		return nil
+	}
+	keys, err := s.ListKeys(s.Context())
+	if err == nil {
+		err = s.startDir(dk, keys)
+	}
+	if err != nil {
+		s.dirs = s.dirs[:len(s.dirs)-1]
+		return err
+	}
+	return nil
+}
+
+// RemoveDir stops syncing the dir with the given ID. Nothing is removed from the MFS or IPNS.
+func (s *Syncer) RemoveDir(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, dk := range s.dirs {
+		if dk.ID == id {
+			dk.workLock.Lock()
+			s.stopDir(dk)
+			dk.workLock.Unlock()
+			s.dirs = append(s.dirs[:i:i], s.dirs[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no dir with ID '%s'", id)
+}
+
+// Reload applies opts to a running Syncer: new dirs are started, removed dirs are stopped, and everything else is
+// updated in place. Dirs are only restarted if their Dir, Nocopy, DontHash, Follow, Encrypt, or Atomic changed, and resynced
+// if their ignore rules changed. EndPoint, BasePath, DB, Concurrency and Logger can't be changed, and are left alone.
+func (s *Syncer) Reload(opts *Options) {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	old := s.opt()
+	o := opts.withDefaults()
+	o.EndPoint, o.BasePath, o.DB, o.Concurrency, o.Logger = old.EndPoint, old.BasePath, old.DB, old.Concurrency, old.Logger
+	s.setOptions(o)
+	ignoreChanged := strings.Join(o.Ignore, "\n") != strings.Join(old.Ignore, "\n") || o.IgnoreHidden != old.IgnoreHidden
+
+	running := make(map[string]*DirKey)
+	for _, dk := range s.Dirs() {
+		running[dk.ID] = dk
+	}
+	var start, resync []*DirKey
+	seen := make(map[string]bool)
+	for _, ndk := range o.Dirs {
+		if seen[ndk.ID] {
+			s.error(nil, fmt.Errorf("duplicate dir ID %s, skipping...", ndk.ID))
+			continue
+		}
+		seen[ndk.ID] = true
+		dk := running[ndk.ID]
+		if dk == ndk { // the same dir, with nothing to compare it to
+			if ignoreChanged {
+				resync = append(resync, dk)
+			}
+			delete(running, ndk.ID)
+			continue
+		}
+		if err := ndk.Prepare(); err != nil {
+			s.error(nil, fmt.Errorf("%w, skipping...", err))
+			delete(running, ndk.ID) // keep running whatever was there before
+			continue
+		}
+		switch {
+		case dk == nil:
+			start = append(start, ndk)
+		case dk.Dir != ndk.Dir || dk.Nocopy != ndk.Nocopy || dk.DontHash != ndk.DontHash || dk.Follow != ndk.Follow ||
+			dk.Atomic != ndk.Atomic || !sameEncryption(dk.Encrypt, ndk.Encrypt):
+			s.log.Println("Restarting", dk.ID, "...")
+			s.RemoveDir(dk.ID)
+			start = append(start, ndk)
+		default:
+			dk.workLock.Lock()
+			dk.Pin = ndk.Pin
+			dk.Estuary = ndk.Estuary
+			dk.PinningServices = ndk.PinningServices
+			dk.Concurrency = ndk.Concurrency
+			dk.Retain = ndk.Retain
+			dk.DNSLinkProvider = ndk.DNSLinkProvider
+			dk.DNSLinkDomains = ndk.DNSLinkDomains
+			dk.TwoWay = ndk.TwoWay
+			dk.Manual = ndk.Manual
+			dk.Confirm = ndk.Confirm
+			dk.Export = ndk.Export
+			if ignoreChanged || strings.Join(dk.Ignore, "\n") != strings.Join(ndk.Ignore, "\n") {
+				dk.Ignore = ndk.Ignore
+				dk.ignoreRules = ndk.ignoreRules
+				resync = append(resync, dk)
+			}
+			dk.workLock.Unlock()
+		}
+		delete(running, ndk.ID)
+	}
+	for id := range running {
+		s.log.Println("Stopping", id, "...")
+		s.RemoveDir(id)
+	}
+	for _, dk := range start {
+		s.log.Println("Starting", dk.ID, "...")
+		if err := s.AddDir(dk); err != nil {
+			s.error(dk, fmt.Errorf("%s failed to start: %w", dk.ID, err))
+		}
+	}
+	for _, dk := range resync {
+		go s.resyncDir(dk)
+	}
+}
+
+// error logs err, and passes it on to OnError.
+func (s *Syncer) error(dk *DirKey, err error) {
+	if dk != nil {
+		s.log.Println("[ERROR]", dk.ID+":", err)
+	} else {
+		s.log.Println("[ERROR]", err)
+	}
+	if onError := s.opt().OnError; onError != nil {
+		onError(dk, err)
+	}
+}
@@ -0,0 +1,1027 @@
+package ipfssync
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSyncer returns a Syncer using fk, with opts (which may be nil) filled in with settings suited to testing.
+func testSyncer(t *testing.T, fk *fakeKubo, opts *Options) *Syncer {
+	t.Helper()
+	if opts == nil {
+		opts = new(Options)
+	}
+	opts.EndPoint = fk.URL
+	opts.Verbose = true
+	opts.Timeout = time.Second * 5
+	opts.Concurrency = 2
+	opts.Quiet = time.Millisecond * 50
+	s, err := NewSyncer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// writeFiles creates every file in files (relative path to contents) under dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		fpath := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fpath, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// testDirKey returns a prepared DirKey for a new temporary directory containing files.
+func testDirKey(t *testing.T, id string, files map[string]string) *DirKey {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), id)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, dir, files)
+	dk := &DirKey{ID: id, Dir: dir}
+	if err := dk.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	return dk
+}
+
+// waitFor polls cond until it returns true, failing the test if it doesn't within a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < time.Second*5; time.Sleep(time.Millisecond * 20) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatal("Timed out waiting for", what)
+}
+
+func TestListKeys(t *testing.T) {
+	fk := newFakeKubo()
+	defer fk.Close()
+	s := testSyncer(t, fk, nil)
+	if _, err := s.GenerateKey(s.Context(), "keys"); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := s.ListKeys(s.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, key := range keys.Keys {
+		found = found || key.Name == KeySpace+"keys"
+	}
+	if !found {
+		t.Error("Generated key missing from", keys.Keys)
+	}
+}
+
+func TestResolveIPNS(t *testing.T) {
+	fk := newFakeKubo()
+	defer fk.Close()
+	s := testSyncer(t, fk, nil)
+	key, err := s.GenerateKey(s.Context(), "resolve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Publish(s.Context(), "QmWa7egj1g4Dmv35s1AauW4KZqMBA84WqrRduxRYbQ5T3p", "resolve"); err != nil {
+		t.Fatal(err)
+	}
+	cid, err := s.ResolveIPNS(s.Context(), key.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cid != "QmWa7egj1g4Dmv35s1AauW4KZqMBA84WqrRduxRYbQ5T3p" {
+		t.Error("Unexpected CID returned from IPNS query:", cid)
+	}
+}
+
+func TestCleanFilestore(t *testing.T) {
+	fk := newFakeKubo()
+	defer fk.Close()
+	s := testSyncer(t, fk, nil)
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"gone.txt": "gone"})
+	hash, err := s.IPFSAddFile(s.Context(), filepath.Join(dir, "gone.txt"), true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(filepath.Join(dir, "gone.txt"))
+
+	if !s.HandleBadBlockError(s.Context(), errors.New("no such file or directory"), "", true) {
+		t.Error("Failed to cleanup bad block!")
+	}
+	if fk.HasBlock(hash.Hash) {
+		t.Error("Block pointing to a missing file wasn't removed")
+	}
+	if s.HandleBadBlockError(s.Context(), errors.New("something else"), "", true) {
+		t.Error("Unrelated error handled as a bad block")
+	}
+}
+
+func TestAddDir(t *testing.T) {
+	fk := newFakeKubo()
+	defer fk.Close()
+	s := testSyncer(t, fk, &Options{Ignore: []string{"swp"}})
+	dk := testDirKey(t, "adddir", map[string]string{
+		"a.txt":       "a",
+		"b/c.txt":     "c",
+		"b/d/e.txt":   "e",
+		"ignored.swp": "swap",
+	})
+
+	cid, err := s.addAll(dk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cid == "" || cid != s.GetFileCID(s.Context(), dk.MFSPath) {
+		t.Errorf("addAll returned '%s', but the MFS root is '%s'", cid, s.GetFileCID(s.Context(), dk.MFSPath))
+	}
+	for name, want := range map[string]string{"a.txt": "a", "b/c.txt": "c", "b/d/e.txt": "e"} {
+		if got, ok := fk.Cat(s.basePath + dk.MFSPath + "/" + name); !ok || got != want {
+			t.Errorf("%s contains '%s', expected '%s'", name, got, want)
+		}
+	}
+	if _, ok := fk.Cat(s.basePath + dk.MFSPath + "/ignored.swp"); ok {
+		t.Error("Ignored file was added")
+	}
+	entries, err := s.ListDir(s.Context(), dk.MFSPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "a.txt" || names[1] != "b" {
+		t.Error("Unexpected entries in MFS root:", names)
+	}
+}
+
+func TestAddFileOverwrite(t *testing.T) {
+	fk := newFakeKubo()
+	defer fk.Close()
+	s := testSyncer(t, fk, nil)
+	dir := t.TempDir()
+	fpath := filepath.Join(dir, "file.txt")
+	writeFiles(t, dir, map[string]string{"file.txt": "first"})
+	first, err := s.AddFile(s.Context(), fpath, "overwrite/file.txt", false, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFiles(t, dir, map[string]string{"file.txt": "second"})
+	if _, err := s.AddFile(s.Context(), fpath, "overwrite/file.txt", false, true, false); err == nil {
+		t.Error("Copying over an existing file without overwrite succeeded")
+	}
+	second, err := s.AddFile(s.Context(), fpath, "overwrite/file.txt", false, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Error("CID didn't change after overwriting")
+	}
+	if got, _ := fk.Cat(s.basePath + "overwrite/file.txt"); got != "second" {
+		t.Errorf("File contains '%s' after overwriting", got)
+	}
+}
+
+func TestRemoveCID(t *testing.T) {
+	fk := newFakeKubo()
+	defer fk.Close()
+	s := testSyncer(t, fk, nil)
+	dk := testDirKey(t, "removecid", map[string]string{"a.txt": "a", "b/c.txt": "c"})
+	cid, err := s.addAll(dk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Pin(s.Context(), cid); err != nil {
+		t.Fatal(err)
+	}
+	child := s.GetFileCID(s.Context(), dk.MFSPath+"/b/c.txt")
+
+	s.RemoveCID(s.Context(), cid)
+	if fk.Pinned(cid) {
+		t.Error("Pin wasn't removed")
+	}
+	if fk.HasBlock(child) {
+		t.Error("Child block wasn't removed")
+	}
+}
+
+func TestUpdatePin(t *testing.T) {
+	fk := newFakeKubo()
+	defer fk.Close()
+	s := testSyncer(t, fk, nil)
+	dk := testDirKey(t, "updatepin", map[string]string{"a.txt": "a"})
+	from, err := s.addAll(dk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Pin(s.Context(), from); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, dk.Dir, map[string]string{"b.txt": "b"})
+	if _, err := s.AddFile(s.Context(), filepath.Join(dk.Dir, "b.txt"), dk.MFSPath+"/b.txt", false, false,
+		false); err != nil {
+		t.Fatal(err)
+	}
+	to := s.GetFileCID(s.Context(), dk.MFSPath)
+
+	if err := s.UpdatePin(s.Context(), from, to, false); err != nil {
+		t.Fatal(err)
+	}
+	if fk.Pinned(from) || !fk.Pinned(to) {
+		t.Error("Pin wasn't moved from", from, "to", to)
+	}
+
+	// updating from something that isn't pinned should still pin the new CID
+	writeFiles(t, dk.Dir, map[string]string{"c.txt": "c"})
+	if _, err := s.AddFile(s.Context(), filepath.Join(dk.Dir, "c.txt"), dk.MFSPath+"/c.txt", false, false,
+		false); err != nil {
+		t.Fatal(err)
+	}
+	last := s.GetFileCID(s.Context(), dk.MFSPath)
+	if err := s.UpdatePin(s.Context(), from, last, false); err != nil {
+		t.Fatal(err)
+	}
+	if !fk.Pinned(last) {
+		t.Error("CID wasn't pinned after a failed update")
+	}
+}
+
+func TestSyncer(t *testing.T) {
+	fk := newFakeKubo()
+	defer fk.Close()
+	dk := testDirKey(t, "syncer", map[string]string{"a.txt": "a", "sub/b.txt": "b"})
+	var lock sync.Mutex
+	added := make(map[string]string)
+	published := make(map[string]string)
+	s := testSyncer(t, fk, &Options{
+		DB:   filepath.Join(t.TempDir(), "db"),
+		Dirs: []*DirKey{dk},
+		Sync: time.Millisecond * 100,
+		OnFileAdded: func(dk *DirKey, path, cid string) {
+			lock.Lock()
+			added[path] = cid
+			lock.Unlock()
+		},
+		OnPublish: func(dk *DirKey, cid string) {
+			lock.Lock()
+			published[dk.ID] = cid
+			lock.Unlock()
+		},
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	waitFor(t, "first publish", func() bool { return fk.Resolve(dk.ID) != "" })
+	first := fk.Resolve(dk.ID)
+	if first != s.GetFileCID(s.Context(), dk.MFSPath) {
+		t.Error("Published", first, "instead of the MFS root")
+	}
+	lock.Lock()
+	if published[dk.ID] != first {
+		t.Errorf("OnPublish was given '%s', expected '%s'", published[dk.ID], first)
+	}
+	lock.Unlock()
+
+	writeFiles(t, dk.Dir, map[string]string{"sub/new.txt": "new"})
+	waitFor(t, "new file to be added", func() bool {
+		got, _ := fk.Cat(s.basePath + dk.MFSPath + "/sub/new.txt")
+		return got == "new"
+	})
+	lock.Lock()
+	cid := added[filepath.Join(dk.Dir, "sub", "new.txt")]
+	if cid != s.GetFileCID(s.Context(), dk.MFSPath+"/sub/new.txt") {
+		t.Errorf("OnFileAdded was given '%s' for the new file", cid)
+	}
+	lock.Unlock()
+	waitFor(t, "republish", func() bool { return fk.Resolve(dk.ID) != first })
+	if got := fk.Resolve(dk.ID); got != s.GetFileCID(s.Context(), dk.MFSPath) {
+		t.Error("Published", got, "instead of the MFS root")
+	}
+
+	os.Remove(filepath.Join(dk.Dir, "a.txt"))
+	waitFor(t, "removed file to be removed", func() bool {
+		_, ok := fk.Cat(s.basePath + dk.MFSPath + "/a.txt")
+		return !ok
+	})
+
+	// dirs can be added and removed while running
+	other := testDirKey(t, "other", map[string]string{"c.txt": "c"})
+	if err := s.AddDir(other); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddDir(other); err == nil {
+		t.Error("Adding a dir with a duplicate ID succeeded")
+	}
+	waitFor(t, "added dir to be published", func() bool { return fk.Resolve(other.ID) != "" })
+	if err := s.RemoveDir(other.ID); err != nil {
+		t.Fatal(err)
+	}
+	if s.Dir(other.ID) != nil {
+		t.Error("Removed dir is still listed")
+	}
+
+	history, err := s.History(dk.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) < 2 || history[0].CID != first {
+		t.Error("Unexpected publish history:", history)
+	}
+}
+
+func TestReloadBadDir(t *testing.T) {
+	fk := newFakeKubo()
+	defer fk.Close()
+	dk := testDirKey(t, "reloaded", map[string]string{"a.txt": "a"})
+	opts := &Options{DB: filepath.Join(t.TempDir(), "db"), Dirs: []*DirKey{dk}}
+	s := testSyncer(t, fk, opts)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	// a dir that can't be prepared is skipped, leaving the one already running alone
+	opts.Dirs = []*DirKey{{ID: dk.ID}}
+	s.Reload(opts)
+	if s.Dir(dk.ID) != dk {
+		t.Fatal("Reloading with a bad dir stopped the running one")
+	}
+	writeFiles(t, dk.Dir, map[string]string{"new.txt": "new"})
+	waitFor(t, "new file to be added", func() bool {
+		got, _ := fk.Cat(s.basePath + dk.MFSPath + "/new.txt")
+		return got == "new"
+	})
+}
+
+func TestRollback(t *testing.T) {
+	fk := newFakeKubo()
+	defer fk.Close()
+	dk := testDirKey(t, "rollback", map[string]string{"a.txt": "a"})
+	dk.Pin = true
+	s := testSyncer(t, fk, &Options{
+		DB:   filepath.Join(t.TempDir(), "db"),
+		Dirs: []*DirKey{dk},
+		Sync: time.Millisecond * 100,
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	waitFor(t, "first publish", func() bool { return fk.Resolve(dk.ID) != "" })
+	first := fk.Resolve(dk.ID)
+	writeFiles(t, dk.Dir, map[string]string{"b.txt": "b"})
+	waitFor(t, "republish", func() bool { return fk.Resolve(dk.ID) != first })
+	second := fk.Resolve(dk.ID)
+	// the record is written after the publish returns
+	waitFor(t, "republish to be recorded", func() bool {
+		history, _ := s.History(dk.ID)
+		return len(history) == 2
+	})
+
+	history, err := s.History(dk.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[1].Sequence == nil || *history[1].Sequence != 1 || history[1].Changes.Added != 1 {
+		t.Fatal("Unexpected publish history:", history)
+	}
+
+	// without restore, the dir is paused so the rollback sticks
+	record, err := s.Rollback(dk.ID, first, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !record.Rollback || record.CID != first || record.Sequence == nil || *record.Sequence != 2 {
+		t.Error("Unexpected rollback record:", record)
+	}
+	if fk.Resolve(dk.ID) != first || !dk.Paused() {
+		t.Error("Rollback didn't publish", first, "and pause the dir")
+	}
+	if !fk.Pinned(first) || fk.Pinned(second) {
+		t.Error("Pin wasn't moved back to", first)
+	}
+
+	// by timestamp, restoring the MFS
+	dk.SetPaused(false)
+	if _, err := s.Rollback(dk.ID, history[1].Time.Format(time.RFC3339Nano), true); err != nil {
+		t.Fatal(err)
+	}
+	if fk.Resolve(dk.ID) != second || s.GetFileCID(s.Context(), dk.MFSPath) != second {
+		t.Error("MFS wasn't restored to", second)
+	}
+	if dk.Paused() {
+		t.Error("Dir was paused after restoring")
+	}
+	if _, err := s.Rollback(dk.ID, "bafkmissing", true); err == nil {
+		t.Error("Rolling back to a CID that was never published succeeded")
+	}
+}
+
+func TestRetentionPolicy(t *testing.T) {
+	start := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC) // a Monday
+	var records []*PublishRecord
+	for i := 0; i < 24*14; i++ { // every hour for two weeks
+		records = append(records, &PublishRecord{Time: start.Add(time.Hour * time.Duration(i)), CID: fmt.Sprint(i)})
+	}
+	for _, test := range []struct {
+		rp   *RetentionPolicy
+		want []string
+	}{
+		{&RetentionPolicy{Last: 3}, []string{"335", "334", "333"}},
+		{&RetentionPolicy{Daily: 3}, []string{"335", "311", "287"}},
+		{&RetentionPolicy{Last: 2, Weekly: 4}, []string{"335", "334", "167"}},
+		{&RetentionPolicy{}, []string{}},
+	} {
+		got := make([]string, 0)
+		for _, record := range test.rp.keep(records) {
+			got = append(got, record.CID)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%+v kept %v, expected %v", test.rp, got, test.want)
+		}
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	fk := newFakeKubo()
+	defer fk.Close()
+	dk := testDirKey(t, "snapshots", map[string]string{"a.txt": "a"})
+	dk.Pin = true
+	dk.Retain = &RetentionPolicy{Last: 2, Expose: true}
+	s := testSyncer(t, fk, &Options{
+		DB:   filepath.Join(t.TempDir(), "db"),
+		Dirs: []*DirKey{dk},
+		Sync: time.Millisecond * 100,
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	// a root is only fully published once the retention policy has been applied to it
+	retained := func(last string) bool {
+		snaps, _ := s.Snapshots(dk.ID)
+		root := fk.Resolve(dk.ID)
+		return root != last && len(snaps) > 0 && snaps[0].CID == root
+	}
+	roots := []string{}
+	waitFor(t, "first publish", func() bool { return retained("") })
+	roots = append(roots, fk.Resolve(dk.ID))
+	for _, name := range []string{"b.txt", "c.txt"} {
+		writeFiles(t, dk.Dir, map[string]string{name: name})
+		waitFor(t, name+" to be published", func() bool { return retained(roots[len(roots)-1]) })
+		roots = append(roots, fk.Resolve(dk.ID))
+	}
+
+	if fk.Pinned(roots[0]) || !fk.Pinned(roots[1]) || !fk.Pinned(roots[2]) {
+		t.Error("Expected only the last two roots to be pinned")
+	}
+	snaps, err := s.Snapshots(dk.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snaps) != 2 || snaps[0].CID != roots[2] || snaps[1].CID != roots[1] {
+		t.Fatal("Unexpected snapshots:", snaps)
+	}
+	entries, err := s.ListDir(s.Context(), SnapshotDir+"/"+dk.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || s.GetFileCID(s.Context(), SnapshotDir+"/"+dk.ID+"/"+snaps[1].Name()) != roots[1] {
+		t.Error("Unexpected snapshots in the MFS:", entries)
+	}
+}
+
+func TestFollowDir(t *testing.T) {
+	fk := newFakeKubo()
+	defer fk.Close()
+	source := testDirKey(t, "source", map[string]string{"a.txt": "a", "sub/b.txt": "b", "sub/deep/c.txt": "c"})
+	s := testSyncer(t, fk, &Options{Ignore: []string{"*.swp"}})
+	if err := s.AddDir(source); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	follower := &DirKey{ID: "follower", Dir: filepath.Join(t.TempDir(), "follower"), Follow: "/ipns/" + source.GetKey()}
+	if err := s.AddDir(follower); err != nil {
+		t.Fatal(err)
+	}
+	read := func(name string) string {
+		data, err := ioutil.ReadFile(filepath.Join(follower.Dir, filepath.FromSlash(name)))
+		if err != nil {
+			return "<missing>"
+		}
+		return string(data)
+	}
+	for name, want := range map[string]string{"a.txt": "a", "sub/b.txt": "b", "sub/deep/c.txt": "c"} {
+		if got := read(name); got != want {
+			t.Errorf("%s contains '%s', expected '%s'", name, got, want)
+		}
+	}
+	if follower.GetCID() != fk.Resolve(source.ID) {
+		t.Error("Follower CID isn't the followed root")
+	}
+
+	// change the source, and make some local changes which should be left alone or undone
+	writeFiles(t, source.Dir, map[string]string{"a.txt": "changed", "new.txt": "new"})
+	os.RemoveAll(filepath.Join(source.Dir, "sub", "deep"))
+	waitFor(t, "source changes to be added", func() bool {
+		changed, _ := fk.Cat(s.basePath + source.MFSPath + "/a.txt")
+		return changed == "changed" && s.GetFileCID(s.Context(), source.MFSPath+"/new.txt") != "" &&
+			s.GetFileCID(s.Context(), source.MFSPath+"/sub/deep") == ""
+	})
+	if !s.PublishDir(source, false) {
+		t.Fatal("Source wasn't published")
+	}
+	writeFiles(t, follower.Dir, map[string]string{"sub/b.txt": "edited", "local.swp": "swap", "mine.txt": "mine",
+		"sub/mine.txt": "mine too"})
+	if err := os.Mkdir(filepath.Join(follower.Dir, "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.FollowDir(follower, false); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"a.txt": "changed", "new.txt": "new", "sub/b.txt": "b", "local.swp": "swap",
+		"sub/deep/c.txt": "<missing>", "mine.txt": "mine", "sub/mine.txt": "mine too"} {
+		if got := read(name); got != want {
+			t.Errorf("%s contains '%s', expected '%s'", name, got, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(follower.Dir, "sub", "deep")); err == nil {
+		t.Error("Removed directory wasn't deleted")
+	}
+	if _, err := os.Stat(filepath.Join(follower.Dir, "empty")); err != nil {
+		t.Error("Local directory was deleted")
+	}
+	if s.PublishDir(follower, true) {
+		t.Error("Follower was published")
+	}
+}
+
+func TestMergeRemote(t *testing.T) {
+	fk := newFakeKubo()
+	defer fk.Close()
+	// two instances on the same node share the key, like two nodes with it imported
+	newInstance := func(name string, files map[string]string) (*Syncer, *DirKey) {
+		dk := testDirKey(t, "shared", files)
+		dk.TwoWay = true
+		s := testSyncer(t, fk, &Options{
+			BasePath: "/" + name + "/",
+			DB:       filepath.Join(t.TempDir(), "db"),
+			Dirs:     []*DirKey{dk},
+		})
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+		return s, dk
+	}
+	read := func(dk *DirKey, name string) string {
+		data, err := ioutil.ReadFile(filepath.Join(dk.Dir, filepath.FromSlash(name)))
+		if err != nil {
+			return "<missing>"
+		}
+		return string(data)
+	}
+	s1, dk1 := newInstance("one", map[string]string{"a.txt": "a", "b.txt": "b", "sub/c.txt": "c"})
+	defer s1.Stop()
+	s2, dk2 := newInstance("two", nil)
+	defer s2.Stop()
+
+	// the second instance starts out empty, so it takes everything
+	if err := s2.MergeRemote(dk2); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"a.txt": "a", "b.txt": "b", "sub/c.txt": "c"} {
+		if got := read(dk2, name); got != want {
+			t.Errorf("%s contains '%s', expected '%s'", name, got, want)
+		}
+	}
+	s2.PublishDir(dk2, false)
+
+	// both change sub/c.txt, and each changes something else
+	writeFiles(t, dk1.Dir, map[string]string{"a.txt": "one", "sub/c.txt": "one"})
+	waitFor(t, "changes to be added", func() bool {
+		a, _ := fk.Cat("/one/" + dk1.MFSPath + "/a.txt")
+		c, _ := fk.Cat("/one/" + dk1.MFSPath + "/sub/c.txt")
+		return a == "one" && c == "one"
+	})
+	if err := s1.MergeRemote(dk1); err != nil {
+		t.Fatal(err)
+	}
+	if !s1.PublishDir(dk1, false) {
+		t.Fatal("First instance wasn't published")
+	}
+	writeFiles(t, dk2.Dir, map[string]string{"sub/c.txt": "two"})
+	os.Remove(filepath.Join(dk2.Dir, "b.txt"))
+	waitFor(t, "changes to be added", func() bool {
+		c, _ := fk.Cat("/two/" + dk2.MFSPath + "/sub/c.txt")
+		return c == "two" && s2.GetFileCID(s2.Context(), dk2.MFSPath+"/b.txt") == ""
+	})
+	if err := s2.MergeRemote(dk2); err != nil {
+		t.Fatal(err)
+	}
+	if !s2.PublishDir(dk2, false) {
+		t.Fatal("Second instance wasn't published")
+	}
+	if err := s1.MergeRemote(dk1); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dk := range []*DirKey{dk1, dk2} {
+		for name, want := range map[string]string{"a.txt": "one", "b.txt": "<missing>", "sub/c.txt": "two"} {
+			if got := read(dk, name); got != want {
+				t.Errorf("%s contains '%s', expected '%s'", name, got, want)
+			}
+		}
+		conflicts, _ := filepath.Glob(filepath.Join(dk.Dir, "sub", "c"+ConflictSuffix+"*.txt"))
+		if len(conflicts) != 1 {
+			t.Errorf("Expected one conflict copy in %s, found %v", dk.Dir, conflicts)
+		} else if got := read(dk, "sub/"+filepath.Base(conflicts[0])); got != "one" {
+			t.Errorf("Conflict copy contains '%s', expected 'one'", got)
+		}
+	}
+	if s1.GetFileCID(s1.Context(), dk1.MFSPath) != fk.Resolve(dk1.ID) {
+		t.Error("First instance doesn't match what was published after merging")
+	}
+
+	// if a file can't be downloaded, the merge fails and is tried again next time
+	writeFiles(t, dk1.Dir, map[string]string{"d.txt": "d"})
+	waitFor(t, "d.txt to be added", func() bool { return s1.GetFileCID(s1.Context(), dk1.MFSPath+"/d.txt") != "" })
+	if !s1.PublishDir(dk1, false) {
+		t.Fatal("First instance wasn't published")
+	}
+	remote, dCID := fk.Resolve(dk1.ID), fakeCID([]byte("d"))
+	fk.lock.Lock()
+	dBlock := fk.blocks[dCID]
+	delete(fk.blocks, dCID)
+	fk.lock.Unlock()
+	if err := s2.MergeRemote(dk2); err == nil {
+		t.Error("Merging a file that can't be downloaded succeeded")
+	}
+	if s2.mergeBase(dk2) == remote || read(dk2, "d.txt") != "<missing>" {
+		t.Error("Failed merge moved the merge base on")
+	}
+	fk.lock.Lock()
+	fk.blocks[dCID] = dBlock
+	fk.lock.Unlock()
+	if err := s2.MergeRemote(dk2); err != nil {
+		t.Fatal(err)
+	}
+	if s2.mergeBase(dk2) != remote || read(dk2, "d.txt") != "d" {
+		t.Error("Merge wasn't retried")
+	}
+}
+
+func TestManualPublish(t *testing.T) {
+	fk := newFakeKubo()
+	defer fk.Close()
+	dk := testDirKey(t, "manual", map[string]string{"index.html": "hello", "css/site.css": "body{}", "old.txt": "old"})
+	dk.Manual, dk.Confirm = true, true
+	s := testSyncer(t, fk, &Options{Sync: time.Millisecond * 50, Dirs: []*DirKey{dk}})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	if fk.Resolve(dk.ID) != "" {
+		t.Fatal("Manual dir was published on its own")
+	}
+
+	root, changes, err := s.PendingChanges(dk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 3 || changes[0].Path != "css/site.css" || changes[0].Type != ChangeAdded || changes[0].Size != 6 {
+		t.Fatalf("Unexpected pending changes %+v", changes)
+	}
+	if err := s.Approve(dk, ""); err == nil {
+		t.Error("Approving without confirming the root didn't fail")
+	}
+	if err := s.Approve(dk, "bafyother"); !errors.Is(err, ErrRootChanged) {
+		t.Errorf("Approving the wrong root returned %v", err)
+	}
+	if err := s.Approve(dk, root); err != nil {
+		t.Fatal(err)
+	}
+	if fk.Resolve(dk.ID) != root {
+		t.Fatal("Approved root wasn't published")
+	}
+
+	writeFiles(t, dk.Dir, map[string]string{"index.html": "hello, world", "new.txt": "new"})
+	os.Remove(filepath.Join(dk.Dir, "old.txt"))
+	var pending []*Change
+	waitFor(t, "changes to be added", func() bool {
+		_, pending, err = s.PendingChanges(dk)
+		return err == nil && len(pending) == 3
+	})
+	want := []Change{{"index.html", ChangeModified, 12}, {"new.txt", ChangeAdded, 3}, {"old.txt", ChangeRemoved, 3}}
+	for i, change := range pending {
+		if *change != want[i] {
+			t.Errorf("Pending change %d is %+v, expected %+v", i, *change, want[i])
+		}
+	}
+	time.Sleep(time.Millisecond * 200) // a few publish loops
+	if fk.Resolve(dk.ID) != root {
+		t.Error("Manual dir was published without being approved")
+	}
+
+	// nor is it republished when its record can't be resolved on startup
+	s.Stop()
+	fk.lock.Lock()
+	delete(fk.records, fk.keys[KeySpace+dk.ID])
+	fk.lock.Unlock()
+	s = testSyncer(t, fk, &Options{Sync: time.Millisecond * 50, Dirs: []*DirKey{dk}})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	time.Sleep(time.Millisecond * 200)
+	if fk.Resolve(dk.ID) != "" {
+		t.Error("Manual dir was republished without being approved")
+	}
+}
+
+func TestAtomicPublish(t *testing.T) {
+	fk := newFakeKubo()
+	defer fk.Close()
+	dk := testDirKey(t, "atomic", map[string]string{"index.html": "hello"})
+	dk.Atomic = true
+	s := testSyncer(t, fk, &Options{DB: filepath.Join(t.TempDir(), "db"), Dirs: []*DirKey{dk}})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	root := s.GetFileCID(s.Context(), dk.MFSPath)
+	if root == "" || fk.Resolve(dk.ID) != root || s.GetFileCID(s.Context(), StagingDir+"/"+dk.MFSPath) != root {
+		t.Fatal("Dir wasn't committed and published")
+	}
+
+	// while a batch is still being added, nothing is committed or published
+	dk.beginAdd()
+	writeFiles(t, dk.Dir, map[string]string{"index.html": "<img src=logo.png>", "logo.png": "logo"})
+	waitFor(t, "changes to be staged", func() bool {
+		data, _ := fk.Cat(s.basePath + StagingDir + "/" + dk.MFSPath + "/index.html")
+		return data == "<img src=logo.png>" && s.GetFileCID(s.Context(), StagingDir+"/"+dk.MFSPath+"/logo.png") != ""
+	})
+	if err := s.Approve(dk, ""); !errors.Is(err, ErrNotSettled) {
+		t.Errorf("Approving mid-batch returned %v", err)
+	}
+	if s.GetFileCID(s.Context(), dk.MFSPath) != root || s.GetFileCID(s.Context(), dk.MFSPath+"/logo.png") != "" {
+		t.Error("Staged changes were committed mid-batch")
+	}
+	dk.endAdd()
+	waitFor(t, "dir to be published once the batch was done", func() bool { return s.PublishDir(dk, false) })
+	if data, _ := fk.Cat(s.basePath + dk.MFSPath + "/index.html"); data != "<img src=logo.png>" {
+		t.Errorf("Committed index.html contains '%s'", data)
+	}
+	if fk.Resolve(dk.ID) != s.GetFileCID(s.Context(), StagingDir+"/"+dk.MFSPath) {
+		t.Error("Published root doesn't match the staged root")
+	}
+	if s.GetFileCID(s.Context(), StagingDir+"/.commit-"+dk.MFSPath) != "" {
+		t.Error("Commit was left behind in the staging dir")
+	}
+
+	// nor while a rename is waiting to be paired up
+	dk.addMoving(1)
+	writeFiles(t, dk.Dir, map[string]string{"about.html": "about"})
+	waitFor(t, "change to be staged", func() bool {
+		return s.GetFileCID(s.Context(), StagingDir+"/"+dk.MFSPath+"/about.html") != ""
+	})
+	if err := s.Approve(dk, ""); !errors.Is(err, ErrNotSettled) {
+		t.Errorf("Approving mid-move returned %v", err)
+	}
+	dk.addMoving(-1)
+	waitFor(t, "dir to be published once the move was done", func() bool { return s.PublishDir(dk, false) })
+	if s.GetFileCID(s.Context(), dk.MFSPath+"/about.html") == "" {
+		t.Error("Staged change wasn't committed")
+	}
+}
+
+func TestExport(t *testing.T) {
+	fk := newFakeKubo()
+	defer fk.Close()
+	dk := testDirKey(t, "exported", map[string]string{"index.html": "v1"})
+	dk.Export = &ExportPolicy{Dir: filepath.Join(t.TempDir(), "cars"), Keep: 2}
+	s := testSyncer(t, fk, &Options{Dirs: []*DirKey{dk}})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	roots := []string{fk.Resolve(dk.ID)}
+	for _, version := range []string{"v2", "v3"} {
+		writeFiles(t, dk.Dir, map[string]string{"index.html": version})
+		waitFor(t, version+" to be added", func() bool {
+			data, _ := fk.Cat(s.basePath + dk.MFSPath + "/index.html")
+			return data == version
+		})
+		if !s.PublishDir(dk, false) {
+			t.Fatal("Dir wasn't published")
+		}
+		roots = append(roots, fk.Resolve(dk.ID))
+	}
+	waitFor(t, "roots to be exported", func() bool {
+		exports, _ := s.Exports(dk)
+		return len(exports) == 2 && strings.HasSuffix(exports[1], roots[2]+".car")
+	})
+	// an export of another dir isn't rotated away
+	other := filepath.Join(dk.Export.Dir, dk.ID+"_old_2020-01-01T000000.000Z_bafyother.car")
+	if err := ioutil.WriteFile(other, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	exports, err := s.Exports(dk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exports) != 2 || !strings.HasSuffix(exports[0], roots[1]+".car") || !strings.HasSuffix(exports[1], roots[2]+".car") {
+		t.Fatalf("Unexpected exports %v of %v", exports, roots)
+	}
+	data, err := ioutil.ReadFile(exports[1])
+	if err != nil || !strings.HasPrefix(string(data), "car "+roots[2]+"\n") || !strings.Contains(string(data), "v3") {
+		t.Errorf("Unexpected export '%s', %v", data, err)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Error("Export of another dir was removed")
+	}
+
+	if err := s.ExportCAR("bafymissing", filepath.Join(dk.Export.Dir, "missing.car")); err == nil {
+		t.Error("Exporting a missing root didn't fail")
+	}
+	if _, err := os.Stat(filepath.Join(dk.Export.Dir, "missing.car")); err == nil {
+		t.Error("Failed export was left behind")
+	}
+}
+
+func TestRestore(t *testing.T) {
+	fk := newFakeKubo()
+	defer fk.Close()
+	files := map[string]string{"index.html": "hello", "sub/a.txt": "a", "sub/deeper/b.txt": "b"}
+	dk := testDirKey(t, "restored", files)
+	s := testSyncer(t, fk, &Options{DB: filepath.Join(t.TempDir(), "db"), Dirs: []*DirKey{dk}})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	root := fk.Resolve(dk.ID)
+	s.Stop()
+
+	target := t.TempDir()
+	if n, err := s.Restore(nil, root, "sub", target); err != nil || n != 2 {
+		t.Fatalf("Restoring a subpath restored %d files, %v", n, err)
+	}
+	for name, want := range map[string]string{"a.txt": "a", "deeper/b.txt": "b"} {
+		if data, err := ioutil.ReadFile(filepath.Join(target, filepath.FromSlash(name))); err != nil || string(data) != want {
+			t.Errorf("%s contains '%s', expected '%s' (%v)", name, data, want, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(target, "index.html")); err == nil {
+		t.Error("File outside the subpath was restored")
+	}
+
+	// a file that doesn't match its CID doesn't replace anything
+	fk.lock.Lock()
+	good := fk.blocks[fakeCID([]byte("a"))].data
+	fk.blocks[fakeCID([]byte("a"))].data = []byte("tampered")
+	fk.lock.Unlock()
+	if _, err := s.Restore(nil, root, "sub/a.txt", target); err == nil {
+		t.Error("Restoring a tampered file didn't fail")
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(target, "a.txt")); string(data) != "a" {
+		t.Errorf("Tampered file replaced a.txt with '%s'", data)
+	}
+	fk.lock.Lock()
+	fk.blocks[fakeCID([]byte("a"))].data = good
+	fk.lock.Unlock()
+
+	// restoring a dir on a new machine seeds its DB and MFS copy, so nothing's added again
+	if err := os.RemoveAll(dk.Dir); err != nil {
+		t.Fatal(err)
+	}
+	var added int
+	var lock sync.Mutex
+	s = testSyncer(t, fk, &Options{
+		DB:   filepath.Join(t.TempDir(), "db"),
+		Dirs: []*DirKey{dk},
+		OnFileAdded: func(dk *DirKey, path, cid string) {
+			lock.Lock()
+			added++
+			lock.Unlock()
+		},
+	})
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	s.RemoveFile(s.Context(), dk.MFSPath)
+	if n, err := s.Restore(dk, root, "", dk.Dir); err != nil || n != 3 {
+		t.Fatalf("Restoring the dir restored %d files, %v", n, err)
+	}
+	if s.GetFileCID(s.Context(), dk.MFSPath) != root {
+		t.Error("MFS copy wasn't restored")
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	// restoring into the dir while it's watched doesn't add what was restored again either
+	if n, err := s.Restore(dk, root, "", dk.Dir); err != nil || n != 3 {
+		t.Fatalf("Restoring the watched dir restored %d files, %v", n, err)
+	}
+	time.Sleep(time.Millisecond * 500)
+	waitFor(t, "the restored files to be handled", func() bool {
+		_, ok := dk.settled()
+		return ok
+	})
+	lock.Lock()
+	defer lock.Unlock()
+	if added != 0 {
+		t.Errorf("%d restored files were added again", added)
+	}
+}
+
+func TestDiffVersions(t *testing.T) {
+	fk := newFakeKubo()
+	defer fk.Close()
+	dk := testDirKey(t, "diffed", map[string]string{"index.html": "hello", "old.txt": "old", "sub/same.txt": "same"})
+	s := testSyncer(t, fk, &Options{DB: filepath.Join(t.TempDir(), "db"), Dirs: []*DirKey{dk}})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	first := dk.GetCID()
+
+	writeFiles(t, dk.Dir, map[string]string{"index.html": "hello, world", "sub/new.txt": "new"})
+	os.Remove(filepath.Join(dk.Dir, "old.txt"))
+	waitFor(t, "changes to be added", func() bool {
+		_, changes, err := s.PendingChanges(dk)
+		return err == nil && len(changes) == 3
+	})
+	if !s.PublishDir(dk, false) {
+		t.Fatal("Dir wasn't published")
+	}
+	second := dk.GetCID()
+
+	from, to, changes, err := s.DiffVersions(dk.ID, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != first || to != second {
+		t.Errorf("Compared %s to %s, expected %s to %s", from, to, first, second)
+	}
+	want := []Change{{"index.html", ChangeModified, 12}, {"old.txt", ChangeRemoved, 3}, {"sub/new.txt", ChangeAdded, 3}}
+	if len(changes) != len(want) {
+		t.Fatalf("Unexpected changes %+v", changes)
+	}
+	for i, change := range changes {
+		if *change != want[i] {
+			t.Errorf("Change %d is %+v, expected %+v", i, *change, want[i])
+		}
+	}
+	if _, _, changes, err := s.DiffVersions(dk.ID, second, first); err != nil || len(changes) != 3 || changes[2].Type != ChangeRemoved {
+		t.Errorf("Diffing backwards returned %+v, %v", changes, err)
+	}
+
+	records, err := s.History(dk.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff := records[len(records)-1].Diff
+	if diff == nil || *diff != (DiffSummary{Added: 1, Removed: 1, Modified: 1, Size: 15}) {
+		t.Errorf("Unexpected diff in the publish history %+v", diff)
+	}
+	if diff.String() != "1 added, 1 removed, 1 modified (15 B)" {
+		t.Errorf("Unexpected summary '%s'", diff)
+	}
+
+	// summaries of publishes which changed too much are given up on
+	defer func(limit int) { SummaryLimit = limit }(SummaryLimit)
+	SummaryLimit = 1
+	if diff := s.summarize(dk, first, second); diff == nil || !diff.Unavailable || diff.String() != "diff unavailable" {
+		t.Errorf("Summary past the limit is %+v", diff)
+	}
+}
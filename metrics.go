@@ -0,0 +1,19 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+// StartMetrics starts serving the syncer's metrics on MetricsAddr at /metrics, if it's set.
+func StartMetrics() {
+	if MetricsAddr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", syncer.MetricsHandler())
+	log.Println("Serving metrics on", MetricsAddr)
+	go func() {
+		log.Println("Metrics server stopped:", http.ListenAndServe(MetricsAddr, mux))
+	}()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+var (
+	reloadLock   sync.Mutex        // makes sure only one reload happens at a time
+	loadedConfig *ConfigFileStruct // the config file as it was last loaded
+)
+
+// ReloadConfig rereads ConfigFile, applying any changes to the running dirs and settings. Flags still override the
+// config file, and settings which can only be changed by restarting are left alone.
+func ReloadConfig() {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	log.Println("Reloading config file", ConfigFile)
+	cfg, err := readConfig(ConfigFile)
+	if err != nil {
+		log.Println("[ERROR] Error reloading config file:", err)
+		return
+	}
+	applyConfig(cfg)
+	applyFlags()
+
+	// compared with the config loaded last, as flags may have overridden what's in use
+	prev := loadedConfig
+	if prev == nil {
+		prev = new(ConfigFileStruct)
+	}
+	if cfg.BasePath != prev.BasePath || cfg.EndPoint != prev.EndPoint || cfg.DB != prev.DB ||
+		cfg.Concurrency != prev.Concurrency || cfg.ControlSocket != prev.ControlSocket ||
+		cfg.ControlAddr != prev.ControlAddr || cfg.MetricsAddr != prev.MetricsAddr {
+		log.Println("BasePath, EndPoint, DB, Concurrency, ControlSocket, ControlAddr, and MetricsAddr changes require a restart, ignoring...")
+	}
+	loadedConfig = cfg
+
+	opts := buildOptions()
+	if len(DirKeysFlag.DirKeys) > 0 {
+		// dirs were given as a flag, which the config file can't override
+		opts.Dirs = syncer.Dirs()
+	} else {
+		opts.Dirs = cfg.Dirs
+	}
+	syncer.Reload(opts)
+}
+
+// WatchConfig reloads the config on SIGHUP, and whenever ConfigFile changes.
+func WatchConfig() {
+	if ConfigFile == "" {
+		return
+	}
+	reload := make(chan bool, 1)
+	trigger := func() {
+		select {
+		case reload <- true:
+		default:
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			trigger()
+		}
+	}()
+
+	// Editors often replace the file instead of writing to it, so watch the directory it's in.
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Println("[ERROR] Failed to watch config file:", err)
+	} else if err := watcher.Add(filepath.Dir(ConfigFile)); err != nil {
+		log.Println("[ERROR] Failed to watch config file:", err)
+		watcher.Close()
+	} else {
+		go func() {
+			defer watcher.Close()
+			for {
+				select {
+				case event, ok := <-watcher.Events:
+					if !ok {
+						return
+					}
+					if filepath.Clean(event.Name) == filepath.Clean(ConfigFile) && event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+						trigger()
+					}
+				case err, ok := <-watcher.Errors:
+					if !ok {
+						return
+					}
+					log.Println("Error watching config file:", err)
+				}
+			}
+		}()
+	}
+
+	go func() {
+		for range reload {
+			// wait for the file to stop changing
+			time.Sleep(time.Second)
+			select {
+			case <-reload:
+			default:
+			}
+			ReloadConfig()
+		}
+	}()
+}